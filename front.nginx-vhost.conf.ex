@@ -17,4 +17,15 @@ server {
         autoindex on;
         alias /var/lib/bakapy/metadata;
     }
+
+    # Job scripts and logs saved apart from metadata (artifacts_dir)
+    location /artifacts {
+        alias /var/lib/bakapy/metadata_artifacts;
+    }
+
+    # Metadata api of scheduler, set http.api in bakapy.conf
+    # and API_URL in scripts/config.js to use it.
+    # location /api {
+    #     proxy_pass http://127.0.0.1:9877;
+    # }
 }
@@ -2,5 +2,9 @@
 
 var CONFIG = {
   STORAGE_URL: '/storage',
-  METADATA_URL: '/metadata'
+  METADATA_URL: '/metadata',
+  ARTIFACTS_URL: '/artifacts',
+  // Scheduler metadata api (http.api), eg '/api'. Used instead of
+  // METADATA_URL directory listing if set.
+  API_URL: ''
 };
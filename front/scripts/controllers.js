@@ -19,15 +19,37 @@ bakapyControllers.controller('BackupListCtrl', ['$scope', '$http', '$location',
     }
   }]);
 
-bakapyControllers.controller('BackupDetailCtrl', ['$scope', '$http', '$routeParams', 'base64', 'CONFIG', '$location',
-  function($scope, $http, $routeParams, base64, CONFIG, $location) {
-    $http.get(CONFIG.METADATA_URL + '/' + $routeParams.id, {'responseType': 'json'}).success(function(data) {
-      var Duration = 0,
-          AvgSpeed = 0,
-          fileList = [],
+bakapyControllers.controller('BackupDetailCtrl', ['$scope', '$http', '$routeParams', 'base64', 'CONFIG', '$location', '$q',
+  function($scope, $http, $routeParams, base64, CONFIG, $location, $q) {
+    var metadataUrl = CONFIG.API_URL ? CONFIG.API_URL + '/metadata' : CONFIG.METADATA_URL;
+
+    // Output, errput and run log saved apart from metadata, api returns them inline
+    function loadArtifacts(data) {
+      var loads = [],
+          artifacts = data.Artifacts || [],
           i,
           j;
 
+      data.ArtifactLinks = [];
+      for (i = 0, j = artifacts.length; i < j; i++) {
+        (function(artifact) {
+          var source = CONFIG.ARTIFACTS_URL + '/' + data.TaskId + '/' + artifact.Name,
+              field = artifact.Name.charAt(0).toUpperCase() + artifact.Name.slice(1);
+
+          if (artifact.Gzip) {
+            data.ArtifactLinks.push({'source': encodeURI(source + '.gz'), 'name': artifact.Name, 'size': artifact.Size});
+            return;
+          }
+          loads.push($http.get(source, {'transformResponse': function(text) { return text; }}).success(function(text) {
+            data[field] = text;
+          }));
+        })(artifacts[i]);
+      }
+
+      return $q.all(loads);
+    }
+
+    $http.get(metadataUrl + '/' + $routeParams.id, {'responseType': 'json'}).success(function(data) {
       if (data.Output) {
         data.Output = base64.decode(data.Output);
       }
@@ -36,10 +58,28 @@ bakapyControllers.controller('BackupDetailCtrl', ['$scope', '$http', '$routePara
         data.Errput = base64.decode(data.Errput);
       }
 
+      if (data.Log) {
+        data.Log = base64.decode(data.Log);
+      }
+
+      loadArtifacts(data).finally(function() {
+        show(data);
+      });
+    });
+
+    function show(data) {
+      var Duration = 0,
+          AvgSpeed = 0,
+          fileList = [],
+          i,
+          j;
+
       if (data.Files) {
         for (i = 0, j = data.Files.length; i < j; i++) {
           fileList.push({
             'source': (encodeURI(CONFIG.STORAGE_URL + '/' + data.Namespace + '/' + data.Files[i].Name)),
+            'name': data.Files[i].Name,
+            'dedup': !!data.Files[i].Chunks,
             'size': data.Files[i].Size
           });
         }
@@ -57,5 +97,5 @@ bakapyControllers.controller('BackupDetailCtrl', ['$scope', '$http', '$routePara
       }
 
       $scope.backup = data;
-    });
+    }
   }]);
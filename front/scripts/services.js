@@ -7,6 +7,29 @@ var bakapyServices = angular.module('bakapyServices', []);
 bakapyServices.factory('Backups', ['$http', function($http) {
   var backups = {};
 
+  function add(item, source) {
+    if (item && item.JobName !== 'undefined') {
+      if (typeof backups[item.JobName] === 'undefined') {
+        backups[item.JobName] = [];
+      }
+
+      item._source = source;
+      backups[item.JobName].push(item);
+    }
+  }
+
+  if (CONFIG.API_URL) {
+    $http.get(CONFIG.API_URL + '/metadata', {'responseType': 'json'}).success(function(items) {
+      var i, j;
+
+      for (i = 0, j = items.length; i < j; i++) {
+        add(items[i], items[i].TaskId);
+      }
+    });
+
+    return backups;
+  }
+
   $http.get(CONFIG.METADATA_URL).success(function(data) {
     var links = jQuery(data).find('a'),
         href,
@@ -18,14 +41,7 @@ bakapyServices.factory('Backups', ['$http', function($http) {
 
       (function(_href) {
         $http.get(CONFIG.METADATA_URL + '/' + _href, {'responseType': 'json'}).success(function(item, status, headers, config) {
-          if (item && item.JobName !== 'undefined') {
-            if (typeof backups[item.JobName] === 'undefined') {
-              backups[item.JobName] = [];
-            }
-
-            item._source = _href;
-            backups[item.JobName].push(item);
-          }
+          add(item, _href);
         });
       })(href);
 
@@ -0,0 +1,97 @@
+package bakapy
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Read-only metadata API for web ui:
+//
+//	/api/metadata?job=&namespace=&status=&since=&until=&limit=
+//	/api/metadata/<task id>, with script, output and errput
+//
+// since and until are RFC3339 times.
+type APIHandler struct {
+	storage *Storage
+}
+
+func NewAPIHandler(storage *Storage) *APIHandler {
+	return &APIHandler{storage: storage}
+}
+
+func parseMetadataQuery(r *http.Request) (MetadataQuery, error) {
+	query := MetadataQuery{
+		JobName:   r.FormValue("job"),
+		Namespace: r.FormValue("namespace"),
+		Status:    r.FormValue("status"),
+	}
+	var err error
+	if since := r.FormValue("since"); since != "" {
+		if query.Since, err = time.Parse(time.RFC3339, since); err != nil {
+			return query, err
+		}
+	}
+	if until := r.FormValue("until"); until != "" {
+		if query.Until, err = time.Parse(time.RFC3339, until); err != nil {
+			return query, err
+		}
+	}
+	if limit := r.FormValue("limit"); limit != "" {
+		if query.Limit, err = strconv.Atoi(limit); err != nil {
+			return query, err
+		}
+	}
+	return query, query.Validate()
+}
+
+func writeJSON(w http.ResponseWriter, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(value)
+}
+
+func (h *APIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if r.URL.Path == "/api/metadata" {
+		h.serveList(w, r)
+		return
+	}
+	taskId := TaskId(strings.TrimPrefix(r.URL.Path, "/api/metadata/"))
+	if !strings.HasPrefix(r.URL.Path, "/api/metadata/") || !safeTaskId(taskId) {
+		http.NotFound(w, r)
+		return
+	}
+	metadata, err := h.storage.Metadata.Get(taskId)
+	if err == nil {
+		err = h.storage.Artifacts.Inline(metadata)
+	}
+	if err != nil {
+		if os.IsNotExist(err) {
+			http.NotFound(w, r)
+		} else {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+		return
+	}
+	writeJSON(w, metadata)
+}
+
+func (h *APIHandler) serveList(w http.ResponseWriter, r *http.Request) {
+	query, err := parseMetadataQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	metadatas, err := h.storage.Metadata.List(query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, metadatas)
+}
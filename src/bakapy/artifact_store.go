@@ -0,0 +1,152 @@
+package bakapy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+)
+
+// Artifact names
+const (
+	ARTIFACT_SCRIPT = "script"
+	ARTIFACT_OUTPUT = "output"
+	ARTIFACT_ERRPUT = "errput"
+	ARTIFACT_LOG    = "log"
+)
+
+// Keeps job script, output, errput and run log out of metadata, in
+// $artifacts_dir/<task id>/<name>[.gz], so metadata stays small
+// for listing and cleanup.
+type ArtifactStore struct {
+	Dir  string
+	Gzip bool
+}
+
+func NewArtifactStore(cfg *Config) *ArtifactStore {
+	dir := cfg.ArtifactsDir
+	if dir == "" {
+		dir = cfg.MetadataDir + "_artifacts"
+	}
+	return &ArtifactStore{Dir: dir, Gzip: cfg.ArtifactsGzip}
+}
+
+func artifactFields(metadata *JobMetadata) map[string]*[]byte {
+	return map[string]*[]byte{
+		ARTIFACT_SCRIPT: &metadata.Script,
+		ARTIFACT_OUTPUT: &metadata.Output,
+		ARTIFACT_ERRPUT: &metadata.Errput,
+		ARTIFACT_LOG:    &metadata.Log,
+	}
+}
+
+func (a *ArtifactStore) Path(taskId TaskId, artifact JobMetadataArtifact) string {
+	name := artifact.Name
+	if artifact.Gzip {
+		name += ".gz"
+	}
+	return path.Join(a.Dir, string(taskId), name)
+}
+
+func (a *ArtifactStore) write(taskId TaskId, artifact JobMetadataArtifact, content []byte) error {
+	filePath := a.Path(taskId, artifact)
+	if err := os.MkdirAll(path.Dir(filePath), 0750); err != nil {
+		return err
+	}
+	if artifact.Gzip {
+		compressed := new(bytes.Buffer)
+		writer := gzip.NewWriter(compressed)
+		writer.Write(content)
+		if err := writer.Close(); err != nil {
+			return err
+		}
+		content = compressed.Bytes()
+	}
+	if err := ioutil.WriteFile(filePath+".tmp", content, 0640); err != nil {
+		return err
+	}
+	return os.Rename(filePath+".tmp", filePath)
+}
+
+// Save script, output, errput and run log of metadata and return
+// its copy referencing them instead of containing
+func (a *ArtifactStore) Split(metadata *JobMetadata) (*JobMetadata, error) {
+	if !safeTaskId(metadata.TaskId) {
+		return nil, errors.New("bad task id '" + string(metadata.TaskId) + "'")
+	}
+	summary := *metadata
+	summary.Artifacts = append([]JobMetadataArtifact(nil), metadata.Artifacts...)
+	fields := artifactFields(&summary)
+	for _, name := range []string{ARTIFACT_SCRIPT, ARTIFACT_OUTPUT, ARTIFACT_ERRPUT, ARTIFACT_LOG} {
+		content := *fields[name]
+		if len(content) == 0 {
+			continue
+		}
+		artifact := JobMetadataArtifact{Name: name, Size: int64(len(content)), Gzip: a.Gzip}
+		if err := a.write(metadata.TaskId, artifact, content); err != nil {
+			return nil, errors.New("cannot save " + name + ": " + err.Error())
+		}
+		*fields[name] = nil
+		summary.Artifacts = append(summary.Artifacts, artifact)
+	}
+	return &summary, nil
+}
+
+func (a *ArtifactStore) Read(taskId TaskId, artifact JobMetadataArtifact) ([]byte, error) {
+	if !safeTaskId(taskId) {
+		return nil, errors.New("bad task id '" + string(taskId) + "'")
+	}
+	content, err := ioutil.ReadFile(a.Path(taskId, artifact))
+	if err != nil || !artifact.Gzip {
+		return content, err
+	}
+	reader, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(reader)
+}
+
+// Load referenced artifacts back into metadata, as it was before
+// split. Unknown artifacts are kept referenced.
+func (a *ArtifactStore) Inline(metadata *JobMetadata) error {
+	fields := artifactFields(metadata)
+	kept := []JobMetadataArtifact{}
+	for _, artifact := range metadata.Artifacts {
+		field, known := fields[artifact.Name]
+		if !known {
+			kept = append(kept, artifact)
+			continue
+		}
+		content, err := a.Read(metadata.TaskId, artifact)
+		if err != nil {
+			return errors.New("cannot load " + artifact.Name + ": " + err.Error())
+		}
+		*field = content
+	}
+	if len(kept) == 0 {
+		kept = nil
+	}
+	metadata.Artifacts = kept
+	return nil
+}
+
+func (a *ArtifactStore) Delete(taskId TaskId) error {
+	if !safeTaskId(taskId) {
+		return nil
+	}
+	return os.RemoveAll(path.Join(a.Dir, string(taskId)))
+}
+
+// Save metadata with script, output, errput and log split to artifacts.
+// Metadata is saved with them inline if artifacts cannot be saved.
+func (stor *Storage) SaveMetadata(metadata *JobMetadata) error {
+	summary, err := stor.Artifacts.Split(metadata)
+	if err != nil {
+		stor.logger.Warning("cannot save artifacts of task %s, keeping them in metadata: %s", metadata.TaskId, err)
+		summary = metadata
+	}
+	return stor.Metadata.Save(summary)
+}
@@ -0,0 +1,94 @@
+package bakapy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestArtifactStore_SplitInline(t *testing.T) {
+	for _, gzip := range []bool{false, true} {
+		dir, cleanup := metadataStoreTestDir(t)
+		defer cleanup()
+		artifacts := &ArtifactStore{Dir: dir, Gzip: gzip}
+		metadata := &JobMetadata{TaskId: "one", Script: []byte("echo hi"), Output: []byte("hi\n")}
+		summary, err := artifacts.Split(metadata)
+		if err != nil {
+			t.Fatal("cannot split:", err)
+		}
+		if summary.Script != nil || summary.Output != nil || len(summary.Artifacts) != 2 {
+			t.Fatal("bad summary:", summary)
+		}
+		if string(metadata.Output) != "hi\n" {
+			t.Fatal("original metadata modified")
+		}
+		name := "output"
+		if gzip {
+			name += ".gz"
+		}
+		if _, err := os.Stat(path.Join(dir, "one", name)); err != nil {
+			t.Fatal("artifact file not found:", err)
+		}
+
+		if err := artifacts.Inline(summary); err != nil {
+			t.Fatal("cannot inline:", err)
+		}
+		if string(summary.Script) != "echo hi" || string(summary.Output) != "hi\n" || summary.Errput != nil || summary.Artifacts != nil {
+			t.Fatal("bad inlined metadata:", summary)
+		}
+
+		if err := artifacts.Delete("one"); err != nil {
+			t.Fatal("cannot delete:", err)
+		}
+		if _, err := os.Stat(path.Join(dir, "one")); !os.IsNotExist(err) {
+			t.Fatal("artifacts not deleted:", err)
+		}
+	}
+}
+
+func TestArtifactStore_BadTaskId(t *testing.T) {
+	artifacts := &ArtifactStore{Dir: "/nonexistent"}
+	if _, err := artifacts.Split(&JobMetadata{TaskId: "../x", Output: []byte("x")}); err == nil {
+		t.Fatal("bad task id accepted")
+	}
+}
+
+func TestStorage_SaveMetadata(t *testing.T) {
+	storage, cleanup := replicationStorage(t)
+	defer cleanup()
+	err := storage.SaveMetadata(&JobMetadata{TaskId: "one", Output: []byte("out"), Errput: []byte("err")})
+	if err != nil {
+		t.Fatal("cannot save:", err)
+	}
+	raw, _ := ioutil.ReadFile(path.Join(storage.MetadataDir, "one"))
+	metadata, _ := storage.Metadata.Get("one")
+	if metadata.Output != nil || len(metadata.Artifacts) != 2 || strings.Contains(string(raw), `"Output"`) {
+		t.Fatal("artifacts saved in metadata:", string(raw))
+	}
+
+	storage.removeTask(*metadata)
+	if _, err := os.Stat(path.Join(storage.Artifacts.Dir, "one")); !os.IsNotExist(err) {
+		t.Fatal("artifacts of removed task still present:", err)
+	}
+}
+
+func TestStorage_SaveMetadata_RunLog(t *testing.T) {
+	storage, cleanup := replicationStorage(t)
+	defer cleanup()
+	if err := storage.SaveMetadata(&JobMetadata{TaskId: "one", Log: []byte("starting up")}); err != nil {
+		t.Fatal("cannot save:", err)
+	}
+	metadata, _ := storage.Metadata.Get("one")
+	if metadata.Log != nil || len(metadata.Artifacts) != 1 || metadata.Artifacts[0].Name != ARTIFACT_LOG {
+		t.Fatal("run log saved in metadata:", metadata)
+	}
+	if migrated, err := storage.MigrateMetadata(true); err != nil || len(migrated) != 0 {
+		t.Fatal("saved metadata needs migration:", migrated, err)
+	}
+	storage.Artifacts.Inline(metadata)
+	if string(metadata.Log) != "starting up" {
+		t.Fatal("bad run log:", string(metadata.Log))
+	}
+}
@@ -0,0 +1,173 @@
+package bakapy
+
+import (
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Backup types of tar listed-incremental commands
+const (
+	BACKUP_TYPE_FULL = "full"
+	BACKUP_TYPE_DIFF = "diff"
+	BACKUP_TYPE_INC  = "inc"
+)
+
+// Returns backup type from job backup_type argument or empty
+// string if job does not make chained backups.
+func BackupTypeFromArgs(args map[string]string) string {
+	switch backupType := args["backup_type"]; backupType {
+	case BACKUP_TYPE_FULL, BACKUP_TYPE_DIFF, BACKUP_TYPE_INC:
+		return backupType
+	}
+	return ""
+}
+
+// Backups with same chain key depend on each other. Jobs sharing
+// namespace, host and listed_incremental_dir make one chain, e.g.
+// separate full, diff and inc jobs of the same data. Backups of jobs
+// without listed_incremental_dir are chained within the job.
+func BackupChainKey(jobName, namespace, host string, args map[string]string) string {
+	source := args["listed_incremental_dir"]
+	if source == "" {
+		source = "job " + jobName
+	}
+	return path.Clean(namespace) + "|" + host + "|" + source
+}
+
+func (metadata *JobMetadata) ChainKey() string {
+	return BackupChainKey(metadata.JobName, metadata.Namespace, metadata.Host, metadata.Config.Args)
+}
+
+// Load all metadata files from directory. Files which
+// cannot be loaded returned as corrupted.
+func LoadMetadataDir(metadataDir string) ([]JobMetadata, []string, error) {
+	metadatas := []JobMetadata{}
+	corrupted := []string{}
+	visit := func(metaPath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return nil
+		}
+		metadata, err := LoadJobMetadata(metaPath)
+		if _, newer := err.(*MetadataVersionError); newer {
+			// saved by newer bakapy, leave it alone
+			return nil
+		}
+		if err != nil {
+			corrupted = append(corrupted, metaPath)
+			return nil
+		}
+		metadata.Filepath = metaPath
+		metadatas = append(metadatas, *metadata)
+		return nil
+	}
+	if err := filepath.Walk(metadataDir, visit); err != nil {
+		return nil, nil, err
+	}
+	return metadatas, corrupted, nil
+}
+
+// Find task which new backup of given type depends on: last successful
+// full backup for diff and last successful backup of any type for inc.
+// Returns empty TaskId for full backups or if there is no parent.
+func FindChainParent(metadatas []JobMetadata, chainKey, backupType string) TaskId {
+	if backupType != BACKUP_TYPE_DIFF && backupType != BACKUP_TYPE_INC {
+		return ""
+	}
+	var parent *JobMetadata
+	for i := range metadatas {
+		m := &metadatas[i]
+		if !m.Success || m.BackupType == "" || m.ChainKey() != chainKey {
+			continue
+		}
+		if backupType == BACKUP_TYPE_DIFF && m.BackupType != BACKUP_TYPE_FULL {
+			continue
+		}
+		if parent == nil || m.StartTime.After(parent.StartTime) {
+			parent = m
+		}
+	}
+	if parent == nil {
+		return ""
+	}
+	return parent.TaskId
+}
+
+// Full backup with all backups depending on it, sorted by start time.
+// Tasks without backup type are chains of one task.
+type BackupChain []JobMetadata
+
+func (chain BackupChain) Root() *JobMetadata {
+	return &chain[0]
+}
+
+// Chain expires when its last task expires
+func (chain BackupChain) ExpireTime() time.Time {
+	expire := chain[0].ExpireTime
+	for _, m := range chain[1:] {
+		if m.ExpireTime.After(expire) {
+			expire = m.ExpireTime
+		}
+	}
+	return expire
+}
+
+func (chain BackupChain) TotalSize() int64 {
+	var size int64
+	for _, m := range chain {
+		size += m.TotalSize
+	}
+	return size
+}
+
+// Group metadatas into chains by parent task id. Task whose parent
+// is missing starts own chain. Chains sorted by root start time.
+func BuildBackupChains(metadatas []JobMetadata) []BackupChain {
+	byId := map[TaskId]int{}
+	for i, m := range metadatas {
+		if m.TaskId != "" {
+			byId[m.TaskId] = i
+		}
+	}
+
+	rootOf := func(i int) int {
+		seen := map[int]bool{}
+		for {
+			seen[i] = true
+			parent, exist := byId[metadatas[i].ParentTaskId]
+			if metadatas[i].ParentTaskId == "" || !exist || seen[parent] {
+				return i
+			}
+			i = parent
+		}
+	}
+
+	order := make([]int, len(metadatas))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return metadatas[order[i]].StartTime.Before(metadatas[order[j]].StartTime)
+	})
+
+	chainIdx := map[int]int{}
+	chains := []BackupChain{}
+	for _, i := range order {
+		root := rootOf(i)
+		idx, exist := chainIdx[root]
+		if !exist {
+			idx = len(chains)
+			chainIdx[root] = idx
+			chains = append(chains, BackupChain{metadatas[root]})
+		}
+		if i != root {
+			chains[idx] = append(chains[idx], metadatas[i])
+		}
+	}
+	return chains
+}
@@ -0,0 +1,220 @@
+package bakapy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func chainMeta(taskId TaskId, backupType string, parent TaskId, hoursAgo int) JobMetadata {
+	return JobMetadata{
+		JobName:      "job",
+		TaskId:       taskId,
+		BackupType:   backupType,
+		ParentTaskId: parent,
+		Success:      true,
+		StartTime:    time.Now().Add(-time.Duration(hoursAgo) * time.Hour),
+	}
+}
+
+func TestBackupTypeFromArgs(t *testing.T) {
+	if BackupTypeFromArgs(map[string]string{"backup_type": "inc"}) != BACKUP_TYPE_INC {
+		t.Fatal("inc expected")
+	}
+	if BackupTypeFromArgs(map[string]string{"backup_type": "wow"}) != "" {
+		t.Fatal("unknown type must be empty")
+	}
+	if BackupTypeFromArgs(nil) != "" {
+		t.Fatal("no type must be empty")
+	}
+}
+
+func TestFindChainParent(t *testing.T) {
+	failed := chainMeta("failed", BACKUP_TYPE_INC, "inc1", 1)
+	failed.Success = false
+	otherHost := chainMeta("other", BACKUP_TYPE_FULL, "", 1)
+	otherHost.Host = "web2"
+	metadatas := []JobMetadata{
+		chainMeta("full1", BACKUP_TYPE_FULL, "", 10),
+		chainMeta("full2", BACKUP_TYPE_FULL, "", 6),
+		chainMeta("diff1", BACKUP_TYPE_DIFF, "full2", 4),
+		chainMeta("inc1", BACKUP_TYPE_INC, "diff1", 2),
+		chainMeta("untyped", "", "", 1),
+		failed,
+		otherHost,
+	}
+
+	chainKey := BackupChainKey("job", "", "", nil)
+	if parent := FindChainParent(metadatas, chainKey, BACKUP_TYPE_DIFF); parent != "full2" {
+		t.Fatal("diff must depend on last full, got", parent)
+	}
+	if parent := FindChainParent(metadatas, chainKey, BACKUP_TYPE_INC); parent != "inc1" {
+		t.Fatal("inc must depend on last successful backup, got", parent)
+	}
+	if parent := FindChainParent(metadatas, chainKey, BACKUP_TYPE_FULL); parent != "" {
+		t.Fatal("full must not have parent, got", parent)
+	}
+	if parent := FindChainParent(metadatas, BackupChainKey("job", "", "web3", nil), BACKUP_TYPE_INC); parent != "" {
+		t.Fatal("no parent expected for other host, got", parent)
+	}
+}
+
+// separate full, diff and inc jobs as in jobs.conf.ex.yaml
+func sharedChainMeta(taskId TaskId, backupType string, parent TaskId, hoursAgo int) JobMetadata {
+	m := chainMeta(taskId, backupType, parent, hoursAgo)
+	m.JobName = "vhosts-" + backupType
+	m.Namespace = "vhosts"
+	m.Host = "127.0.0.1"
+	m.Config.Args = map[string]string{"backup_type": backupType, "listed_incremental_dir": "/tmp/backup-meta"}
+	return m
+}
+
+func TestFindChainParent_SharedIncrementalDir(t *testing.T) {
+	otherDir := sharedChainMeta("other", BACKUP_TYPE_FULL, "", 1)
+	otherDir.Config.Args = map[string]string{"backup_type": BACKUP_TYPE_FULL, "listed_incremental_dir": "/tmp/other"}
+	metadatas := []JobMetadata{
+		sharedChainMeta("full1", BACKUP_TYPE_FULL, "", 10),
+		sharedChainMeta("diff1", BACKUP_TYPE_DIFF, "full1", 4),
+		otherDir,
+	}
+	chainKey := BackupChainKey("vhosts-diff", "vhosts", "127.0.0.1", map[string]string{"listed_incremental_dir": "/tmp/backup-meta"})
+	if parent := FindChainParent(metadatas, chainKey, BACKUP_TYPE_DIFF); parent != "full1" {
+		t.Fatal("diff must depend on full of other job, got", parent)
+	}
+	chainKey = BackupChainKey("vhosts-inc", "vhosts", "127.0.0.1", map[string]string{"listed_incremental_dir": "/tmp/backup-meta"})
+	if parent := FindChainParent(metadatas, chainKey, BACKUP_TYPE_INC); parent != "diff1" {
+		t.Fatal("inc must depend on diff of other job, got", parent)
+	}
+}
+
+func TestBuildBackupChains(t *testing.T) {
+	chains := BuildBackupChains([]JobMetadata{
+		chainMeta("inc2", BACKUP_TYPE_INC, "inc1", 1),
+		chainMeta("full1", BACKUP_TYPE_FULL, "", 10),
+		chainMeta("inc1", BACKUP_TYPE_INC, "full2", 2),
+		chainMeta("diff1", BACKUP_TYPE_DIFF, "full1", 8),
+		chainMeta("full2", BACKUP_TYPE_FULL, "", 6),
+		chainMeta("orphan", BACKUP_TYPE_INC, "removed", 3),
+	})
+	if len(chains) != 3 {
+		t.Fatal("3 chains expected, got", len(chains))
+	}
+	expected := [][]TaskId{
+		{"full1", "diff1"},
+		{"full2", "inc1", "inc2"},
+		{"orphan"},
+	}
+	order := map[TaskId]int{"full1": 0, "full2": 1, "orphan": 2}
+	for _, chain := range chains {
+		want := expected[order[chain.Root().TaskId]]
+		if len(chain) != len(want) {
+			t.Fatal("bad chain", chain.Root().TaskId, len(chain))
+		}
+		for i, m := range chain {
+			if m.TaskId != want[i] {
+				t.Fatal("bad chain order", chain.Root().TaskId, i, m.TaskId)
+			}
+		}
+	}
+}
+
+func TestBackupChain_ExpireTime(t *testing.T) {
+	full := chainMeta("full", BACKUP_TYPE_FULL, "", 3)
+	full.ExpireTime = time.Now().Add(-time.Hour)
+	inc := chainMeta("inc", BACKUP_TYPE_INC, "full", 1)
+	inc.ExpireTime = time.Now().Add(time.Hour)
+	chain := BackupChain{full, inc}
+	if chain.ExpireTime() != inc.ExpireTime {
+		t.Fatal("chain must expire with last backup")
+	}
+}
+
+func TestStorage_CleanupExpired_Chain(t *testing.T) {
+	config := NewConfig()
+	config.MetadataDir, _ = ioutil.TempDir("", "")
+	config.StorageDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(config.MetadataDir)
+	defer os.RemoveAll(config.StorageDir)
+	storage := NewStorage(config)
+	os.MkdirAll(path.Join(config.StorageDir, "ns"), 0755)
+
+	save := func(m JobMetadata, expired bool) string {
+		m.Namespace = "ns"
+		m.ExpireTime = time.Now().Add(time.Hour)
+		if expired {
+			m.ExpireTime = time.Now().Add(-time.Hour)
+		}
+		filename := string(m.TaskId) + ".tar"
+		ioutil.WriteFile(path.Join(config.StorageDir, "ns", filename), []byte("x"), 0644)
+		m.Files = []JobMetadataFile{{Name: filename}}
+		m.Save(path.Join(config.MetadataDir, string(m.TaskId)))
+		return filename
+	}
+	exists := func(taskId TaskId) bool {
+		_, err := os.Stat(path.Join(config.MetadataDir, string(taskId)))
+		_, dataErr := os.Stat(path.Join(config.StorageDir, "ns", string(taskId)+".tar"))
+		return err == nil && dataErr == nil
+	}
+
+	// expired chain
+	save(chainMeta("full1", BACKUP_TYPE_FULL, "", 10), true)
+	save(chainMeta("inc1", BACKUP_TYPE_INC, "full1", 9), true)
+	// expired full with active incremental
+	save(chainMeta("full2", BACKUP_TYPE_FULL, "", 6), true)
+	save(chainMeta("inc2", BACKUP_TYPE_INC, "full2", 5), true)
+	save(chainMeta("inc3", BACKUP_TYPE_INC, "inc2", 1), false)
+
+	if err := storage.CleanupExpired(); err != nil {
+		t.Fatal("error:", err)
+	}
+	if exists("full1") || exists("inc1") {
+		t.Fatal("expired chain not removed")
+	}
+	for _, taskId := range []TaskId{"full2", "inc2", "inc3"} {
+		if !exists(taskId) {
+			t.Fatal("backup with active dependent removed:", taskId)
+		}
+	}
+}
+
+func TestStorage_CleanupExpired_ChainAcrossJobs(t *testing.T) {
+	config := NewConfig()
+	config.MetadataDir, _ = ioutil.TempDir("", "")
+	config.StorageDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(config.MetadataDir)
+	defer os.RemoveAll(config.StorageDir)
+	storage := NewStorage(config)
+
+	save := func(m JobMetadata, expired bool) {
+		m.ExpireTime = time.Now().Add(time.Hour)
+		if expired {
+			m.ExpireTime = time.Now().Add(-time.Hour)
+		}
+		m.Save(path.Join(config.MetadataDir, string(m.TaskId)))
+	}
+	exists := func(taskId TaskId) bool {
+		_, err := os.Stat(path.Join(config.MetadataDir, string(taskId)))
+		return err == nil
+	}
+
+	// full job keeps runs for a day, diff job for a week
+	save(sharedChainMeta("full1", BACKUP_TYPE_FULL, "", 50), true)
+	save(sharedChainMeta("diff1", BACKUP_TYPE_DIFF, "full1", 48), true)
+	save(sharedChainMeta("full2", BACKUP_TYPE_FULL, "", 30), true)
+	save(sharedChainMeta("diff2", BACKUP_TYPE_DIFF, "full2", 26), false)
+	save(sharedChainMeta("full3", BACKUP_TYPE_FULL, "", 2), false)
+
+	if err := storage.CleanupExpired(); err != nil {
+		t.Fatal("error:", err)
+	}
+	if exists("full1") || exists("diff1") {
+		t.Fatal("expired chain not removed")
+	}
+	for _, taskId := range []TaskId{"full2", "diff2", "full3"} {
+		if !exists(taskId) {
+			t.Fatal("backup needed for restore removed:", taskId)
+		}
+	}
+}
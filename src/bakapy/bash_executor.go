@@ -2,10 +2,13 @@ package bakapy
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
 	"github.com/op/go-logging"
 	"io"
 	"os/exec"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -14,12 +17,31 @@ type Executer interface {
 	Execute(script []byte, output io.Writer, errput io.Writer) error
 }
 
+// Executers able to forward storage port over own connection.
+// OpenTunnel returns storage address as seen from remote host,
+// CloseTunnel waits for forwarded connections and closes tunnel.
+type TunnelExecuter interface {
+	Executer
+	OpenTunnel(storageAddr string) (string, error)
+	CloseTunnel() error
+}
+
+// Executers able to receive job files from job stdout,
+// see StreamDemuxer.
+type StreamExecuter interface {
+	Executer
+	SetStream(taskId TaskId, handler StorageConnHandler)
+}
+
 type BashExecutor struct {
-	Args   map[string]string
-	Host   string
-	Port   uint
-	Sudo   bool
-	logger *logging.Logger
+	Args      map[string]string
+	Host      string
+	Port      uint
+	Sudo      bool
+	Secrets   []string
+	Transport string
+	stream    *StreamDemuxer
+	logger    *logging.Logger
 }
 
 func NewBashExecutor(args map[string]string, host string, port uint, sudo bool) *BashExecutor {
@@ -32,22 +54,52 @@ func NewBashExecutor(args map[string]string, host string, port uint, sudo bool)
 	}
 }
 
-func (e *BashExecutor) GetCmd() (*exec.Cmd, error) {
-	var remoteCmd string
-	env := make([]string, len(e.Args))
-	for argName, argValue := range e.Args {
-		arg := fmt.Sprintf("%s='%s'", strings.ToUpper(argName), argValue)
-		env = append(env, arg)
+var envNameRe = regexp.MustCompile(`^[A-Z_][A-Z0-9_]*$`)
+
+// Quote value for safe use as single shell word
+func shellQuote(value string) string {
+	return "'" + strings.Replace(value, "'", `'\''`, -1) + "'"
+}
+
+// Returns export statements for job args. They are sent to remote
+// shell with the script, so values never appear in command line.
+func (e *BashExecutor) GetEnvScript() ([]byte, error) {
+	return argsEnvScript(e.Args)
+}
+
+func argsEnvScript(args map[string]string) ([]byte, error) {
+	names := make([]string, 0, len(args))
+	for argName := range args {
+		names = append(names, argName)
 	}
+	sort.Strings(names)
 
-	if e.Port == 0 {
-		e.Port = 22
+	env := new(bytes.Buffer)
+	for _, argName := range names {
+		envName := strings.ToUpper(argName)
+		if !envNameRe.MatchString(envName) {
+			return nil, errors.New("bad argument name '" + argName + "'")
+		}
+		fmt.Fprintf(env, "export %s=%s\n", envName, shellQuote(args[argName]))
 	}
+	return env.Bytes(), nil
+}
+
+func (e *BashExecutor) GetCmd() (*exec.Cmd, error) {
+	var remoteCmd string
 
 	if e.Sudo {
-		remoteCmd = fmt.Sprintf("sudo %s /bin/bash", strings.Join(env, " "))
+		remoteCmd = "sudo /bin/bash"
 	} else {
-		remoteCmd = fmt.Sprintf("%s /bin/bash", strings.Join(env, " "))
+		remoteCmd = "/bin/bash"
+	}
+	return e.getCmd(remoteCmd)
+}
+
+// Returns command running remoteCmd on job host
+func (e *BashExecutor) getCmd(remoteCmd string) (*exec.Cmd, error) {
+	if e.Port == 0 {
+		e.Port = 22
 	}
 
 	var args []string
@@ -79,17 +131,41 @@ func (e *BashExecutor) GetCmd() (*exec.Cmd, error) {
 	return cmd, nil
 }
 
+func (e *BashExecutor) SetStream(taskId TaskId, handler StorageConnHandler) {
+	remoteAddr := e.Host
+	if remoteAddr == "" {
+		remoteAddr = "localhost"
+	}
+	e.stream = NewStreamDemuxer(taskId, handler, remoteAddr)
+}
+
 func (e *BashExecutor) Execute(script []byte, output io.Writer, errput io.Writer) error {
+	if e.Transport == TRANSPORT_STDOUT {
+		return executeWithStream(e.stream, e.execute, script, output, errput)
+	}
+	return e.execute(script, output, errput)
+}
+
+func (e *BashExecutor) execute(script []byte, output io.Writer, errput io.Writer) error {
 	cmd, err := e.GetCmd()
 	if err != nil {
 		return err
 	}
+	return e.run(cmd, script, output, errput)
+}
+
+func (e *BashExecutor) run(cmd *exec.Cmd, script []byte, output io.Writer, errput io.Writer) error {
+	env, err := e.GetEnvScript()
+	if err != nil {
+		return err
+	}
+	script = append(env, script...)
 
 	cmd.Stderr = errput
 	cmd.Stdout = output
 	cmd.Stdin = bytes.NewReader(script)
 
-	e.logger.Debug(string(script))
+	e.logger.Debug("%s", RedactSecrets(script, e.Secrets))
 	e.logger.Debug("executing command '%s'",
 		strings.Join(cmd.Args, " "))
 
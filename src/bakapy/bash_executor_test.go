@@ -2,6 +2,7 @@ package bakapy
 
 import (
 	"bytes"
+	"os/exec"
 	"strings"
 	"testing"
 )
@@ -19,8 +20,10 @@ func TestBashExecutor_GetCmd_Local(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error:", err)
 	}
-	if strings.Join(cmd.Args, "|||") != "/bin/bash|||-c||| TEST='oneone' /bin/bash" {
-		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected '/bin/bash|||-c||| TEST='oneone' /bin/bash'")
+	bashPath, _ := exec.LookPath("bash")
+	expected_args := bashPath + "|||-c|||/bin/bash"
+	if strings.Join(cmd.Args, "|||") != expected_args {
+		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected", expected_args)
 	}
 	t.Log(cmd.Args)
 }
@@ -37,7 +40,8 @@ func TestBashExecutor_GetCmd_LocalSudo(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error:", err)
 	}
-	expected_args := "/bin/bash|||-c|||sudo  TEST='oneone' /bin/bash"
+	bashPath, _ := exec.LookPath("bash")
+	expected_args := bashPath + "|||-c|||sudo /bin/bash"
 	if strings.Join(cmd.Args, "|||") != expected_args {
 		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected", expected_args)
 	}
@@ -57,7 +61,7 @@ func TestBashExecutor_GetCmd_Remote(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error:", err)
 	}
-	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||2424||| TEST='oneone' /bin/bash"
+	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||2424|||/bin/bash"
 	if strings.Join(cmd.Args, "|||") != expected_args {
 		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected", expected_args)
 	}
@@ -77,7 +81,7 @@ func TestBashExecutor_GetCmd_RemoteSudo(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error:", err)
 	}
-	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||2424|||sudo  TEST='oneone' /bin/bash"
+	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||2424|||sudo /bin/bash"
 	if strings.Join(cmd.Args, "|||") != expected_args {
 		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected", expected_args)
 	}
@@ -97,7 +101,7 @@ func TestBashExecutor_GetCmd_RemoteNoPort(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error:", err)
 	}
-	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||22||| TEST='oneone' /bin/bash"
+	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||22|||/bin/bash"
 	if strings.Join(cmd.Args, "|||") != expected_args {
 		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected", expected_args)
 	}
@@ -115,7 +119,7 @@ func TestBashExecutor_GetCmd_RemoteNoArgs(t *testing.T) {
 	if err != nil {
 		t.Fatal("Error:", err)
 	}
-	if strings.Join(cmd.Args, "|||") != "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||2323||| /bin/bash" {
+	if strings.Join(cmd.Args, "|||") != "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||2323|||/bin/bash" {
 		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"))
 	}
 	t.Log(cmd.Args)
@@ -162,3 +166,76 @@ func TestBashExecutor_Execute_CommandFailed(t *testing.T) {
 		t.Fatalf("Errput must be 'some errput', not '%s'", errput)
 	}
 }
+
+func TestBashExecutor_GetEnvScript_Ok(t *testing.T) {
+	args := map[string]string{
+		"test":  "oneone",
+		"quote": "it's",
+	}
+	executor := NewBashExecutor(args, "", 0, false)
+	env, err := executor.GetEnvScript()
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	expected := "export QUOTE='it'\\''s'\nexport TEST='oneone'\n"
+	if string(env) != expected {
+		t.Fatalf("env script must be '%s', not '%s'", expected, env)
+	}
+}
+
+func TestBashExecutor_GetEnvScript_BadArgName(t *testing.T) {
+	args := map[string]string{
+		"test; rm -rf /": "oneone",
+	}
+	executor := NewBashExecutor(args, "", 0, false)
+	_, err := executor.GetEnvScript()
+	if err == nil || err.Error() != "bad argument name 'test; rm -rf /'" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestBashExecutor_Execute_HostileArgs(t *testing.T) {
+	hostileValues := []string{
+		"'; echo pwned; '",
+		"it's",
+		"$(echo pwned)",
+		"`echo pwned`",
+		"\"; echo pwned; \"",
+		"back\\slash\\",
+		"multi\nline\n; echo pwned",
+		"${HOME} $$ * ?",
+		"",
+	}
+	for _, value := range hostileValues {
+		args := map[string]string{"hostile": value}
+		executor := NewBashExecutor(args, "", 0, false)
+
+		script := []byte(`printf '%s' "$HOSTILE"`)
+		output := new(bytes.Buffer)
+		errput := new(bytes.Buffer)
+		err := executor.Execute(script, output, errput)
+		if err != nil {
+			t.Fatalf("Error for value %q: %s (%s)", value, err, errput)
+		}
+		if output.String() != value {
+			t.Fatalf("Output must be %q, not %q", value, output)
+		}
+		if errput.String() != "" {
+			t.Fatalf("Errput must be '', not %q", errput)
+		}
+	}
+}
+
+func TestBashExecutor_GetCmd_ArgsNotInCommandLine(t *testing.T) {
+	args := map[string]string{
+		"mysql_pwd": "s3cr3t",
+	}
+	executor := NewBashExecutor(args, "test-host.example", 22, true)
+	cmd, err := executor.GetCmd()
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if strings.Contains(strings.Join(cmd.Args, " "), "s3cr3t") {
+		t.Fatal("arg value found in command line:", cmd.Args)
+	}
+}
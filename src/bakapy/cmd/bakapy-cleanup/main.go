@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bakapy"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to config file")
+var LOG_LEVEL = flag.String("loglevel", "warning", "Log level")
+var DRY_RUN = flag.Bool("dry-run", false, "Only show what would be removed (default)")
+var APPLY = flag.Bool("apply", false, "Remove expired tasks")
+
+func printPlan(storage *bakapy.Storage, plan *bakapy.CleanupPlan) {
+	for _, jobName := range plan.Skipped {
+		fmt.Printf("==> [%s] skipped due to last task failure\n", jobName)
+	}
+	for _, metaPath := range plan.Corrupted {
+		fmt.Printf("==> corrupted metadata %s\n", metaPath)
+	}
+	for _, metadata := range plan.Tasks {
+		var size int64
+		for _, fileMeta := range metadata.Files {
+			size += fileMeta.Size
+		}
+		fmt.Printf("==> [%s]%s started %s, %d bytes\n", metadata.JobName, metadata.TaskId, metadata.StartTime, size)
+		if reason, exist := plan.Reasons[metadata.Key()]; exist {
+			fmt.Printf("    removed early: %s\n", reason)
+		}
+		if metadata.Filepath != "" {
+			fmt.Printf("    %s\n", metadata.Filepath)
+		}
+		for _, filePath := range storage.TaskFiles(metadata) {
+			fmt.Printf("    %s\n", filePath)
+		}
+	}
+	fmt.Printf("==> %d tasks, %d bytes\n", len(plan.Tasks), storage.TasksSize(plan.Tasks))
+	if unloaded := len(plan.Corrupted) + len(plan.Unloaded); unloaded != 0 {
+		fmt.Printf("==> dedup chunks kept, metadata of %d tasks cannot be loaded\n", unloaded)
+	}
+	if chunks := plan.FreedChunks(); len(chunks) != 0 {
+		fmt.Printf("==> %d dedup chunks, %d bytes\n", len(chunks), storage.ChunksSize(chunks))
+	}
+}
+
+func main() {
+	flag.Parse()
+	if *DRY_RUN && *APPLY {
+		fmt.Println("Only one of --dry-run and --apply may be used")
+		os.Exit(1)
+	}
+	err := bakapy.SetupLogging(*LOG_LEVEL)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	config, err := bakapy.ParseConfig(*CONFIG_PATH)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+	err = bakapy.ConfigureLogging(config.Log, *LOG_LEVEL)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	storage := bakapy.NewStorage(config)
+	plan, err := storage.PlanCleanup()
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+
+	if !*APPLY {
+		fmt.Println("Tasks to remove (dry run):")
+		printPlan(storage, plan)
+		return
+	}
+
+	fmt.Println("Removing tasks:")
+	printPlan(storage, plan)
+	err = storage.ApplyCleanup(plan)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
+}
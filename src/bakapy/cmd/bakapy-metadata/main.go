@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bakapy"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+)
+
+var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to config file")
+var LOG_LEVEL = flag.String("loglevel", "warning", "Log level")
+var IMPORT_DIR = flag.String("import", "", "Import metadata files from directory to configured store")
+var EXPORT_DIR = flag.String("export", "", "Export configured store to directory, one file per task")
+
+func main() {
+	flag.Parse()
+	err := bakapy.SetupLogging(*LOG_LEVEL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	config, err := bakapy.ParseConfig(*CONFIG_PATH)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	err = bakapy.ConfigureLogging(config.Log, *LOG_LEVEL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	if (*IMPORT_DIR == "") == (*EXPORT_DIR == "") {
+		fmt.Fprintln(os.Stderr, "Exactly one of -import or -export required")
+		os.Exit(1)
+	}
+
+	store := bakapy.NewMetadataStore(config)
+	failed := false
+	if *IMPORT_DIR != "" {
+		files := &bakapy.FileMetadataStore{Dir: *IMPORT_DIR}
+		metadatas, bad, err := files.LoadAll()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		for _, filepath := range bad {
+			fmt.Fprintf(os.Stderr, "%s: cannot load metadata, skipped\n", filepath)
+			failed = true
+		}
+		for _, metadata := range metadatas {
+			if metadata.TaskId == "" {
+				// old runs saved without task id
+				metadata.TaskId = bakapy.TaskId(path.Base(metadata.Filepath))
+			}
+			if err := store.Save(&metadata); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", metadata.TaskId, err)
+				failed = true
+				continue
+			}
+			fmt.Printf("imported %s\n", metadata.TaskId)
+		}
+	} else {
+		files := &bakapy.FileMetadataStore{Dir: *EXPORT_DIR}
+		metadatas, err := store.List(bakapy.MetadataQuery{})
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		if err := os.MkdirAll(*EXPORT_DIR, 0750); err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		for _, metadata := range metadatas {
+			if err := files.Save(&metadata); err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", metadata.TaskId, err)
+				failed = true
+				continue
+			}
+			fmt.Printf("exported %s\n", metadata.TaskId)
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bakapy"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to config file")
+var LOG_LEVEL = flag.String("loglevel", "warning", "Log level")
+var DRY_RUN = flag.Bool("dry-run", false, "Only show metadata which needs migration")
+
+func main() {
+	flag.Parse()
+	err := bakapy.SetupLogging(*LOG_LEVEL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	config, err := bakapy.ParseConfig(*CONFIG_PATH)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	err = bakapy.ConfigureLogging(config.Log, *LOG_LEVEL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	storage := bakapy.NewStorage(config)
+	migrated, err := storage.MigrateMetadata(*DRY_RUN)
+	action := "migrated"
+	if *DRY_RUN {
+		action = "needs migration"
+	}
+	for _, name := range migrated {
+		fmt.Printf("%s %s\n", action, name)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
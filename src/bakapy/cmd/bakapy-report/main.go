@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bakapy"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+)
+
+var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to config file")
+var LOG_LEVEL = flag.String("loglevel", "warning", "Log level")
+var REPORT_NAME = flag.String("name", "", "Report name from config")
+var FORMAT = flag.String("format", "", "Print report in this format (text or html) instead of report one")
+var SEND = flag.Bool("send", false, "Send report to its notifiers instead of printing")
+
+func main() {
+	flag.Parse()
+	err := bakapy.SetupLogging(*LOG_LEVEL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	config, err := bakapy.ParseConfig(*CONFIG_PATH)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	err = bakapy.ConfigureLogging(config.Log, *LOG_LEVEL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	var reportConfig *bakapy.ReportConfig
+	for i := range config.Reports {
+		if config.Reports[i].Name == *REPORT_NAME {
+			reportConfig = &config.Reports[i]
+		}
+	}
+	if reportConfig == nil {
+		fmt.Fprintf(os.Stderr, "Report '%s' not found in config\n", *REPORT_NAME)
+		os.Exit(1)
+	}
+
+	storage := bakapy.NewStorage(config)
+	if *SEND {
+		err = storage.SendReport(config, *reportConfig, time.Now())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	format := reportConfig.Format
+	if *FORMAT != "" {
+		format = *FORMAT
+	}
+	report, err := storage.BuildReport(config, *reportConfig, time.Now())
+	if err == nil {
+		var body string
+		body, err = report.Render(format)
+		fmt.Print(body)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
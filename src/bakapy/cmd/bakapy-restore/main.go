@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bakapy"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+)
+
+var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to config file")
+var LOG_LEVEL = flag.String("loglevel", "warning", "Log level")
+var TASK_ID = flag.String("task", "REQUIRED", "Task id")
+var FILE_NAME = flag.String("file", "", "File name, may be omitted if task has one file")
+var OUTPUT = flag.String("output", "-", "Output file path, - for stdout")
+
+func main() {
+	flag.Parse()
+	err := bakapy.SetupLogging(*LOG_LEVEL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	config, err := bakapy.ParseConfig(*CONFIG_PATH)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	err = bakapy.ConfigureLogging(config.Log, *LOG_LEVEL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	storage := bakapy.NewStorage(config)
+	metadata, err := storage.Metadata.Get(bakapy.TaskId(*TASK_ID))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot load task %s: %s\n", *TASK_ID, err)
+		os.Exit(1)
+	}
+
+	var fileMeta *bakapy.JobMetadataFile
+	for i := range metadata.Files {
+		if metadata.Files[i].Name == *FILE_NAME || (*FILE_NAME == "" && len(metadata.Files) == 1) {
+			fileMeta = &metadata.Files[i]
+		}
+	}
+	if fileMeta == nil {
+		fmt.Fprintf(os.Stderr, "File '%s' not found in task %s, available files:\n", *FILE_NAME, *TASK_ID)
+		for _, f := range metadata.Files {
+			fmt.Fprintf(os.Stderr, "  %s\n", f.Name)
+		}
+		os.Exit(1)
+	}
+
+	var output io.WriteCloser = os.Stdout
+	if *OUTPUT != "-" {
+		output, err = os.Create(*OUTPUT)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+	}
+
+	_, err = storage.RestoreFile(metadata, *fileMeta, output)
+	if closeErr := output.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Cannot restore file %s: %s\n", fileMeta.Name, err)
+		os.Exit(1)
+	}
+}
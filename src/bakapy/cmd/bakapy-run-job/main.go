@@ -24,6 +24,11 @@ func main() {
 		fmt.Println(err.Error())
 		os.Exit(1)
 	}
+	err = bakapy.ConfigureLogging(config.Log, *LOG_LEVEL)
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(1)
+	}
 
 	storage := bakapy.NewStorage(config)
 
@@ -35,5 +40,5 @@ func main() {
 	}
 
 	storage.Start()
-	bakapy.RunJob(jobName, jobConfig, config, storage)
+	bakapy.RunJobHosts(jobName, jobConfig, config, storage)
 }
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"github.com/op/go-logging"
 	"github.com/robfig/cron"
+	"net/http"
 	"os"
 	"time"
 )
@@ -15,6 +16,23 @@ var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to conf
 var LOG_LEVEL = flag.String("loglevel", "debug", "Log level")
 var TEST_CONFIG_ONLY = flag.Bool("test", false, "Check config and exit")
 
+func syncLoop(source bakapy.SyncSourceConfig, config *bakapy.Config, storage *bakapy.Storage) {
+	for {
+		client, err := bakapy.NewSyncClient(source, config.SecretsDir)
+		if err == nil {
+			var fetched []bakapy.TaskId
+			fetched, err = storage.SyncFrom(client)
+			if len(fetched) != 0 {
+				logger.Info("%d tasks fetched from %s", len(fetched), source.URL)
+			}
+		}
+		if err != nil {
+			logger.Warning("sync from %s failed: %s", source.URL, err)
+		}
+		time.Sleep(source.Interval)
+	}
+}
+
 func main() {
 	flag.Parse()
 	err := bakapy.SetupLogging(*LOG_LEVEL)
@@ -28,6 +46,11 @@ func main() {
 		fmt.Fprintf(os.Stderr, "Configuration error: %s\n", err)
 		os.Exit(1)
 	}
+	err = bakapy.ConfigureLogging(config.Log, *LOG_LEVEL)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Logging error: %s\n", err)
+		os.Exit(1)
+	}
 
 	logger.Debug(string(config.PrettyFmt()))
 
@@ -45,17 +68,44 @@ func main() {
 		func(jobName string, jobConfig *bakapy.JobConfig, config *bakapy.Config, storage *bakapy.Storage) {
 			scheduler.AddFunc(runSpec, func() {
 				logger.Critical("Starting job %s", jobName)
-				bakapy.RunJob(jobName, jobConfig, config, storage)
+				bakapy.RunJobHosts(jobName, jobConfig, config, storage)
 			})
 		}(jobName, jobConfig, config, storage)
 	}
 
+	for _, reportConfig := range config.Reports {
+		runSpec := reportConfig.RunAt.SchedulerString()
+		logger.Info("adding report %s{%s} to scheduler", reportConfig.Name, runSpec)
+		func(reportConfig bakapy.ReportConfig) {
+			scheduler.AddFunc(runSpec, func() {
+				logger.Info("sending report %s", reportConfig.Name)
+				if err := storage.SendReport(config, reportConfig, time.Now()); err != nil {
+					logger.Critical("cannot send report %s: %s", reportConfig.Name, err)
+				}
+			})
+		}(reportConfig)
+	}
+
 	if *TEST_CONFIG_ONLY {
 		return
 	}
 
 	storage.Start()
 	scheduler.Start()
+	if storage.Replication != nil {
+		go storage.Replication.Run()
+	}
+	if config.HTTP.Listen != "" {
+		go func() {
+			logger.Info("http server listening on %s", config.HTTP.Listen)
+			err := http.ListenAndServe(config.HTTP.Listen, bakapy.NewHTTPHandler(config, storage))
+			logger.Critical("http server failed: %s", err)
+		}()
+	}
+	go bakapy.NewStalenessChecker(config, storage).Run()
+	for _, source := range config.SyncFrom {
+		go syncLoop(source, config, storage)
+	}
 
 	for {
 		err := storage.CleanupExpired()
@@ -2,12 +2,22 @@ package main
 
 import (
 	"bakapy"
+	"flag"
 	"fmt"
 	"os"
 	"sort"
 )
 
-var USAGE = "Usage: bakapy-show-meta files..."
+var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to config file")
+var LOG_LEVEL = flag.String("loglevel", "warning", "Log level")
+var JOB_NAME = flag.String("job", "", "Show only runs of job")
+var NAMESPACE = flag.String("namespace", "", "Show only runs in namespace")
+
+func usage() {
+	fmt.Fprintln(os.Stderr, "Usage: bakapy-show-meta [options] [task ids...]")
+	fmt.Fprintln(os.Stderr, "Shows given tasks or all stored runs matching options")
+	flag.PrintDefaults()
+}
 
 type ByStartTime []*bakapy.JobMetadata
 
@@ -19,6 +29,10 @@ func printMetadata(metadata *bakapy.JobMetadata) {
 	fmt.Printf("==> [%s]%s\n", metadata.JobName, metadata.TaskId)
 	fmt.Println("==> Success:", metadata.Success)
 	fmt.Println("==> Command:", metadata.Command)
+	if metadata.BackupType != "" {
+		fmt.Println("==> Type:", metadata.BackupType)
+		fmt.Println("==> Parent:", metadata.ParentTaskId)
+	}
 	fmt.Println("==> AvgSpeed:", metadata.AvgSpeed())
 	fmt.Println("==> PID:", metadata.Pid)
 	fmt.Println("==> Start:", metadata.StartTime)
@@ -29,23 +43,77 @@ func printMetadata(metadata *bakapy.JobMetadata) {
 	fmt.Println("==> Expire:", metadata.ExpireTime)
 	fmt.Printf("==> Output:\n%s\n", string(metadata.Output))
 	fmt.Printf("==> Errput:\n%s\n", string(metadata.Errput))
+	if metadata.Log != nil {
+		fmt.Printf("==> Log:\n%s\n", string(metadata.Log))
+	}
 	fmt.Println("==================================")
 }
 
+func printChains(metas []*bakapy.JobMetadata) {
+	var list []bakapy.JobMetadata
+	for _, m := range metas {
+		if m.BackupType != "" {
+			list = append(list, *m)
+		}
+	}
+	if len(list) == 0 {
+		return
+	}
+	fmt.Println("==> Chains:")
+	for _, chain := range bakapy.BuildBackupChains(list) {
+		root := chain.Root()
+		fmt.Printf("[%s] %s, size %d, expire %s\n", root.JobName, root.Host, chain.TotalSize(), chain.ExpireTime())
+		for _, m := range chain {
+			fmt.Printf("    %-4s %s %s\n", m.BackupType, m.TaskId, m.StartTime)
+		}
+	}
+}
+
 func main() {
-	if len(os.Args[1:]) == 0 {
-		fmt.Println(USAGE)
+	flag.Usage = usage
+	flag.Parse()
+	err := bakapy.SetupLogging(*LOG_LEVEL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(1)
 	}
+
+	config, err := bakapy.ParseConfig(*CONFIG_PATH)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	err = bakapy.ConfigureLogging(config.Log, *LOG_LEVEL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	storage := bakapy.NewStorage(config)
 	var metas []*bakapy.JobMetadata
-	for _, metaPath := range os.Args[1:] {
-		meta, err := bakapy.LoadJobMetadata(metaPath)
+	if flag.NArg() == 0 {
+		metadatas, err := storage.Metadata.List(bakapy.MetadataQuery{JobName: *JOB_NAME, Namespace: *NAMESPACE})
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "[warning] %s: %s\n", metaPath, err)
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		for i := range metadatas {
+			metas = append(metas, &metadatas[i])
+		}
+	}
+	for _, taskId := range flag.Args() {
+		meta, err := storage.Metadata.Get(bakapy.TaskId(taskId))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "[warning] %s: %s\n", taskId, err)
 			continue
 		}
 		metas = append(metas, meta)
 	}
+	for _, meta := range metas {
+		if err := storage.Artifacts.Inline(meta); err != nil {
+			fmt.Fprintf(os.Stderr, "[warning] %s: %s\n", meta.TaskId, err)
+		}
+	}
 	if len(metas) == 0 {
 		fmt.Println("[warning] no valid metadatas found")
 		return
@@ -56,5 +124,6 @@ func main() {
 	for _, m := range metas {
 		printMetadata(m)
 	}
+	printChains(metas)
 
 }
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bakapy"
+	"flag"
+	"fmt"
+	"os"
+)
+
+var CONFIG_PATH = flag.String("config", "/etc/bakapy/bakapy.conf", "Path to config file")
+var LOG_LEVEL = flag.String("loglevel", "warning", "Log level")
+var URL = flag.String("url", "", "Pull from this instance instead of sync_from list")
+var KEY = flag.String("key", "", "Sync key for -url, may be !secret or !env reference")
+
+func main() {
+	flag.Parse()
+	err := bakapy.SetupLogging(*LOG_LEVEL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	config, err := bakapy.ParseConfig(*CONFIG_PATH)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+	err = bakapy.ConfigureLogging(config.Log, *LOG_LEVEL)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+
+	sources := config.SyncFrom
+	if *URL != "" {
+		sources = []bakapy.SyncSourceConfig{{URL: *URL, Key: bakapy.SecretString(*KEY)}}
+	}
+	if len(sources) == 0 {
+		fmt.Fprintln(os.Stderr, "No sync sources, use -url or sync_from in config")
+		os.Exit(1)
+	}
+
+	storage := bakapy.NewStorage(config)
+	failed := false
+	for _, source := range sources {
+		client, err := bakapy.NewSyncClient(source, config.SecretsDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", source.URL, err)
+			failed = true
+			continue
+		}
+		fetched, err := storage.SyncFrom(client)
+		for _, taskId := range fetched {
+			fmt.Printf("%s: fetched %s\n", source.URL, taskId)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %s\n", source.URL, err)
+			failed = true
+		}
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -3,26 +3,88 @@ package bakapy
 import (
 	"errors"
 	"fmt"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 	"io/ioutil"
 	"path"
 	"path/filepath"
+	"strings"
+	"text/template"
 	"time"
 )
 
 type Config struct {
-	IncludeJobs []string `yaml:"include_jobs"`
-	Listen      string
-	StorageDir  string     `yaml:"storage_dir"`
-	MetadataDir string     `yaml:"metadata_dir"`
-	CommandDir  string     `yaml:"command_dir"`
-	SMTP        SMTPConfig `yaml:"smtp"`
-	Jobs        map[string]*JobConfig
+	IncludeJobs    []string `yaml:"include_jobs"`
+	Listen         string
+	StorageDir     string             `yaml:"storage_dir"`
+	MetadataDir    string             `yaml:"metadata_dir"`
+	MetadataStore  string             `yaml:"metadata_store"`
+	ArtifactsDir   string             `yaml:"artifacts_dir"`
+	ArtifactsGzip  bool               `yaml:"artifacts_gzip"`
+	CommandDir     string             `yaml:"command_dir"`
+	SecretsDir     string             `yaml:"secrets_dir"`
+	ChunkDir       string             `yaml:"chunk_dir"`
+	SMTP           SMTPConfig         `yaml:"smtp"`
+	Quota          StorageQuotaConfig `yaml:"storage_quota"`
+	Replicas       []ReplicaConfig
+	ReplicationDir string             `yaml:"replication_dir"`
+	NotifyStateDir string             `yaml:"notify_state_dir"`
+	ReplicaKey     SecretString       `yaml:"replica_key"`
+	HTTP           HTTPConfig         `yaml:"http"`
+	SyncFrom       []SyncSourceConfig `yaml:"sync_from"`
+	Notifiers      []NotifierConfig
+	Notify         NotifyRoutes
+	Reports        []ReportConfig
+	Log            LogConfig
+	Jobs           map[string]*JobConfig
 }
 
 type SMTPConfig struct {
 	Host string
 	Port int
+	// Sender and recipients, current user name if empty
+	From string
+	To   []string
+	// Fail if server does not support STARTTLS
+	StartTLS bool `yaml:"starttls"`
+	// AUTH PLAIN, password may be !secret or !env reference
+	Username string
+	Password SecretString
+	// Mail template files by event, relative to config dir
+	Templates map[string]string
+	templates map[string]*template.Template `yaml:"-"`
+}
+
+func (cfg *SMTPConfig) Sanitize(configDir, secretsDir string) error {
+	if _, err := cfg.Password.Resolve(secretsDir); err != nil {
+		return errors.New("smtp: " + err.Error())
+	}
+	cfg.templates = map[string]*template.Template{}
+	for event, file := range cfg.Templates {
+		if !isNotificationEvent(event) {
+			return errors.New("smtp: unknown template event '" + event + "'")
+		}
+		if !path.IsAbs(file) {
+			file = path.Join(configDir, file)
+		}
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return errors.New("smtp: " + err.Error())
+		}
+		tmpl, err := template.New(path.Base(file)).Parse(string(raw))
+		if err != nil {
+			return errors.New("smtp: " + err.Error())
+		}
+		cfg.templates[event] = tmpl
+	}
+	return nil
+}
+
+// User template of event if configured
+func (cfg SMTPConfig) Template(event string, builtin *template.Template) *template.Template {
+	if tmpl, exist := cfg.templates[event]; exist {
+		return tmpl
+	}
+	return builtin
 }
 
 func (cfg *Config) PrettyFmt() []byte {
@@ -30,6 +92,20 @@ func (cfg *Config) PrettyFmt() []byte {
 	return s
 }
 
+type SSHConfig struct {
+	User           string
+	KeyFile        string        `yaml:"key_file"`
+	KnownHosts     string        `yaml:"known_hosts"`
+	HostKeyPolicy  string        `yaml:"host_key_policy"`
+	ConnectTimeout time.Duration `yaml:"connect_timeout"`
+	Keepalive      time.Duration `yaml:"keepalive"`
+	// Connection closed after this many keepalives without reply
+	KeepaliveMaxMissed uint   `yaml:"keepalive_max_missed"`
+	JumpHost           string `yaml:"jump_host"`
+	ReverseTunnel      bool   `yaml:"reverse_tunnel"`
+	TunnelPort         uint   `yaml:"tunnel_port"`
+}
+
 type RunAtSpec struct {
 	Second  string
 	Minute  string
@@ -58,15 +134,35 @@ type JobConfig struct {
 	Sudo       bool
 	Disabled   bool
 	Gzip       bool
+	Dedup      bool
 	MaxAgeDays int           `yaml:"max_age_days"`
 	MaxAge     time.Duration `yaml:"max_age"`
+	Retention  RetentionConfig
 	Namespace  string
 	Host       string
+	Hosts      []string
+	HostsFile  string `yaml:"hosts_file"`
+	Parallel   uint
 	Port       uint
+	Executor   string
+	Container  string
+	Transport  string
+	Driver     string
+	SSH        SSHConfig `yaml:"ssh"`
 	Command    string
-	Args       map[string]string
+	Args       SecretMap
 	RunAt      RunAtSpec `yaml:"run_at"`
 	executor   Executer  `yaml:"-"`
+	// Alert if there is no successful run for this long
+	MaxStaleness time.Duration `yaml:"max_staleness"`
+	// Notifiers by event, overrides main config routes
+	Notify NotifyRoutes
+	// Mail recipients, overrides smtp to
+	NotifyTo []string `yaml:"notify_to"`
+	// Repeat failure alert after this many more failures in a row
+	// or this long after last alert, alerted once if both zero
+	RealertFailures uint          `yaml:"realert_failures"`
+	RealertInterval time.Duration `yaml:"realert_interval"`
 }
 
 func (jobConfig *JobConfig) Sanitize() error {
@@ -75,12 +171,123 @@ func (jobConfig *JobConfig) Sanitize() error {
 			jobConfig.MaxAge, jobConfig.MaxAgeDays)
 		return errors.New(e)
 	}
+	if jobConfig.Gzip && jobConfig.Dedup {
+		return errors.New("gzip and dedup cannot be used together")
+	}
+	if err := jobConfig.Retention.Validate(); err != nil {
+		return err
+	}
+	if jobConfig.Retention.Enabled() && (jobConfig.MaxAgeDays != 0 || jobConfig.MaxAge != 0) {
+		return errors.New("both retention and max_age defined, use only one of them")
+	}
 	if jobConfig.MaxAgeDays != 0 {
 		jobConfig.MaxAge = time.Duration(jobConfig.MaxAgeDays) * time.Hour * 24
 	}
+	if jobConfig.Host != "" && len(jobConfig.Hosts) != 0 {
+		e := fmt.Sprintf("both host and hosts defined. host='%s' hosts='%s'",
+			jobConfig.Host, strings.Join(jobConfig.Hosts, ","))
+		return errors.New(e)
+	}
+	switch jobConfig.Executor {
+	case "", "bash", "ssh", "docker":
+	default:
+		return errors.New("unknown executor '" + jobConfig.Executor + "'")
+	}
+	if jobConfig.Executor == "docker" {
+		if jobConfig.Container == "" {
+			return errors.New("docker executor requires container")
+		}
+		if err := ValidateContainerName(jobConfig.Container); err != nil {
+			return err
+		}
+	} else if jobConfig.Container != "" {
+		return errors.New("container defined but executor is not docker")
+	}
+	switch jobConfig.SSH.HostKeyPolicy {
+	case "", HOST_KEY_POLICY_STRICT, HOST_KEY_POLICY_ACCEPT_NEW, HOST_KEY_POLICY_INSECURE:
+	default:
+		return errors.New("unknown ssh host_key_policy '" + jobConfig.SSH.HostKeyPolicy + "'")
+	}
+	if jobConfig.Executor == "ssh" && jobConfig.Host == "" && len(jobConfig.Hosts) == 0 {
+		return errors.New("ssh executor requires host")
+	}
+	switch jobConfig.Transport {
+	case "", TRANSPORT_TCP, TRANSPORT_STDOUT:
+	default:
+		return errors.New("unknown transport '" + jobConfig.Transport + "'")
+	}
+	if jobConfig.SSH.ReverseTunnel && jobConfig.Executor != "ssh" {
+		return errors.New("ssh reverse_tunnel requires ssh executor")
+	}
+	if jobConfig.Driver != "" {
+		if _, err := GetDriver(jobConfig.Driver); err != nil {
+			return err
+		}
+		if jobConfig.Host != "" || len(jobConfig.Hosts) != 0 || jobConfig.Executor != "" {
+			return errors.New("driver " + jobConfig.Driver + " runs locally, host, hosts and executor must not be defined")
+		}
+	}
+	if jobConfig.Parallel == 0 {
+		jobConfig.Parallel = 1
+	}
 	return nil
 }
 
+// Read hosts from hosts_file glob (relative to configDir) and append
+// them to hosts list. Empty lines and lines starting with # are ignored.
+func (jobConfig *JobConfig) loadHostsFile(configDir string) error {
+	if jobConfig.HostsFile == "" {
+		return nil
+	}
+	paths, err := filepath.Glob(path.Join(configDir, jobConfig.HostsFile))
+	if err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		return errors.New("hosts_file " + jobConfig.HostsFile + " does not match any file")
+	}
+	for _, hostsPath := range paths {
+		raw, err := ioutil.ReadFile(hostsPath)
+		if err != nil {
+			return err
+		}
+		for _, line := range strings.Split(string(raw), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			jobConfig.Hosts = append(jobConfig.Hosts, line)
+		}
+	}
+	return nil
+}
+
+// Returns one config per host. Jobs without hosts list
+// returned as is.
+func (jobConfig *JobConfig) ExpandHosts() []*JobConfig {
+	if len(jobConfig.Hosts) == 0 {
+		return []*JobConfig{jobConfig}
+	}
+	configs := make([]*JobConfig, 0, len(jobConfig.Hosts))
+	for _, host := range jobConfig.Hosts {
+		hostConfig := *jobConfig
+		hostConfig.Host = host
+		hostConfig.Hosts = nil
+		hostConfig.HostsFile = ""
+		hostConfig.Namespace = path.Join(jobConfig.Namespace, hostNamespace(host))
+		configs = append(configs, &hostConfig)
+	}
+	return configs
+}
+
+// Strip ssh user from host, "root@web1" -> "web1"
+func hostNamespace(host string) string {
+	if idx := strings.LastIndex(host, "@"); idx != -1 {
+		return host[idx+1:]
+	}
+	return host
+}
+
 func NewConfig() *Config {
 	jobs := Config{
 		Jobs: map[string]*JobConfig{},
@@ -101,7 +308,59 @@ func ParseConfig(configPath string) (*Config, error) {
 		return nil, err
 	}
 
+	if err := cfg.Quota.Validate(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Log.Validate(); err != nil {
+		return nil, err
+	}
+	switch cfg.MetadataStore {
+	case "", METADATA_STORE_FILES, METADATA_STORE_INDEXED:
+	default:
+		return nil, errors.New("unknown metadata_store '" + cfg.MetadataStore + "'")
+	}
+	replicaNames := map[string]bool{}
+	for i := range cfg.Replicas {
+		if err := cfg.Replicas[i].Sanitize(); err != nil {
+			return nil, err
+		}
+		if replicaNames[cfg.Replicas[i].Name] {
+			return nil, errors.New("duplicated replica name " + cfg.Replicas[i].Name)
+		}
+		replicaNames[cfg.Replicas[i].Name] = true
+	}
+	if _, err := cfg.ReplicaKey.Resolve(cfg.SecretsDir); err != nil {
+		return nil, err
+	}
+	if _, err := cfg.HTTP.SyncKey.Resolve(cfg.SecretsDir); err != nil {
+		return nil, err
+	}
+	for i := range cfg.SyncFrom {
+		if err := cfg.SyncFrom[i].Sanitize(); err != nil {
+			return nil, err
+		}
+	}
 	configDir := path.Dir(configPath)
+	if err := cfg.SMTP.Sanitize(configDir, cfg.SecretsDir); err != nil {
+		return nil, err
+	}
+	notifierNames := map[string]bool{}
+	for i := range cfg.Notifiers {
+		if err := cfg.Notifiers[i].Sanitize(cfg.SecretsDir); err != nil {
+			return nil, err
+		}
+		if notifierNames[cfg.Notifiers[i].Name] {
+			return nil, errors.New("duplicated notifier name " + cfg.Notifiers[i].Name)
+		}
+		notifierNames[cfg.Notifiers[i].Name] = true
+	}
+	if len(cfg.Notifiers) == 0 {
+		notifierNames[NOTIFIER_SMTP] = true
+	}
+	if err := cfg.Notify.Validate(notifierNames); err != nil {
+		return nil, err
+	}
+
 	jobDefines := map[string]string{}
 	for _, relPathGlob := range cfg.IncludeJobs {
 		pathGlob := path.Join(configDir, relPathGlob)
@@ -134,10 +393,42 @@ func ParseConfig(configPath string) (*Config, error) {
 	}
 
 	for jobName, jobConfig := range cfg.Jobs {
-		err := jobConfig.Sanitize()
+		err := jobConfig.loadHostsFile(configDir)
+		if err != nil {
+			return nil, errors.New("job " + jobName + ": " + err.Error())
+		}
+		err = jobConfig.Sanitize()
 		if err != nil {
 			return nil, errors.New("job " + jobName + ": " + err.Error())
 		}
+		if err := jobConfig.Notify.Validate(notifierNames); err != nil {
+			return nil, errors.New("job " + jobName + ": " + err.Error())
+		}
+	}
+
+	reportNames := map[string]bool{}
+	for i := range cfg.Reports {
+		report := &cfg.Reports[i]
+		if err := report.Sanitize(); err != nil {
+			return nil, err
+		}
+		if reportNames[report.Name] {
+			return nil, errors.New("duplicated report name " + report.Name)
+		}
+		reportNames[report.Name] = true
+		for _, name := range report.Notifiers {
+			if !notifierNames[name] {
+				return nil, errors.New("report " + report.Name + ": unknown notifier '" + name + "'")
+			}
+		}
+		if len(report.Notifiers) == 0 && cfg.Notify != nil && len(cfg.Notify[EVENT_REPORT]) == 0 {
+			return nil, errors.New("report " + report.Name + ": no notifiers and no report route")
+		}
+		for _, jobName := range report.Jobs {
+			if _, exist := cfg.Jobs[jobName]; !exist {
+				return nil, errors.New("report " + report.Name + ": unknown job '" + jobName + "'")
+			}
+		}
 	}
 
 	return cfg, nil
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -52,6 +53,14 @@ jobs:
       namespace: one
 `)
 
+var TEST_CONFIG_HOSTS_BOTH = []byte(`
+jobs:
+    wow:
+      namespace: one
+      host: web1
+      hosts: [web2, web3]
+`)
+
 var JOBS_CONFIG = []byte(`
 xxx:
   namespace: one
@@ -210,6 +219,72 @@ func TestParseConfig_MaxAgeDaysParseOk(t *testing.T) {
 	}
 }
 
+func TestParseConfig_HostsBothSpecified(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write(TEST_CONFIG_HOSTS_BOTH)
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	_, err := ParseConfig(cfg.Name())
+	expectedErr := "job wow: both host and hosts defined. host='web1' hosts='web2,web3'"
+	if err == nil || err.Error() != expectedErr {
+		t.Fatal(err, "| != |", expectedErr)
+	}
+}
+
+func TestParseConfig_HostsFile(t *testing.T) {
+	hostsFile, _ := ioutil.TempFile("", "testhosts")
+	hostsFile.Write([]byte("# web servers\nweb2\n\n  root@web3  \n"))
+	hostsFile.Close()
+	defer os.Remove(hostsFile.Name())
+
+	mainConfig, _ := ioutil.TempFile("", "testconfig")
+	mainConfig.Write([]byte("jobs: {wow: {namespace: one, hosts: [web1], hosts_file: testhosts*}}"))
+	mainConfig.Close()
+	defer os.Remove(mainConfig.Name())
+
+	config, err := ParseConfig(mainConfig.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hosts := strings.Join(config.Jobs["wow"].Hosts, ",")
+	if hosts != "web1,web2,root@web3" {
+		t.Fatal("bad hosts list:", hosts)
+	}
+	if config.Jobs["wow"].Parallel != 1 {
+		t.Fatal("default parallel must be 1, not", config.Jobs["wow"].Parallel)
+	}
+}
+
+func TestJobConfig_ExpandHosts(t *testing.T) {
+	cfg := &JobConfig{
+		Namespace: "www",
+		Hosts:     []string{"web1", "root@web2"},
+	}
+	configs := cfg.ExpandHosts()
+	if len(configs) != 2 {
+		t.Fatal("expanded configs length must be 2, not", len(configs))
+	}
+	if configs[0].Host != "web1" || configs[0].Namespace != "www/web1" {
+		t.Fatal("bad first config:", configs[0].Host, configs[0].Namespace)
+	}
+	if configs[1].Host != "root@web2" || configs[1].Namespace != "www/web2" {
+		t.Fatal("bad second config:", configs[1].Host, configs[1].Namespace)
+	}
+	if len(configs[1].Hosts) != 0 {
+		t.Fatal("expanded config must not have hosts list")
+	}
+}
+
+func TestJobConfig_ExpandHostsSingleHost(t *testing.T) {
+	cfg := &JobConfig{Namespace: "www", Host: "web1"}
+	configs := cfg.ExpandHosts()
+	if len(configs) != 1 || configs[0] != cfg {
+		t.Fatal("single host config must be returned as is")
+	}
+}
+
 func TestRunAtSpec_SchedulerString_NoSecond(t *testing.T) {
 	spec := &RunAtSpec{
 		Minute:  "3",
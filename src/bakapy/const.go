@@ -1,7 +1,9 @@
 package bakapy
 
 import (
+	htmltemplate "html/template"
 	"text/template"
+	"time"
 )
 
 // Waiting for client authentication
@@ -9,6 +11,19 @@ const STORAGE_AUTH_TIMEOUT = 30 // seconds
 const STORAGE_TASK_ID_LEN = 36
 const STORAGE_READ_BUFSIZE = 4096
 
+// Free space is checked after each such amount written
+const STORAGE_SPACE_CHECK_INTERVAL = 16 * 1048576
+
+// Dedup store chunk sizes. Boundary mask has 20 bits set,
+// so average chunk is about 1Mb.
+const DEDUP_MIN_CHUNK = 256 * 1024
+const DEDUP_MAX_CHUNK = 4 * 1048576
+const DEDUP_CHUNK_MASK = uint64(1<<20-1) << 44
+
+// Unused chunks younger than it are not removed, they may
+// belong to upload in progress.
+const DEDUP_GC_GRACE = 48 * time.Hour
+
 // Length of filename length header
 const STORAGE_FILENAME_LEN_LEN = 4
 
@@ -23,6 +38,51 @@ const (
 
 const JOB_FINISH = "_@!_JOB_FINISH_!@_"
 
+// Filename of storage connection carrying replica of task
+// from other bakapy instance, see BakapyReplica
+const STORAGE_REPLICA_MAGIC = "_@!_REPLICA_!@_"
+const STORAGE_REPLICA_REPLY_TIMEOUT = 10 * time.Minute
+
+const REPLICATION_CHECK_INTERVAL = time.Minute
+const REPLICATION_DEFAULT_RETRIES = 5
+const REPLICATION_DEFAULT_RETRY_INTERVAL = 5 * time.Minute
+
+// Sync endpoint file headers, see SyncHandler
+const SYNC_SIZE_HEADER = "X-Bakapy-Size"
+const SYNC_CHECKSUM_HEADER = "X-Bakapy-Sha256"
+const SYNC_DEFAULT_INTERVAL = time.Hour
+
+// Indexed metadata store log is compacted when it has more
+// deleted or replaced records than this and than live records
+const METADATA_LOG_COMPACT_MIN = 1000
+
+// Version of metadata format written by this bakapy, metadata
+// of older versions is upgraded on load
+const METADATA_SCHEMA_VERSION = 1
+
+// Namespace directories sizes reported by /metrics are
+// recalculated not more often than this
+const METRICS_DISK_USAGE_INTERVAL = 5 * time.Minute
+
+// Webhook and command notifiers timeout
+const NOTIFY_DEFAULT_TIMEOUT = 30 * time.Second
+
+// How often scheduler checks jobs max_staleness
+const STALENESS_CHECK_INTERVAL = 5 * time.Minute
+
+// Period summarized by report without period
+const REPORT_DEFAULT_PERIOD = 24 * time.Hour
+
+// Stream transport frames, see StreamDemuxer
+const STREAM_FRAME_LEN_LEN = 8
+const STREAM_CHUNK_SIZE = 1048576
+const (
+	STREAM_FRAME_OUTPUT = 'O'
+	STREAM_FRAME_FILE   = 'F'
+	STREAM_FRAME_DATA   = 'D'
+	STREAM_FRAME_END    = 'E'
+)
+
 var MAIL_TEMPLATE_JOB_FAILED = template.Must(template.New("mail").Parse(`From: {{ .From }}
 To: {{.To}}
 Subject: {{.Subject}}
@@ -42,6 +102,59 @@ Errput:
 -----------------------------
 `))
 
+var MAIL_TEMPLATE_JOB_STALE = template.Must(template.New("mail").Parse(`From: {{ .From }}
+To: {{.To}}
+Subject: {{.Subject}}
+Content-Type: text/plain;charset=utf8
+
+Job {{.JobName}} has no successful backups:
+{{.Message}}
+`))
+
+var MAIL_TEMPLATE_JOB_EVENT = template.Must(template.New("mail").Parse(`From: {{ .From }}
+To: {{.To}}
+Subject: {{.Subject}}
+Content-Type: text/plain;charset=utf8
+
+Job {{.JobName}} {{.Event}}:
+{{.Message}}
+`))
+
+var MAIL_TEMPLATE_REPORT = template.Must(template.New("mail").Parse(`From: {{ .From }}
+To: {{.To}}
+Subject: {{.Subject}}
+MIME-Version: 1.0
+Content-Type: {{.ContentType}};charset=utf8
+
+{{.Message}}
+`))
+
+var REPORT_TEMPLATE_TEXT = template.Must(template.New("report").Funcs(reportTemplateFuncs).Parse(`Bakapy report {{.Name}}
+{{time .Since}} - {{time .Until}}
+
+{{.Runs}} runs, {{.Failures}} failed, {{size .TotalSize}} stored, {{size .StorageSize}} total
+{{range .Jobs}}
+{{.JobName}}
+  runs:          {{.Runs}} ({{.Successes}} ok, {{.Failures}} failed)
+  stored:        {{size .TotalSize}}
+  storage:       {{size .StorageSize}}
+  last success:  {{time .LastSuccess}}
+  average speed: {{size .AvgSpeed}}/s
+{{end}}`))
+
+var REPORT_TEMPLATE_HTML = htmltemplate.Must(htmltemplate.New("report").Funcs(reportTemplateFuncs).Parse(`<html>
+<body>
+<h3>Bakapy report {{.Name}}</h3>
+<p>{{time .Since}} - {{time .Until}}</p>
+<p>{{.Runs}} runs, {{.Failures}} failed, {{size .TotalSize}} stored, {{size .StorageSize}} total</p>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Job</th><th>Runs</th><th>Successes</th><th>Failures</th><th>Stored</th><th>Storage</th><th>Last success</th><th>Average speed</th></tr>
+{{range .Jobs}}<tr{{if .Failures}} style="color: #c00"{{end}}><td>{{.JobName}}</td><td>{{.Runs}}</td><td>{{.Successes}}</td><td>{{.Failures}}</td><td>{{size .TotalSize}}</td><td>{{size .StorageSize}}</td><td>{{time .LastSuccess}}</td><td>{{size .AvgSpeed}}/s</td></tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
 var JOB_TEMPLATE = template.Must(template.New("job").Parse(`
 ##
 # Common header
@@ -49,7 +162,45 @@ var JOB_TEMPLATE = template.Must(template.New("job").Parse(`
 set -e
 
 TASK_NAME='{{.Job.Name}}'
+{{if .StreamTransport}}
+# files and output are sent as frames to original stdout
+exec 4>&1
+_STREAM_OUTPUT=$(mktemp)
+exec 1>"$_STREAM_OUTPUT"
+
+_send_frame(){
+    printf "%s%0{{.STREAM_FRAME_LEN_LEN}}d" "$1" $(wc -c < "$2") >&4
+    cat "$2" >&4
+}
 
+_send_file(){
+    local name="$1"
+    local chunk
+    chunk=$(mktemp)
+    printf "%s" "$name" > "$chunk"
+    _send_frame F "$chunk"
+    while head -c {{.STREAM_CHUNK_SIZE}} > "$chunk" && [ -s "$chunk" ]; do
+        _send_frame D "$chunk"
+    done
+    : > "$chunk"
+    _send_frame E "$chunk"
+    rm -f "$chunk"
+}
+
+_flush_output(){
+    local code=$?
+    exec 1>&2
+    local chunk
+    chunk=$(mktemp)
+    while head -c {{.STREAM_CHUNK_SIZE}} > "$chunk" && [ -s "$chunk" ]; do
+        _send_frame O "$chunk"
+    done < "$_STREAM_OUTPUT"
+    rm -f "$chunk" "$_STREAM_OUTPUT"
+    exit $code
+}
+
+trap '_flush_output' EXIT
+{{else}}
 _send_file(){
     local name="$1"
 
@@ -58,7 +209,7 @@ _send_file(){
     cat - >&3
     exec 3>&-
 }
-
+{{end}}
 _finish(){
     echo > /dev/null
 }
@@ -0,0 +1,201 @@
+package bakapy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+var chunkHashRe = regexp.MustCompile("^[0-9a-f]{64}$")
+
+// Random values for gear rolling hash, generated by splitmix64
+// with fixed seed, so chunk boundaries are stable between runs.
+var dedupGear = func() [256]uint64 {
+	var table [256]uint64
+	seed := uint64(0x62616b617079)
+	for i := range table {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}()
+
+// Content addressed chunk storage. Chunks are saved as
+// $chunk_dir/<first 2 hash chars>/<sha256 hash>.
+type DedupStore struct {
+	RootDir string
+	logger  *logging.Logger
+}
+
+func NewDedupStore(rootDir string) *DedupStore {
+	return &DedupStore{
+		RootDir: rootDir,
+		logger:  logging.MustGetLogger("bakapy.dedup"),
+	}
+}
+
+func (s *DedupStore) ChunkPath(hash string) string {
+	return path.Join(s.RootDir, hash[:2], hash)
+}
+
+// Save chunk if it does not exist yet. Existing chunk modification
+// time is updated, so garbage collector does not remove chunks of
+// running uploads.
+func (s *DedupStore) PutChunk(data []byte) (string, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	chunkPath := s.ChunkPath(hash)
+
+	now := time.Now()
+	if err := os.Chtimes(chunkPath, now, now); err == nil {
+		return hash, nil
+	}
+
+	if err := os.MkdirAll(path.Dir(chunkPath), 0750); err != nil {
+		return "", err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(chunkPath), ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), chunkPath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return hash, nil
+}
+
+// Write file content assembled from chunks to output
+func (s *DedupStore) Restore(chunks []string, output io.Writer) (int64, error) {
+	var written int64
+	for _, hash := range chunks {
+		if !chunkHashRe.MatchString(hash) {
+			return written, errors.New("bad chunk hash '" + hash + "'")
+		}
+		data, err := ioutil.ReadFile(s.ChunkPath(hash))
+		if err != nil {
+			return written, err
+		}
+		sum := sha256.Sum256(data)
+		if hex.EncodeToString(sum[:]) != hash {
+			return written, errors.New("chunk " + hash + " is corrupted")
+		}
+		n, err := output.Write(data)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// Remove chunks without references and not modified during grace
+// period. Returns count and size of removed chunks.
+func (s *DedupStore) Collect(refs map[string]int, grace time.Duration) (int, int64, error) {
+	count := 0
+	var size int64
+	deadline := time.Now().Add(-grace)
+	err := filepath.Walk(s.RootDir, func(chunkPath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || refs[info.Name()] > 0 || info.ModTime().After(deadline) {
+			return nil
+		}
+		s.logger.Info("removing unused chunk %s", chunkPath)
+		if err := os.Remove(chunkPath); err != nil {
+			s.logger.Warning("failed to remove chunk %s: %s", chunkPath, err)
+			return nil
+		}
+		count++
+		size += info.Size()
+		return nil
+	})
+	return count, size, err
+}
+
+// Writer splitting stream into content-defined chunks and saving
+// them to store. Chunk boundary is placed where gear hash of last
+// bytes matches mask, so equal content produces equal chunks even
+// if it is shifted in stream.
+type ChunkWriter struct {
+	store  *DedupStore
+	buf    []byte
+	hash   uint64
+	pos    int
+	Chunks []string
+}
+
+func NewChunkWriter(store *DedupStore) *ChunkWriter {
+	return &ChunkWriter{store: store, Chunks: []string{}}
+}
+
+func (w *ChunkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		cut := w.boundary()
+		if cut < 0 {
+			return len(p), nil
+		}
+		if err := w.flush(cut); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// Returns chunk length or -1 if more data needed
+func (w *ChunkWriter) boundary() int {
+	for ; w.pos < len(w.buf); w.pos++ {
+		w.hash = (w.hash << 1) + dedupGear[w.buf[w.pos]]
+		if w.pos+1 >= DEDUP_MAX_CHUNK {
+			return w.pos + 1
+		}
+		if w.pos+1 >= DEDUP_MIN_CHUNK && w.hash&DEDUP_CHUNK_MASK == 0 {
+			return w.pos + 1
+		}
+	}
+	return -1
+}
+
+func (w *ChunkWriter) flush(length int) error {
+	hash, err := w.store.PutChunk(w.buf[:length])
+	if err != nil {
+		return errors.New(fmt.Sprintf("cannot save chunk: %s", err))
+	}
+	w.Chunks = append(w.Chunks, hash)
+	w.buf = append(w.buf[:0], w.buf[length:]...)
+	w.hash = 0
+	w.pos = 0
+	return nil
+}
+
+// Save rest of data as last chunk. Empty file is saved as
+// one empty chunk to be distinguished from not deduplicated file.
+func (w *ChunkWriter) Close() error {
+	if len(w.buf) == 0 && len(w.Chunks) != 0 {
+		return nil
+	}
+	return w.flush(len(w.buf))
+}
@@ -0,0 +1,227 @@
+package bakapy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func randomData(seed int64, size int) []byte {
+	data := make([]byte, size)
+	rand.New(rand.NewSource(seed)).Read(data)
+	return data
+}
+
+func chunkData(t *testing.T, store *DedupStore, data []byte) []string {
+	writer := NewChunkWriter(store)
+	// small writes like bufio.Writer does
+	for start := 0; start < len(data); start += 4096 {
+		end := start + 4096
+		if end > len(data) {
+			end = len(data)
+		}
+		if _, err := writer.Write(data[start:end]); err != nil {
+			t.Fatal("write error:", err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal("close error:", err)
+	}
+	return writer.Chunks
+}
+
+func TestChunkWriter_RestoreAndDedup(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(dir)
+	store := NewDedupStore(dir)
+
+	data := randomData(1, 10*1048576)
+	chunks := chunkData(t, store, data)
+	if len(chunks) < 3 {
+		t.Fatal("too few chunks:", len(chunks))
+	}
+	restored := new(bytes.Buffer)
+	if _, err := store.Restore(chunks, restored); err != nil {
+		t.Fatal("restore error:", err)
+	}
+	if !bytes.Equal(restored.Bytes(), data) {
+		t.Fatal("restored data differs")
+	}
+
+	// data shifted by prefix shares most chunks
+	shifted := append([]byte("new header"), data...)
+	shiftedChunks := chunkData(t, store, shifted)
+	old := map[string]bool{}
+	for _, hash := range chunks {
+		old[hash] = true
+	}
+	shared := 0
+	for _, hash := range shiftedChunks {
+		if old[hash] {
+			shared++
+		}
+	}
+	if shared < len(chunks)-2 {
+		t.Fatal("chunks not deduplicated, shared", shared, "of", len(chunks))
+	}
+}
+
+func TestChunkWriter_Empty(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(dir)
+	store := NewDedupStore(dir)
+	chunks := chunkData(t, store, []byte{})
+	if len(chunks) != 1 {
+		t.Fatal("empty file must have one chunk, got", chunks)
+	}
+}
+
+func TestDedupStore_Restore_Corrupted(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(dir)
+	store := NewDedupStore(dir)
+	hash, _ := store.PutChunk([]byte("hello"))
+	ioutil.WriteFile(store.ChunkPath(hash), []byte("wow"), 0644)
+	_, err := store.Restore([]string{hash}, new(bytes.Buffer))
+	if err == nil || err.Error() != "chunk "+hash+" is corrupted" {
+		t.Fatal("bad error:", err)
+	}
+	_, err = store.Restore([]string{"../../etc/passwd"}, new(bytes.Buffer))
+	if err == nil || err.Error() != "bad chunk hash '../../etc/passwd'" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestDedupStore_Collect(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(dir)
+	store := NewDedupStore(dir)
+	used, _ := store.PutChunk([]byte("used"))
+	unused, _ := store.PutChunk([]byte("unused"))
+	fresh, _ := store.PutChunk([]byte("fresh"))
+	old := time.Now().Add(-2 * DEDUP_GC_GRACE)
+	os.Chtimes(store.ChunkPath(used), old, old)
+	os.Chtimes(store.ChunkPath(unused), old, old)
+
+	count, size, err := store.Collect(map[string]int{used: 1}, DEDUP_GC_GRACE)
+	if err != nil || count != 1 || size != 6 {
+		t.Fatal("bad collect result:", count, size, err)
+	}
+	for hash, exist := range map[string]bool{used: true, unused: false, fresh: true} {
+		if _, err := os.Stat(store.ChunkPath(hash)); (err == nil) != exist {
+			t.Fatal("bad chunk state", hash, exist)
+		}
+	}
+}
+
+func TestStorage_DedupJobAndCleanup(t *testing.T) {
+	cfg := NewConfig()
+	cfg.StorageDir, _ = ioutil.TempDir("", "")
+	cfg.MetadataDir, _ = ioutil.TempDir("", "")
+	cfg.ChunkDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(cfg.StorageDir)
+	defer os.RemoveAll(cfg.MetadataDir)
+	defer os.RemoveAll(cfg.ChunkDir)
+	storage := NewStorage(cfg)
+
+	fileCh := make(chan JobMetadataFile, 1)
+	storage.AddJob(&StorageCurrentJob{
+		TaskId:      TaskId("a70cb394-c22d-4fe7-a5cc-bc0a5e19a24c"),
+		FileAddChan: fileCh,
+		Namespace:   "ns",
+		Dedup:       true,
+	})
+	data := randomData(2, 3*1048576)
+	err := storage.HandleConnection(&NullStorageProtocol{filename: "dump.sql", content: data})
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	fileMeta := <-fileCh
+	if len(fileMeta.Chunks) == 0 || fileMeta.Size != int64(len(data)) {
+		t.Fatal("bad file metadata:", fileMeta.Size, fileMeta.Chunks)
+	}
+	if _, err := os.Stat(path.Join(cfg.StorageDir, "ns", "dump.sql")); err == nil {
+		t.Fatal("dedup file saved to namespace")
+	}
+
+	metadata := &JobMetadata{
+		TaskId:     "expired",
+		JobName:    "job",
+		Namespace:  "ns",
+		Success:    true,
+		ExpireTime: time.Now().Add(-time.Hour),
+		Files:      []JobMetadataFile{fileMeta},
+	}
+	metadata.Save(path.Join(cfg.MetadataDir, "expired"))
+	loaded, _ := LoadJobMetadata(path.Join(cfg.MetadataDir, "expired"))
+	restored := new(bytes.Buffer)
+	if _, err := storage.RestoreFile(loaded, loaded.Files[0], restored); err != nil {
+		t.Fatal("restore error:", err)
+	}
+	if !bytes.Equal(restored.Bytes(), data) {
+		t.Fatal("restored data differs")
+	}
+
+	plan, err := storage.PlanCleanup()
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	if len(plan.FreedChunks()) != len(fileMeta.Chunks) {
+		t.Fatal("bad freed chunks:", plan.FreedChunks())
+	}
+	if storage.TasksSize(plan.Tasks) != 0 || storage.ChunksSize(plan.FreedChunks()) != int64(len(data)) {
+		t.Fatal("bad freed size:", storage.TasksSize(plan.Tasks), storage.ChunksSize(plan.FreedChunks()))
+	}
+
+	// chunks are fresh and must survive gc grace period
+	storage.ApplyCleanup(plan)
+	if _, err := os.Stat(storage.Dedup.ChunkPath(fileMeta.Chunks[0])); err != nil {
+		t.Fatal("fresh chunk removed:", err)
+	}
+	old := time.Now().Add(-2 * DEDUP_GC_GRACE)
+	for _, hash := range fileMeta.Chunks {
+		os.Chtimes(storage.Dedup.ChunkPath(hash), old, old)
+	}
+	storage.CleanupExpired()
+	if _, err := os.Stat(storage.Dedup.ChunkPath(fileMeta.Chunks[0])); err == nil {
+		t.Fatal("unused chunk not removed")
+	}
+}
+
+func TestStorage_CleanupKeepsChunksOfUnloadedMetadata(t *testing.T) {
+	storage, cleanup := replicationStorage(t)
+	defer cleanup()
+	defer os.RemoveAll(storage.MetadataDir + "_corrupted")
+	newerChunk, _ := storage.Dedup.PutChunk([]byte("newer"))
+	corruptedChunk, _ := storage.Dedup.PutChunk([]byte("corrupted"))
+	old := time.Now().Add(-2 * DEDUP_GC_GRACE)
+	os.Chtimes(storage.Dedup.ChunkPath(newerChunk), old, old)
+	os.Chtimes(storage.Dedup.ChunkPath(corruptedChunk), old, old)
+	newerPath := path.Join(storage.MetadataDir, "newer")
+	ioutil.WriteFile(newerPath, []byte(`{"SchemaVersion":99,"Files":[{"Chunks":["`+newerChunk+`"]}]}`), 0640)
+	ioutil.WriteFile(path.Join(storage.MetadataDir, "corrupted"), []byte(`{"Files":[{"Chunks":["`+corruptedChunk+`"]}`), 0640)
+
+	plan, err := storage.PlanCleanup()
+	if err != nil || len(plan.Corrupted) != 1 || len(plan.Unloaded) != 1 || plan.ChunkRefs != nil {
+		t.Fatal("bad plan:", plan, err)
+	}
+	storage.ApplyCleanup(plan)
+	// corrupted metadata moved away is still not loaded
+	storage.CleanupExpired()
+	for _, hash := range []string{newerChunk, corruptedChunk} {
+		if _, err := os.Stat(storage.Dedup.ChunkPath(hash)); err != nil {
+			t.Fatal("chunk of unloaded metadata removed:", hash)
+		}
+	}
+
+	os.Remove(newerPath)
+	os.RemoveAll(storage.MetadataDir + "_corrupted")
+	storage.CleanupExpired()
+	if _, err := os.Stat(storage.Dedup.ChunkPath(newerChunk)); err == nil {
+		t.Fatal("unused chunk not removed")
+	}
+}
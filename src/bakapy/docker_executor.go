@@ -0,0 +1,64 @@
+package bakapy
+
+import (
+	"errors"
+	"github.com/op/go-logging"
+	"io"
+	"os/exec"
+	"regexp"
+)
+
+var containerNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+
+func ValidateContainerName(name string) error {
+	if !containerNameRe.MatchString(name) {
+		return errors.New("bad container name '" + name + "'")
+	}
+	return nil
+}
+
+// Runs job script inside docker container on job host
+// (or locally if host is not set).
+type DockerExecutor struct {
+	BashExecutor
+	Container string
+}
+
+func NewDockerExecutor(args map[string]string, host string, port uint, sudo bool, container string) *DockerExecutor {
+	return &DockerExecutor{
+		BashExecutor: BashExecutor{
+			Args:   args,
+			Host:   host,
+			Port:   port,
+			Sudo:   sudo,
+			logger: logging.MustGetLogger("bakapy.executor.docker"),
+		},
+		Container: container,
+	}
+}
+
+func (e *DockerExecutor) GetCmd() (*exec.Cmd, error) {
+	if err := ValidateContainerName(e.Container); err != nil {
+		return nil, err
+	}
+	remoteCmd := "docker exec -i " + e.Container + " /bin/bash"
+	if e.Sudo {
+		remoteCmd = "sudo " + remoteCmd
+	}
+	return e.getCmd(remoteCmd)
+}
+
+func (e *DockerExecutor) Execute(script []byte, output io.Writer, errput io.Writer) error {
+	if e.Transport == TRANSPORT_STDOUT {
+		return executeWithStream(e.stream, e.execute, script, output, errput)
+	}
+	return e.execute(script, output, errput)
+}
+
+func (e *DockerExecutor) execute(script []byte, output io.Writer, errput io.Writer) error {
+	cmd, err := e.GetCmd()
+	if err != nil {
+		return err
+	}
+	return e.run(cmd, script, output, errput)
+}
@@ -0,0 +1,85 @@
+package bakapy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestDockerExecutor_GetCmd_Local(t *testing.T) {
+	executor := NewDockerExecutor(map[string]string{}, "", 0, false, "mysql-1")
+	cmd, err := executor.GetCmd()
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	bashPath, _ := exec.LookPath("bash")
+	expected_args := bashPath + "|||-c|||docker exec -i mysql-1 /bin/bash"
+	if strings.Join(cmd.Args, "|||") != expected_args {
+		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected", expected_args)
+	}
+}
+
+func TestDockerExecutor_GetCmd_RemoteSudo(t *testing.T) {
+	executor := NewDockerExecutor(map[string]string{}, "test-host.example", 2424, true, "mysql-1")
+	cmd, err := executor.GetCmd()
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	expected_args := "/usr/bin/ssh|||test-host.example|||-oBatchMode=yes|||-p|||2424|||sudo docker exec -i mysql-1 /bin/bash"
+	if strings.Join(cmd.Args, "|||") != expected_args {
+		t.Fatal("Wrong cmd args:", strings.Join(cmd.Args, "|||"), "expected", expected_args)
+	}
+}
+
+func TestDockerExecutor_GetCmd_BadContainerName(t *testing.T) {
+	executor := NewDockerExecutor(map[string]string{}, "", 0, false, "x; rm -rf /")
+	_, err := executor.GetCmd()
+	if err == nil || err.Error() != "bad container name 'x; rm -rf /'" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestDockerExecutor_Execute_Ok(t *testing.T) {
+	// fake docker binary running command without container
+	binDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(binDir)
+	ioutil.WriteFile(path.Join(binDir, "docker"), []byte(`#!/bin/bash
+test "$1 $2 $3" = "exec -i mysql-1" || exit 99
+shift 3
+exec "$@"
+`), 0755)
+	oldPath := os.Getenv("PATH")
+	os.Setenv("PATH", binDir+":"+oldPath)
+	defer os.Setenv("PATH", oldPath)
+
+	executor := NewDockerExecutor(map[string]string{"db": "it's"}, "", 0, false, "mysql-1")
+	output := new(bytes.Buffer)
+	errput := new(bytes.Buffer)
+	err := executor.Execute([]byte(`printf '%s' "$DB"`), output, errput)
+	if err != nil {
+		t.Fatal("Error:", err, errput.String())
+	}
+	if output.String() != "it's" {
+		t.Fatalf("Output must be 'it's', not '%s'", output)
+	}
+}
+
+func TestJobConfig_Sanitize_DockerWithoutContainer(t *testing.T) {
+	cfg := &JobConfig{Executor: "docker"}
+	err := cfg.Sanitize()
+	if err == nil || err.Error() != "docker executor requires container" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestJobConfig_Sanitize_ContainerWithoutDocker(t *testing.T) {
+	cfg := &JobConfig{Container: "mysql"}
+	err := cfg.Sanitize()
+	if err == nil || err.Error() != "container defined but executor is not docker" {
+		t.Fatal("bad error:", err)
+	}
+}
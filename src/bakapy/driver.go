@@ -0,0 +1,112 @@
+package bakapy
+
+import (
+	"errors"
+	"github.com/op/go-logging"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Built-in backup driver. Runs inside bakapy process instead of
+// shell command and sends files directly to storage.
+type Driver interface {
+	Run(ctx *DriverContext) error
+}
+
+type DriverContext struct {
+	Args   map[string]string
+	Output io.Writer
+	Errput io.Writer
+	// Save content to storage as file name
+	SendFile func(name string, content io.Reader) error
+}
+
+type DriverFactory func() Driver
+
+var driversMu sync.RWMutex
+var drivers = map[string]DriverFactory{
+	"directory": func() Driver { return &DirectoryDriver{} },
+}
+
+func RegisterDriver(name string, factory DriverFactory) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	drivers[name] = factory
+}
+
+func GetDriver(name string) (Driver, error) {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	factory, exist := drivers[name]
+	if !exist {
+		return nil, errors.New("unknown driver '" + name + "'")
+	}
+	return factory(), nil
+}
+
+func DriverNames() []string {
+	driversMu.RLock()
+	defer driversMu.RUnlock()
+	names := make([]string, 0, len(drivers))
+	for name := range drivers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Splits list argument by commas and whitespace
+func driverListArg(value string) []string {
+	return strings.Fields(strings.Replace(value, ",", " ", -1))
+}
+
+// Executer running built-in driver. Job script is ignored.
+type DriverExecutor struct {
+	Name    string
+	Args    map[string]string
+	taskId  TaskId
+	handler StorageConnHandler
+	logger  *logging.Logger
+}
+
+func NewDriverExecutor(name string, args map[string]string) *DriverExecutor {
+	return &DriverExecutor{
+		Name:   name,
+		Args:   args,
+		logger: logging.MustGetLogger("bakapy.executor.driver"),
+	}
+}
+
+func (e *DriverExecutor) SetStream(taskId TaskId, handler StorageConnHandler) {
+	e.taskId = taskId
+	e.handler = handler
+}
+
+func (e *DriverExecutor) sendFile(name string, content io.Reader) error {
+	e.logger.Debug("sending file %s to storage", name)
+	return e.handler.HandleConnection(&streamConn{
+		taskId:     e.taskId,
+		filename:   name,
+		content:    content,
+		remoteAddr: streamAddr("driver:" + e.Name),
+	})
+}
+
+func (e *DriverExecutor) Execute(script []byte, output io.Writer, errput io.Writer) error {
+	if e.handler == nil {
+		return errors.New("driver " + e.Name + " used but storage stream not set")
+	}
+	driver, err := GetDriver(e.Name)
+	if err != nil {
+		return err
+	}
+	e.logger.Debug("running driver %s", e.Name)
+	return driver.Run(&DriverContext{
+		Args:     e.Args,
+		Output:   output,
+		Errput:   errput,
+		SendFile: e.sendFile,
+	})
+}
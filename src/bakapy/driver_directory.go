@@ -0,0 +1,167 @@
+package bakapy
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Saves local directory as tar archive.
+//
+// Args:
+//
+//	path     - directory to backup (required)
+//	include  - file globs to include, all files if empty
+//	exclude  - file and directory globs to skip
+//	filename - archive name, "<path basename>_<start time>.tar" by default
+//
+// Globs are matched against path relative to directory and
+// against base name.
+type DirectoryDriver struct {
+	root    string
+	include []string
+	exclude []string
+	files   int
+	size    int64
+}
+
+func globMatch(patterns []string, relPath string) bool {
+	baseName := filepath.Base(relPath)
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, relPath); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, baseName); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (d *DirectoryDriver) Run(ctx *DriverContext) error {
+	d.root = ctx.Args["path"]
+	if d.root == "" {
+		return errors.New("directory driver requires argument 'path'")
+	}
+	d.root = filepath.Clean(d.root)
+	d.include = driverListArg(ctx.Args["include"])
+	d.exclude = driverListArg(ctx.Args["exclude"])
+	for _, pattern := range append(d.include, d.exclude...) {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			return errors.New("bad glob '" + pattern + "': " + err.Error())
+		}
+	}
+
+	stat, err := os.Stat(d.root)
+	if err != nil {
+		return err
+	}
+	if !stat.IsDir() {
+		return errors.New(d.root + " is not a directory")
+	}
+
+	filename := ctx.Args["filename"]
+	if filename == "" {
+		filename = filepath.Base(d.root) + "_" + time.Now().Format("2006-01-02_150405") + ".tar"
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(d.writeTar(writer, ctx.Errput))
+	}()
+	err = ctx.SendFile(filename, reader)
+	// stop walking if storage failed
+	reader.CloseWithError(errors.New("storage connection closed"))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(ctx.Output, "%s: %d files, %d bytes saved to %s\n", d.root, d.files, d.size, filename)
+	return nil
+}
+
+func (d *DirectoryDriver) writeTar(output io.Writer, errput io.Writer) error {
+	archive := tar.NewWriter(output)
+	prefix := filepath.Base(d.root)
+
+	err := filepath.Walk(d.root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			fmt.Fprintf(errput, "%s\n", err)
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		relPath, err := filepath.Rel(d.root, filePath)
+		if err != nil {
+			return err
+		}
+		if relPath != "." && globMatch(d.exclude, relPath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() && len(d.include) != 0 {
+			return nil
+		}
+		if !info.IsDir() && len(d.include) != 0 && !globMatch(d.include, relPath) {
+			return nil
+		}
+		return d.addFile(archive, filePath, filepath.Join(prefix, relPath), info, errput)
+	})
+	if err != nil {
+		return err
+	}
+	return archive.Close()
+}
+
+func (d *DirectoryDriver) addFile(archive *tar.Writer, filePath string, name string, info os.FileInfo, errput io.Writer) error {
+	var link string
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		link, err = os.Readlink(filePath)
+		if err != nil {
+			fmt.Fprintf(errput, "%s\n", err)
+			return nil
+		}
+	}
+	if !info.Mode().IsRegular() && !info.IsDir() && link == "" {
+		// sockets, devices and pipes are skipped
+		return nil
+	}
+
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = filepath.ToSlash(name)
+	if info.IsDir() {
+		header.Name += "/"
+	}
+
+	if !info.Mode().IsRegular() {
+		return archive.WriteHeader(header)
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		fmt.Fprintf(errput, "%s\n", err)
+		return nil
+	}
+	defer file.Close()
+	if err := archive.WriteHeader(header); err != nil {
+		return err
+	}
+	written, err := io.CopyN(archive, file, header.Size)
+	if err != nil {
+		return errors.New(fmt.Sprintf("%s: %s", strings.TrimPrefix(filePath, d.root), err))
+	}
+	d.files++
+	d.size += written
+	return nil
+}
@@ -0,0 +1,188 @@
+package bakapy
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func makeDriverTree(t *testing.T) string {
+	root, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := path.Join(root, "data")
+	os.MkdirAll(path.Join(dir, "sub"), 0755)
+	os.MkdirAll(path.Join(dir, "cache"), 0755)
+	ioutil.WriteFile(path.Join(dir, "a.txt"), []byte("aaa"), 0644)
+	ioutil.WriteFile(path.Join(dir, "b.log"), []byte("bb"), 0644)
+	ioutil.WriteFile(path.Join(dir, "sub", "c.txt"), []byte("c"), 0644)
+	ioutil.WriteFile(path.Join(dir, "cache", "d.txt"), []byte("dddd"), 0644)
+	os.Symlink("a.txt", path.Join(dir, "link"))
+	return root
+}
+
+func runDirectoryDriver(t *testing.T, args map[string]string) (map[string]string, map[string]*tar.Header, string) {
+	handler := &TestStreamHandler{files: map[string]string{}}
+	executor := NewDriverExecutor("directory", args)
+	executor.SetStream("taskid", handler)
+	output := new(bytes.Buffer)
+	err := executor.Execute(nil, output, new(bytes.Buffer))
+	if err != nil {
+		t.Fatal("Execute failed:", err)
+	}
+	if len(handler.files) != 1 {
+		t.Fatal("one file expected, got", handler.files)
+	}
+
+	files := map[string]string{}
+	headers := map[string]*tar.Header{}
+	for filename, content := range handler.files {
+		if filename != args["filename"] {
+			t.Fatal("bad filename:", filename)
+		}
+		archive := tar.NewReader(strings.NewReader(content))
+		for {
+			header, err := archive.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal("bad tar:", err)
+			}
+			data, _ := ioutil.ReadAll(archive)
+			files[header.Name] = string(data)
+			headers[header.Name] = header
+		}
+	}
+	return files, headers, output.String()
+}
+
+func fileNames(files map[string]string) string {
+	names := []string{}
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func TestDirectoryDriver_All(t *testing.T) {
+	root := makeDriverTree(t)
+	defer os.RemoveAll(root)
+
+	files, headers, output := runDirectoryDriver(t, map[string]string{
+		"path":     path.Join(root, "data"),
+		"filename": "data.tar",
+	})
+	expected := "data/ data/a.txt data/b.log data/cache/ data/cache/d.txt data/link data/sub/ data/sub/c.txt"
+	if fileNames(files) != expected {
+		t.Fatal("bad files:", fileNames(files))
+	}
+	if files["data/a.txt"] != "aaa" || files["data/cache/d.txt"] != "dddd" {
+		t.Fatal("bad content:", files)
+	}
+	if headers["data/link"].Typeflag != tar.TypeSymlink || headers["data/link"].Linkname != "a.txt" {
+		t.Fatal("symlink not saved as link:", headers["data/link"])
+	}
+	if !strings.Contains(output, "4 files, 10 bytes saved to data.tar") {
+		t.Fatal("bad output:", output)
+	}
+}
+
+func TestDirectoryDriver_IncludeExclude(t *testing.T) {
+	root := makeDriverTree(t)
+	defer os.RemoveAll(root)
+
+	files, _, _ := runDirectoryDriver(t, map[string]string{
+		"path":     path.Join(root, "data"),
+		"filename": "data.tar",
+		"include":  "*.txt, *.log",
+		"exclude":  "cache b.log",
+	})
+	if fileNames(files) != "data/a.txt data/sub/c.txt" {
+		t.Fatal("bad files:", fileNames(files))
+	}
+}
+
+func TestDirectoryDriver_NoPath(t *testing.T) {
+	executor := NewDriverExecutor("directory", map[string]string{})
+	executor.SetStream("taskid", &TestStreamHandler{files: map[string]string{}})
+	err := executor.Execute(nil, new(bytes.Buffer), new(bytes.Buffer))
+	if err == nil || err.Error() != "directory driver requires argument 'path'" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestDirectoryDriver_BadGlob(t *testing.T) {
+	executor := NewDriverExecutor("directory", map[string]string{"path": "/tmp", "exclude": "[x"})
+	executor.SetStream("taskid", &TestStreamHandler{files: map[string]string{}})
+	err := executor.Execute(nil, new(bytes.Buffer), new(bytes.Buffer))
+	if err == nil || !strings.HasPrefix(err.Error(), "bad glob '[x'") {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestDriverExecutor_UnknownDriver(t *testing.T) {
+	executor := NewDriverExecutor("wow", map[string]string{})
+	executor.SetStream("taskid", &TestStreamHandler{files: map[string]string{}})
+	err := executor.Execute(nil, new(bytes.Buffer), new(bytes.Buffer))
+	if err == nil || err.Error() != "unknown driver 'wow'" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestDirectoryDriver_RunJob(t *testing.T) {
+	root := makeDriverTree(t)
+	defer os.RemoveAll(root)
+	cfg := NewConfig()
+	cfg.StorageDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(cfg.StorageDir)
+	cfg.MetadataDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(cfg.MetadataDir)
+	defer os.RemoveAll(cfg.MetadataDir + "_artifacts")
+	defer os.RemoveAll(cfg.MetadataDir + "_notify")
+	storage := NewStorage(cfg)
+
+	jConfig := &JobConfig{
+		Namespace: "ns",
+		Driver:    "directory",
+		Args:      map[string]string{"path": path.Join(root, "data"), "filename": "data.tar"},
+	}
+	if err := jConfig.Sanitize(); err != nil {
+		t.Fatal("Sanitize failed:", err)
+	}
+	taskId := RunJob("driver", jConfig, cfg, storage)
+
+	m, err := storage.Metadata.Get(taskId)
+	if err != nil {
+		t.Fatal("cannot load metadata:", err)
+	}
+	if !m.Success {
+		t.Fatal("job failed:", m.Message, string(m.Errput))
+	}
+	if len(m.Files) != 1 || m.Files[0].Name != "data.tar" {
+		t.Fatal("bad metadata files:", m.Files)
+	}
+	stat, err := os.Stat(path.Join(cfg.StorageDir, "ns", "data.tar"))
+	if err != nil || stat.Size() != m.TotalSize {
+		t.Fatal("bad archive:", stat, err)
+	}
+}
+
+func TestJobConfig_Sanitize_Driver(t *testing.T) {
+	jConfig := &JobConfig{Driver: "wow"}
+	if err := jConfig.Sanitize(); err == nil || err.Error() != "unknown driver 'wow'" {
+		t.Fatal("bad error:", err)
+	}
+	jConfig = &JobConfig{Driver: "directory", Host: "web1"}
+	if err := jConfig.Sanitize(); err == nil {
+		t.Fatal("driver with host must fail")
+	}
+}
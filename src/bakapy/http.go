@@ -0,0 +1,26 @@
+package bakapy
+
+import (
+	"net/http"
+)
+
+type HTTPConfig struct {
+	Listen string
+	// Sync endpoint is enabled only if key set
+	SyncKey SecretString `yaml:"sync_key"`
+	// Serve metadata api for web ui
+	API bool `yaml:"api"`
+}
+
+// Handler of scheduler http server
+func NewHTTPHandler(cfg *Config, storage *Storage) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", NewMetricsHandler(cfg, storage))
+	if cfg.HTTP.SyncKey != "" {
+		mux.Handle("/sync/", NewSyncHandler(storage, cfg.HTTP.SyncKey, cfg.SecretsDir))
+	}
+	if cfg.HTTP.API {
+		mux.Handle("/api/", NewAPIHandler(storage))
+	}
+	return mux
+}
@@ -3,27 +3,40 @@ package bakapy
 import (
 	"bytes"
 	"code.google.com/p/go-uuid/uuid"
-	"fmt"
 	"github.com/op/go-logging"
 	"os"
 	"path"
 	"strings"
+	"sync"
 	"time"
 )
 
 type TaskId string
 
+// go-uuid node id initialization is not thread safe
+var taskIdMu sync.Mutex
+
+func NewTaskId() TaskId {
+	taskIdMu.Lock()
+	defer taskIdMu.Unlock()
+	return TaskId(uuid.NewUUID().String())
+}
+
 type JobTemplateContext struct {
-	Job              *Job
-	FILENAME_LEN_LEN uint
+	Job                  *Job
+	StorageAddr          string
+	StreamTransport      bool
+	FILENAME_LEN_LEN     uint
+	STREAM_FRAME_LEN_LEN uint
+	STREAM_CHUNK_SIZE    uint
 }
 
 func (jctx *JobTemplateContext) ToHost() string {
-	return strings.Split(jctx.Job.StorageAddr, ":")[0]
+	return strings.Split(jctx.StorageAddr, ":")[0]
 }
 
 func (jctx *JobTemplateContext) ToPort() string {
-	return strings.Split(jctx.Job.StorageAddr, ":")[1]
+	return strings.Split(jctx.StorageAddr, ":")[1]
 }
 
 type Job struct {
@@ -34,12 +47,16 @@ type Job struct {
 	storage     Jober
 	executor    Executer
 	cfg         *JobConfig
-	logger      *logging.Logger
+	secrets     []string
+	// backup chain position, see FindChainParent
+	backupType   string
+	parentTaskId TaskId
+	logger       *logging.Logger
 }
 
 func NewJob(name string, cfg *JobConfig, StorageAddr string, commandDir string, jober Jober, executor Executer) *Job {
-	taskId := TaskId(uuid.NewUUID().String())
-	loggerName := fmt.Sprintf("bakapy.job[%s][%s]", name, taskId)
+	taskId := NewTaskId()
+	loggerName := LoggerName("bakapy.job", LogFields{Job: name, TaskId: taskId})
 	return &Job{
 		Name:        name,
 		TaskId:      taskId,
@@ -52,11 +69,21 @@ func NewJob(name string, cfg *JobConfig, StorageAddr string, commandDir string,
 	}
 }
 
-func (job *Job) getScript() ([]byte, error) {
+// Generate job script. storageAddr is storage address
+// as seen from remote host.
+func (job *Job) getScript(storageAddr string) ([]byte, error) {
+	if job.cfg.Driver != "" {
+		// built-in drivers do not run shell script
+		return nil, nil
+	}
 	script := new(bytes.Buffer)
 	err := JOB_TEMPLATE.Execute(script, &JobTemplateContext{
-		Job:              job,
-		FILENAME_LEN_LEN: STORAGE_FILENAME_LEN_LEN,
+		Job:                  job,
+		StorageAddr:          storageAddr,
+		StreamTransport:      job.cfg.Transport == TRANSPORT_STDOUT,
+		FILENAME_LEN_LEN:     STORAGE_FILENAME_LEN_LEN,
+		STREAM_FRAME_LEN_LEN: STREAM_FRAME_LEN_LEN,
+		STREAM_CHUNK_SIZE:    STREAM_CHUNK_SIZE,
 	})
 	if err != nil {
 		return nil, err
@@ -77,23 +104,56 @@ func (job *Job) getScript() ([]byte, error) {
 	return script.Bytes(), nil
 }
 
-func (job *Job) Run() *JobMetadata {
+func (job *Job) newMetadata() *JobMetadata {
 	metadata := &JobMetadata{
-		JobName:   job.Name,
-		Gzip:      job.cfg.Gzip,
-		Namespace: job.cfg.Namespace,
-		Pid:       os.Getpid(),
-		Command:   job.cfg.Command,
-		Config:    *job.cfg,
-		StartTime: time.Now(),
-		TaskId:    job.TaskId,
-		Success:   false,
+		JobName:      job.Name,
+		Gzip:         job.cfg.Gzip,
+		Namespace:    job.cfg.Namespace,
+		Host:         job.cfg.Host,
+		Pid:          os.Getpid(),
+		Command:      job.cfg.Command,
+		Config:       *job.cfg,
+		StartTime:    time.Now(),
+		TaskId:       job.TaskId,
+		Success:      false,
+		BackupType:   job.backupType,
+		ParentTaskId: job.parentTaskId,
 	}
-	metadata.ExpireTime = metadata.StartTime.Add(job.cfg.MaxAge)
+	// backups under retention policy have no fixed expire time
+	if !job.cfg.Retention.Enabled() {
+		metadata.ExpireTime = metadata.StartTime.Add(job.cfg.MaxAge)
+	}
+	return metadata
+}
+
+func (job *Job) Run() *JobMetadata {
+	metadata := job.newMetadata()
 	job.logger.Info("starting up")
 
-	script, err := job.getScript()
+	storageAddr := job.StorageAddr
+	tunnel, hasTunnel := job.executor.(TunnelExecuter)
+	if hasTunnel {
+		remoteAddr, err := tunnel.OpenTunnel(job.StorageAddr)
+		if err != nil {
+			job.logger.Warning("cannot open storage tunnel: %s", err.Error())
+			metadata.Message = err.Error()
+			metadata.EndTime = time.Now()
+			return metadata
+		}
+		storageAddr = remoteAddr
+	}
+	closeTunnel := func() {
+		if !hasTunnel {
+			return
+		}
+		if err := tunnel.CloseTunnel(); err != nil {
+			job.logger.Warning("cannot close storage tunnel: %s", err.Error())
+		}
+	}
+
+	script, err := job.getScript(storageAddr)
 	if err != nil {
+		closeTunnel()
 		job.logger.Warning("cannot get job script: %s", err.Error())
 		metadata.Message = err.Error()
 		return metadata
@@ -104,12 +164,15 @@ func (job *Job) Run() *JobMetadata {
 
 	job.storage.AddJob(&StorageCurrentJob{
 		Gzip:        job.cfg.Gzip,
+		Dedup:       job.cfg.Dedup,
 		TaskId:      job.TaskId,
 		Namespace:   job.cfg.Namespace,
 		FileAddChan: fileAddChan,
 	})
 
+	fileAddDone := make(chan bool)
 	go func() {
+		defer close(fileAddDone)
 		for fileMeta := range fileAddChan {
 			job.logger.Debug("adding new file metadata: %s", fileMeta.String())
 			metadata.Files = append(metadata.Files, fileMeta)
@@ -121,19 +184,20 @@ func (job *Job) Run() *JobMetadata {
 	output := new(bytes.Buffer)
 	errput := new(bytes.Buffer)
 	err = job.executor.Execute(script, output, errput)
+	closeTunnel()
 
 	job.storage.RemoveJob(job.TaskId)
 
-	job.logger.Debug("Command output: %s", output.String())
-	job.logger.Debug("Command errput: %s", errput.String())
+	metadata.Output = RedactSecrets(output.Bytes(), job.secrets)
+	metadata.Errput = RedactSecrets(errput.Bytes(), job.secrets)
 
-	metadata.Output = output.Bytes()
-	metadata.Errput = errput.Bytes()
+	job.logger.Debug("Command output: %s", metadata.Output)
+	job.logger.Debug("Command errput: %s", metadata.Errput)
 
 	if err != nil {
 		job.logger.Warning("command failed: %s", err)
 		metadata.Success = false
-		metadata.Message = err.Error()
+		metadata.Message = string(RedactSecrets([]byte(err.Error()), job.secrets))
 		metadata.EndTime = time.Now()
 		return metadata
 	}
@@ -145,5 +209,6 @@ func (job *Job) Run() *JobMetadata {
 	job.logger.Debug("waiting storage")
 	job.storage.WaitJob(job.TaskId)
 	close(fileAddChan)
+	<-fileAddDone
 	return metadata
 }
@@ -3,6 +3,7 @@ package bakapy
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -17,6 +18,8 @@ type JobMetadataFile struct {
 	SourceAddr string
 	StartTime  time.Time
 	EndTime    time.Time
+	// Dedup store chunks, file is not saved to namespace if set
+	Chunks []string `json:",omitempty"`
 }
 
 func (m *JobMetadataFile) String() string {
@@ -24,6 +27,13 @@ func (m *JobMetadataFile) String() string {
 		m.Name, m.Size, m.StartTime, m.EndTime)
 }
 
+// Script, output or errput saved by ArtifactStore
+type JobMetadataArtifact struct {
+	Name string
+	Size int64
+	Gzip bool
+}
+
 type MetadataSortByStartTime []JobMetadata
 
 func (slice MetadataSortByStartTime) Len() int {
@@ -31,7 +41,7 @@ func (slice MetadataSortByStartTime) Len() int {
 }
 
 func (slice MetadataSortByStartTime) Swap(i, j int) {
-	slice[i].StartTime, slice[j].StartTime = slice[j].StartTime, slice[i].StartTime
+	slice[i], slice[j] = slice[j], slice[i]
 }
 
 func (slice MetadataSortByStartTime) Less(i, j int) bool {
@@ -39,26 +49,45 @@ func (slice MetadataSortByStartTime) Less(i, j int) bool {
 }
 
 type JobMetadata struct {
-	JobName    string
-	Gzip       bool
-	Namespace  string
-	TaskId     TaskId
-	Command    string
-	Success    bool
-	Message    string
-	TotalSize  int64
-	StartTime  time.Time
-	EndTime    time.Time
-	ExpireTime time.Time
-	Files      []JobMetadataFile
-	Pid        int
-	RetCode    uint
-	Script     []byte
-	Output     []byte
-	Errput     []byte
-	Config     JobConfig
-	Corrupted  bool   `json:"-"`
-	Filepath   string `json:"-"`
+	JobName   string
+	Gzip      bool
+	Namespace string
+	Host      string
+	TaskId    TaskId
+	// full, diff, inc or empty if job does not make chained backups
+	BackupType string
+	// Task this backup depends on
+	ParentTaskId TaskId
+	Command      string
+	Success      bool
+	Message      string
+	TotalSize    int64
+	StartTime    time.Time
+	EndTime      time.Time
+	ExpireTime   time.Time
+	Files        []JobMetadataFile
+	Pid          int
+	RetCode      uint
+	// Empty if saved as artifacts
+	Script    []byte                `json:",omitempty"`
+	Output    []byte                `json:",omitempty"`
+	Errput    []byte                `json:",omitempty"`
+	Log       []byte                `json:",omitempty"`
+	Artifacts []JobMetadataArtifact `json:",omitempty"`
+	Config    JobConfig
+	Corrupted bool   `json:"-"`
+	Filepath  string `json:"-"`
+	// Format version, 0 for metadata saved before versioning
+	SchemaVersion int
+}
+
+// Identifier of metadata in store, file path if it was loaded
+// from file or task id
+func (metadata *JobMetadata) Key() string {
+	if metadata.Filepath != "" {
+		return metadata.Filepath
+	}
+	return string(metadata.TaskId)
 }
 
 func (metadata *JobMetadata) Duration() time.Duration {
@@ -78,7 +107,74 @@ func (metadata *JobMetadata) AvgSpeed() int64 {
 	return metadata.TotalSize / int64(metadata.Duration().Seconds())
 }
 
+// Metadata of newer version than supported, it cannot be read
+// but is not corrupted
+type MetadataVersionError struct {
+	Version int
+}
+
+func (e *MetadataVersionError) Error() string {
+	return fmt.Sprintf("unsupported metadata schema version %d, newest known is %d", e.Version, METADATA_SCHEMA_VERSION)
+}
+
+// Upgrades of decoded metadata JSON, n-th converts version n to n+1
+var metadataUpgrades = []func(raw map[string]interface{}){
+	upgradeMetadataV0,
+}
+
+// Version 0 had no Host, jobs ran on Config.Host only
+func upgradeMetadataV0(raw map[string]interface{}) {
+	if host, _ := raw["Host"].(string); host != "" {
+		return
+	}
+	if config, ok := raw["Config"].(map[string]interface{}); ok {
+		raw["Host"] = config["Host"]
+	}
+}
+
+// Same fields without UnmarshalJSON, to decode them as is
+type jobMetadataFields JobMetadata
+
+// Decode metadata of any known version, upgrading it to current
+func (metadata *JobMetadata) UnmarshalJSON(data []byte) error {
+	if string(bytes.TrimSpace(data)) == "null" {
+		return nil
+	}
+	fields := jobMetadataFields{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	from := fields.SchemaVersion
+	if from < 0 || from > METADATA_SCHEMA_VERSION {
+		return &MetadataVersionError{from}
+	}
+	if from < METADATA_SCHEMA_VERSION {
+		// numbers kept as is, durations do not fit float64
+		raw := map[string]interface{}{}
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&raw); err != nil {
+			return err
+		}
+		for version := from; version < METADATA_SCHEMA_VERSION; version++ {
+			metadataUpgrades[version](raw)
+		}
+		raw["SchemaVersion"] = METADATA_SCHEMA_VERSION
+		upgraded, err := json.Marshal(raw)
+		if err != nil {
+			return err
+		}
+		fields = jobMetadataFields{}
+		if err := json.Unmarshal(upgraded, &fields); err != nil {
+			return errors.New(fmt.Sprintf("cannot upgrade metadata of version %d: %s", from, err))
+		}
+	}
+	*metadata = JobMetadata(fields)
+	return nil
+}
+
 func (metadata *JobMetadata) Save(saveTo string) error {
+	metadata.SchemaVersion = METADATA_SCHEMA_VERSION
 	err := os.MkdirAll(path.Dir(saveTo), 0750)
 	if err != nil {
 		return err
@@ -104,6 +200,9 @@ func LoadJobMetadata(path string) (*JobMetadata, error) {
 	if err != nil {
 		return nil, err
 	}
+	if trimmed := bytes.TrimSpace(data); len(trimmed) == 0 || trimmed[0] != '{' {
+		return nil, errors.New("metadata is not a JSON object")
+	}
 	metadata := JobMetadata{}
 	err = json.Unmarshal(data, &metadata)
 	if err != nil {
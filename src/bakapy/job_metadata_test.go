@@ -1,6 +1,10 @@
 package bakapy
 
 import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
 	"testing"
 	"time"
 )
@@ -22,7 +26,7 @@ func TestJobMetadataDuration_StartTimeAfterEndTime(t *testing.T) {
 		EndTime:   time.Date(2011, 2, 21, 20, 20, 0, 0, time.UTC),
 	}
 	d := meta.Duration()
-	if d.String() != "0" {
+	if d != 0 {
 		t.Fatal("duration must be 0, not", d)
 	}
 }
@@ -32,7 +36,7 @@ func TestJobMetadataDuration_NoEndTime(t *testing.T) {
 		StartTime: time.Date(2010, 9, 1, 14, 30, 0, 0, time.UTC),
 	}
 	d := meta.Duration()
-	if d.String() != "0" {
+	if d != 0 {
 		t.Fatal("duration must be 0, not", d)
 	}
 }
@@ -42,7 +46,7 @@ func TestJobMetadataDuration_NoStartTime(t *testing.T) {
 		EndTime: time.Date(2010, 9, 1, 14, 30, 0, 0, time.UTC),
 	}
 	d := meta.Duration()
-	if d.String() != "0" {
+	if d != 0 {
 		t.Fatal("duration must be 0, not", d)
 	}
 }
@@ -50,7 +54,7 @@ func TestJobMetadataDuration_NoStartTime(t *testing.T) {
 func TestJobMetadataDuration_NoStartNoEndTime(t *testing.T) {
 	meta := JobMetadata{}
 	d := meta.Duration()
-	if d.String() != "0" {
+	if d != 0 {
 		t.Fatal("duration must be 0, not", d)
 	}
 }
@@ -86,3 +90,90 @@ func TestJobMetadataSaveTo_Ok(t *testing.T) {
 		t.Fatal("Cannot save metadata:", err)
 	}
 }
+
+func TestMetadataSortByStartTime_SwapsWholeMetadata(t *testing.T) {
+	metas := []JobMetadata{
+		{TaskId: "second", StartTime: time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{TaskId: "first", StartTime: time.Date(2011, 1, 1, 0, 0, 0, 0, time.UTC)},
+	}
+	sort.Sort(MetadataSortByStartTime(metas))
+	if metas[0].TaskId != "first" || metas[1].TaskId != "second" {
+		t.Fatal("bad order:", metas[0].TaskId, metas[1].TaskId)
+	}
+}
+
+// Metadata saved by bakapy before schema versioning
+const metadataV0 = `{"JobName":"job","Namespace":"ns","TaskId":"old","Success":true,` +
+	`"Script":"ZWNobw==","Output":"b3V0","Errput":null,` +
+	`"Config":{"Host":"db.example.com","MaxAge":31536000000000001}}`
+
+func TestLoadJobMetadata_UpgradeV0(t *testing.T) {
+	dir, cleanup := metadataStoreTestDir(t)
+	defer cleanup()
+	ioutil.WriteFile(path.Join(dir, "old"), []byte(metadataV0), 0640)
+	metadata, err := LoadJobMetadata(path.Join(dir, "old"))
+	if err != nil {
+		t.Fatal("cannot load:", err)
+	}
+	if metadata.SchemaVersion != METADATA_SCHEMA_VERSION || metadata.Host != "db.example.com" {
+		t.Fatal("metadata not upgraded:", metadata)
+	}
+	if string(metadata.Output) != "out" || metadata.Config.MaxAge != 31536000000000001 {
+		t.Fatal("fields changed by upgrade:", string(metadata.Output), int64(metadata.Config.MaxAge))
+	}
+}
+
+func TestLoadJobMetadata_Invalid(t *testing.T) {
+	dir, cleanup := metadataStoreTestDir(t)
+	defer cleanup()
+	for content, expected := range map[string]string{
+		"[]":                   "metadata is not a JSON object",
+		"null":                 "metadata is not a JSON object",
+		`{"SchemaVersion":99}`: "unsupported metadata schema version 99, newest known is 1",
+	} {
+		ioutil.WriteFile(path.Join(dir, "bad"), []byte(content), 0640)
+		_, err := LoadJobMetadata(path.Join(dir, "bad"))
+		if err == nil || err.Error() != expected {
+			t.Fatal("bad error for", content, err)
+		}
+	}
+
+	// newer metadata is not reported as corrupted
+	ioutil.WriteFile(path.Join(dir, "bad"), []byte(`{"SchemaVersion":99}`), 0640)
+	metadatas, corrupted, err := LoadMetadataDir(dir)
+	if err != nil || len(metadatas) != 0 || len(corrupted) != 0 {
+		t.Fatal("bad load result:", metadatas, corrupted, err)
+	}
+}
+
+func TestStorage_MigrateMetadata(t *testing.T) {
+	storage, cleanup := replicationStorage(t)
+	defer cleanup()
+	oldPath := path.Join(storage.MetadataDir, "old")
+	ioutil.WriteFile(oldPath, []byte(metadataV0), 0640)
+	(&JobMetadata{TaskId: "current", JobName: "job"}).Save(path.Join(storage.MetadataDir, "current"))
+
+	migrated, err := storage.MigrateMetadata(true)
+	if err != nil || len(migrated) != 1 || migrated[0] != oldPath {
+		t.Fatal("bad dry run result:", migrated, err)
+	}
+	if raw, _ := ioutil.ReadFile(oldPath); string(raw) != metadataV0 {
+		t.Fatal("metadata changed by dry run")
+	}
+
+	migrated, err = storage.MigrateMetadata(false)
+	if err != nil || len(migrated) != 1 {
+		t.Fatal("bad migration result:", migrated, err)
+	}
+	migrated, err = storage.MigrateMetadata(true)
+	if err != nil || len(migrated) != 0 {
+		t.Fatal("metadata needs migration after migration:", migrated, err)
+	}
+	metadata, _ := storage.Metadata.Get("old")
+	if metadata.Output != nil || len(metadata.Artifacts) != 2 || metadata.Host != "db.example.com" {
+		t.Fatal("bad migrated metadata:", metadata)
+	}
+	if _, err := os.Stat(oldPath + ".tmp"); !os.IsNotExist(err) {
+		t.Fatal("temporary file left:", err)
+	}
+}
@@ -110,11 +110,11 @@ func TestJob_Run_ExecutionOkMetadataSetted(t *testing.T) {
 	}
 
 	if m.StartTime.Before(now) {
-		t.Fatalf("m.StartTime before ", now)
+		t.Fatal("m.StartTime before", now)
 	}
 
 	if m.EndTime.Before(now) {
-		t.Fatalf("m.EndTime before ", now)
+		t.Fatal("m.EndTime before", now)
 	}
 
 	expected_expire := m.StartTime.Add(maxAge)
@@ -157,10 +157,10 @@ func TestJob_Run_ExecutionFailedMetadataSetted(t *testing.T) {
 		t.Fatalf("m.TaskId must be '%s' not '%s'", m.TaskId, job.TaskId)
 	}
 	if m.StartTime.Before(now) {
-		t.Fatalf("m.StartTime before ", now)
+		t.Fatal("m.StartTime before", now)
 	}
 	if m.EndTime.Before(now) {
-		t.Fatalf("m.EndTime before ", now)
+		t.Fatal("m.EndTime before", now)
 	}
 	expected_expire := m.StartTime.Add(maxAge)
 	if !m.ExpireTime.Equal(expected_expire) {
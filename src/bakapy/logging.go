@@ -0,0 +1,304 @@
+package bakapy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"log/syslog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log formats
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
+const LOG_TEXT_FORMAT = "%{level:.8s} %{module} %{message}"
+const LOG_TEXT_FORMAT_TIME = "%{time:2006-01-02 15:04:05.000} %{level:.8s} %{module} %{message}"
+
+type LogConfig struct {
+	// -loglevel flag wins if given
+	Level  string
+	Format string
+	// Log file instead of stderr, rotated when it grows over
+	// max_size, max_backups old files are kept
+	File       string
+	MaxSize    ByteSize `yaml:"max_size"`
+	MaxBackups int      `yaml:"max_backups"`
+	// Save log of each job run as its artifact
+	RunLogs bool `yaml:"run_logs"`
+}
+
+func (cfg *LogConfig) Validate() error {
+	if cfg.Level != "" {
+		if _, err := logging.LogLevel(strings.ToUpper(cfg.Level)); err != nil {
+			return errors.New("log: " + err.Error())
+		}
+	}
+	switch cfg.Format {
+	case "", LOG_FORMAT_TEXT, LOG_FORMAT_JSON:
+	default:
+		return errors.New("log: unknown format '" + cfg.Format + "'")
+	}
+	if cfg.MaxBackups < 0 {
+		return errors.New("log: max_backups must not be negative")
+	}
+	return nil
+}
+
+// Context of log records, kept in logger module name as
+// "module[job=name][task_id=id]" and split back by JSON format.
+// Brackets in values are escaped as %5B and %5D.
+type LogFields struct {
+	Job        string `json:"job,omitempty"`
+	TaskId     TaskId `json:"task_id,omitempty"`
+	RemoteAddr string `json:"remote_addr,omitempty"`
+	File       string `json:"file,omitempty"`
+}
+
+var logFieldEscaper = strings.NewReplacer("%", "%25", "[", "%5B", "]", "%5D")
+var logFieldUnescaper = strings.NewReplacer("%25", "%", "%5B", "[", "%5D", "]")
+
+func LoggerName(module string, fields LogFields) string {
+	name := module
+	for _, field := range []struct{ key, value string }{
+		{"job", fields.Job},
+		{"task_id", string(fields.TaskId)},
+		{"remote_addr", fields.RemoteAddr},
+		{"file", fields.File},
+	} {
+		if field.value != "" {
+			name += "[" + field.key + "=" + logFieldEscaper.Replace(field.value) + "]"
+		}
+	}
+	return name
+}
+
+func parseLoggerName(name string) (string, LogFields) {
+	fields := LogFields{}
+	idx := strings.Index(name, "[")
+	if idx == -1 || !strings.HasSuffix(name, "]") {
+		return name, fields
+	}
+	for _, part := range strings.Split(name[idx+1:len(name)-1], "][") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return name, LogFields{}
+		}
+		kv[1] = logFieldUnescaper.Replace(kv[1])
+		switch kv[0] {
+		case "job":
+			fields.Job = kv[1]
+		case "task_id":
+			fields.TaskId = TaskId(kv[1])
+		case "remote_addr":
+			fields.RemoteAddr = kv[1]
+		case "file":
+			fields.File = kv[1]
+		}
+	}
+	return name[:idx], fields
+}
+
+type jsonLogRecord struct {
+	Time   time.Time `json:"time"`
+	Level  string    `json:"level"`
+	Module string    `json:"module"`
+	LogFields
+	Message string `json:"message"`
+}
+
+// One JSON object per record
+type jsonLogFormatter struct{}
+
+func (f jsonLogFormatter) Format(calldepth int, r *logging.Record, output io.Writer) error {
+	module, fields := parseLoggerName(r.Module)
+	line, err := json.Marshal(&jsonLogRecord{
+		Time:      r.Time,
+		Level:     r.Level.String(),
+		Module:    module,
+		LogFields: fields,
+		Message:   r.Message(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = output.Write(line)
+	return err
+}
+
+func newLogFormatter(format string, withTime bool) logging.Formatter {
+	if format == LOG_FORMAT_JSON {
+		return jsonLogFormatter{}
+	}
+	if withTime {
+		return logging.MustStringFormatter(LOG_TEXT_FORMAT_TIME)
+	}
+	return logging.MustStringFormatter(LOG_TEXT_FORMAT)
+}
+
+// Log file renamed to file.1, file.1 to file.2 and so on when
+// it grows over max size
+type rotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxBackups int
+	mu         sync.Mutex
+	file       *os.File
+	size       int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	f := &rotatingFile{Path: path, MaxSize: maxSize, MaxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	return nil
+}
+
+func (f *rotatingFile) rotate() error {
+	f.file.Close()
+	os.Remove(fmt.Sprintf("%s.%d", f.Path, f.MaxBackups))
+	for i := f.MaxBackups - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", f.Path, i), fmt.Sprintf("%s.%d", f.Path, i+1))
+	}
+	if f.MaxBackups > 0 {
+		os.Rename(f.Path, f.Path+".1")
+	} else {
+		os.Remove(f.Path)
+	}
+	return f.open()
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Collects records of tasks registered by StartRunLog
+type runLogBackend struct {
+	mu        sync.Mutex
+	enabled   bool
+	logs      map[TaskId]*bytes.Buffer
+	formatter logging.Formatter
+}
+
+var runLogs = &runLogBackend{logs: map[TaskId]*bytes.Buffer{}}
+
+func (b *runLogBackend) Log(level logging.Level, calldepth int, rec *logging.Record) error {
+	if !strings.Contains(rec.Module, "[task_id=") {
+		return nil
+	}
+	_, fields := parseLoggerName(rec.Module)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	buf, exist := b.logs[fields.TaskId]
+	if !exist {
+		return nil
+	}
+	if err := b.formatter.Format(calldepth+1, rec, buf); err != nil {
+		return err
+	}
+	buf.WriteByte('\n')
+	return nil
+}
+
+// Start collecting log records of task if run logs are enabled
+func StartRunLog(taskId TaskId) {
+	runLogs.mu.Lock()
+	defer runLogs.mu.Unlock()
+	if runLogs.enabled {
+		runLogs.logs[taskId] = new(bytes.Buffer)
+	}
+}
+
+// Stop collecting log records of task and return them
+func StopRunLog(taskId TaskId) []byte {
+	runLogs.mu.Lock()
+	defer runLogs.mu.Unlock()
+	buf, exist := runLogs.logs[taskId]
+	if !exist {
+		return nil
+	}
+	delete(runLogs.logs, taskId)
+	return buf.Bytes()
+}
+
+func setupLogging(cfg LogConfig) error {
+	level, err := logging.LogLevel(strings.ToUpper(cfg.Level))
+	if err != nil {
+		return err
+	}
+	var output io.Writer = os.Stderr
+	if cfg.File != "" {
+		output, err = openRotatingFile(cfg.File, int64(cfg.MaxSize), cfg.MaxBackups)
+		if err != nil {
+			return err
+		}
+	}
+	syslogBackend, err := logging.NewSyslogBackendPriority("", syslog.LOG_CRIT|syslog.LOG_DAEMON)
+	if err != nil {
+		return err
+	}
+
+	backends := []logging.Backend{logging.NewLogBackend(output, "", 0), syslogBackend}
+	runLogs.mu.Lock()
+	runLogs.enabled = cfg.RunLogs
+	runLogs.formatter = newLogFormatter(cfg.Format, true)
+	runLogs.mu.Unlock()
+	if cfg.RunLogs {
+		backends = append(backends, runLogs)
+	}
+	logging.SetFormatter(newLogFormatter(cfg.Format, cfg.File != ""))
+	logging.SetBackend(backends...)
+	logging.SetLevel(level, "")
+	return nil
+}
+
+func SetupLogging(logLevel string) error {
+	return setupLogging(LogConfig{Level: logLevel})
+}
+
+// Reconfigure logging by config. Level is taken from config
+// unless -loglevel flag was given.
+func ConfigureLogging(cfg LogConfig, flagLevel string) error {
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		explicit = explicit || f.Name == "loglevel"
+	})
+	if cfg.Level == "" || explicit {
+		cfg.Level = flagLevel
+	}
+	return setupLogging(cfg)
+}
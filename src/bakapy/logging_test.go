@@ -0,0 +1,142 @@
+package bakapy
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestLoggerName(t *testing.T) {
+	fields := LogFields{Job: "db", TaskId: "abc", RemoteAddr: "10.0.0.1:4000", File: "dump.sql"}
+	name := LoggerName("bakapy.storage", fields)
+	if name != "bakapy.storage[job=db][task_id=abc][remote_addr=10.0.0.1:4000][file=dump.sql]" {
+		t.Fatal("bad logger name:", name)
+	}
+	module, parsed := parseLoggerName(name)
+	if module != "bakapy.storage" || parsed != fields {
+		t.Fatal("bad parsed name:", module, parsed)
+	}
+	// file names sent by clients cannot replace other fields
+	fields = LogFields{TaskId: "abc", File: "x][task_id=other]%5B"}
+	name = LoggerName("bakapy.storage", fields)
+	if name != "bakapy.storage[task_id=abc][file=x%5D%5Btask_id=other%5D%255B]" {
+		t.Fatal("bad escaped logger name:", name)
+	}
+	module, parsed = parseLoggerName(name)
+	if module != "bakapy.storage" || parsed != fields {
+		t.Fatal("bad parsed escaped name:", module, parsed)
+	}
+	module, parsed = parseLoggerName("bakapy.job[old style]")
+	if module != "bakapy.job[old style]" || parsed != (LogFields{}) {
+		t.Fatal("bad parsed old style name:", module, parsed)
+	}
+}
+
+func TestJSONLogFormatter(t *testing.T) {
+	memory := logging.InitForTesting(logging.DEBUG)
+	defer logging.Reset()
+	logger := logging.MustGetLogger(LoggerName("bakapy.job", LogFields{Job: "db", TaskId: "abc"}))
+	logger.Info("saved %d files", 2)
+
+	output := new(bytes.Buffer)
+	if err := (jsonLogFormatter{}).Format(0, memory.Head().Record, output); err != nil {
+		t.Fatal("cannot format:", err)
+	}
+	record := map[string]string{}
+	if err := json.Unmarshal(output.Bytes(), &record); err != nil {
+		t.Fatal("bad json:", output.String(), err)
+	}
+	if record["level"] != "INFO" || record["module"] != "bakapy.job" || record["job"] != "db" ||
+		record["task_id"] != "abc" || record["message"] != "saved 2 files" || record["file"] != "" {
+		t.Fatal("bad record:", record)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, cleanup := metadataStoreTestDir(t)
+	defer cleanup()
+	logPath := path.Join(dir, "bakapy.log")
+	file, err := openRotatingFile(logPath, 10, 2)
+	if err != nil {
+		t.Fatal("cannot open:", err)
+	}
+	for _, line := range []string{"first\n", "second\n", "third\n", "fourth\n"} {
+		if _, err := file.Write([]byte(line)); err != nil {
+			t.Fatal("cannot write:", err)
+		}
+	}
+	for name, expected := range map[string]string{"bakapy.log": "fourth\n", "bakapy.log.1": "third\n", "bakapy.log.2": "second\n"} {
+		content, _ := ioutil.ReadFile(path.Join(dir, name))
+		if string(content) != expected {
+			t.Fatal("bad content of", name, ":", string(content))
+		}
+	}
+	if _, err := os.Stat(logPath + ".3"); !os.IsNotExist(err) {
+		t.Fatal("too many backups kept")
+	}
+}
+
+func TestRunJob_RunLog(t *testing.T) {
+	runLogs.mu.Lock()
+	runLogs.enabled = true
+	runLogs.formatter = newLogFormatter(LOG_FORMAT_TEXT, false)
+	runLogs.mu.Unlock()
+	logging.SetBackend(runLogs)
+	defer func() {
+		runLogs.mu.Lock()
+		runLogs.enabled = false
+		runLogs.mu.Unlock()
+		logging.Reset()
+	}()
+
+	storage, cleanup := replicationStorage(t)
+	defer cleanup()
+	gConfig := NewConfig()
+	gConfig.Listen = "1.1.1.1:1234"
+	gConfig.CommandDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(gConfig.CommandDir)
+	os.Create(path.Join(gConfig.CommandDir, "job.cmd"))
+	taskId := RunJob("job", &JobConfig{Command: "job.cmd", executor: &TestOkExecutor{}}, gConfig, storage)
+	// other task records are not collected
+	logging.MustGetLogger(LoggerName("bakapy.job", LogFields{TaskId: "other"})).Info("other task")
+
+	metadata, err := storage.Metadata.Get(taskId)
+	if err != nil || len(metadata.Artifacts) == 0 {
+		t.Fatal("bad metadata:", metadata, err)
+	}
+	storage.Artifacts.Inline(metadata)
+	runLog := string(metadata.Log)
+	if !strings.Contains(runLog, "INFO bakapy.job[job=job][task_id="+string(taskId)+"] starting up") {
+		t.Fatal("bad run log:", runLog)
+	}
+	if strings.Contains(runLog, "other task") {
+		t.Fatal("record of other task in run log:", runLog)
+	}
+	if len(runLogs.logs) != 0 {
+		t.Fatal("run log not released:", runLogs.logs)
+	}
+}
+
+func TestParseConfig_Log(t *testing.T) {
+	cases := map[string]string{
+		"log: {level: loud}":     "log: logger: invalid log level",
+		"log: {format: xml}":     "log: unknown format 'xml'",
+		"log: {max_backups: -1}": "log: max_backups must not be negative",
+		"log: {max_size: 10Q}":   "bad size '10Q'",
+	}
+	for content, expected := range cases {
+		cfg, _ := ioutil.TempFile("", "test_config")
+		cfg.Write([]byte(content))
+		cfg.Close()
+		_, err := ParseConfig(cfg.Name())
+		os.Remove(cfg.Name())
+		if err == nil || err.Error() != expected {
+			t.Fatal("bad error for", content, ":", err)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package bakapy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+func inlineArtifact(raw json.RawMessage) bool {
+	value := string(raw)
+	return value != "" && value != "null" && value != `""`
+}
+
+// Old schema version or script, output, errput or log inside
+func metadataNeedsMigration(data []byte) (bool, error) {
+	peek := struct {
+		SchemaVersion               int
+		Script, Output, Errput, Log json.RawMessage
+	}{}
+	if err := json.Unmarshal(data, &peek); err != nil {
+		return false, err
+	}
+	if peek.SchemaVersion > METADATA_SCHEMA_VERSION {
+		return false, &MetadataVersionError{peek.SchemaVersion}
+	}
+	return peek.SchemaVersion < METADATA_SCHEMA_VERSION ||
+		inlineArtifact(peek.Script) || inlineArtifact(peek.Output) || inlineArtifact(peek.Errput) || inlineArtifact(peek.Log), nil
+}
+
+// Upgrade metadata file in place, moving inline script, output
+// and errput to artifacts
+func (stor *Storage) migrateMetadataFile(metaPath string) error {
+	metadata, err := LoadJobMetadata(metaPath)
+	if err != nil {
+		return err
+	}
+	summary, err := stor.Artifacts.Split(metadata)
+	if err != nil {
+		stor.logger.Warning("cannot save artifacts of %s, keeping them in metadata: %s", metaPath, err)
+		summary = metadata
+	}
+	tmpPath := metaPath + ".tmp"
+	if err := summary.Save(tmpPath); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, metaPath)
+}
+
+func (stor *Storage) migrateMetadataFiles(dryRun bool) ([]string, error) {
+	migrated := []string{}
+	failed := 0
+	visit := func(metaPath string, f os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if f.IsDir() {
+			return nil
+		}
+		data, err := ioutil.ReadFile(metaPath)
+		if err == nil {
+			var needed bool
+			needed, err = metadataNeedsMigration(data)
+			if err == nil && !needed {
+				return nil
+			}
+			if err == nil && !dryRun {
+				err = stor.migrateMetadataFile(metaPath)
+			}
+		}
+		if err != nil {
+			stor.logger.Warning("cannot migrate %s: %s", metaPath, err)
+			failed++
+			return nil
+		}
+		migrated = append(migrated, metaPath)
+		return nil
+	}
+	if _, err := os.Stat(stor.MetadataDir); os.IsNotExist(err) {
+		return migrated, nil
+	}
+	if err := filepath.Walk(stor.MetadataDir, visit); err != nil {
+		return migrated, err
+	}
+	if failed != 0 {
+		return migrated, errors.New(fmt.Sprintf("%d metadata files failed to migrate", failed))
+	}
+	return migrated, nil
+}
+
+// Records of old versions are upgraded on load and rewritten by
+// compaction, inline artifacts are split
+func (stor *Storage) migrateIndexedMetadata(store *IndexedMetadataStore, dryRun bool) ([]string, error) {
+	metadatas, err := store.List(MetadataQuery{})
+	if err != nil {
+		return nil, err
+	}
+	migrated := []string{}
+	for i := range metadatas {
+		metadata := &metadatas[i]
+		if metadata.Script == nil && metadata.Output == nil && metadata.Errput == nil && metadata.Log == nil {
+			continue
+		}
+		if !dryRun {
+			if err := stor.SaveMetadata(metadata); err != nil {
+				return migrated, err
+			}
+		}
+		migrated = append(migrated, string(metadata.TaskId))
+	}
+	if dryRun {
+		return migrated, nil
+	}
+	return migrated, store.Compact()
+}
+
+// Rewrite metadata saved by older bakapy in current format. Returns
+// migrated file paths or task ids of indexed store.
+func (stor *Storage) MigrateMetadata(dryRun bool) ([]string, error) {
+	if indexed, ok := stor.Metadata.(*IndexedMetadataStore); ok {
+		return stor.migrateIndexedMetadata(indexed, dryRun)
+	}
+	return stor.migrateMetadataFiles(dryRun)
+}
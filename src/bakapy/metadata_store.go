@@ -0,0 +1,145 @@
+package bakapy
+
+import (
+	"errors"
+	"os"
+	"path"
+	"sort"
+	"time"
+)
+
+// Metadata store types
+const (
+	METADATA_STORE_FILES   = "files"
+	METADATA_STORE_INDEXED = "indexed"
+)
+
+// Task status filter values
+const (
+	METADATA_STATUS_SUCCESS = "success"
+	METADATA_STATUS_FAILED  = "failed"
+)
+
+// Empty fields match everything. Namespace matches nested
+// namespaces too.
+type MetadataQuery struct {
+	JobName   string
+	Namespace string
+	Status    string
+	Since     time.Time
+	Until     time.Time
+	// Return only last tasks by start time if set
+	Limit int
+}
+
+func (q MetadataQuery) Match(metadata *JobMetadata) bool {
+	if q.JobName != "" && metadata.JobName != q.JobName {
+		return false
+	}
+	if q.Namespace != "" && !inNamespace(metadata.Namespace, path.Clean(q.Namespace)) {
+		return false
+	}
+	switch q.Status {
+	case METADATA_STATUS_SUCCESS:
+		if !metadata.Success {
+			return false
+		}
+	case METADATA_STATUS_FAILED:
+		if metadata.Success {
+			return false
+		}
+	}
+	if !q.Since.IsZero() && metadata.StartTime.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !metadata.StartTime.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+func (q MetadataQuery) Validate() error {
+	switch q.Status {
+	case "", METADATA_STATUS_SUCCESS, METADATA_STATUS_FAILED:
+		return nil
+	}
+	return errors.New("unknown status '" + q.Status + "'")
+}
+
+// Sort by start time and apply limit
+func (q MetadataQuery) finish(metadatas []JobMetadata) []JobMetadata {
+	sort.Stable(MetadataSortByStartTime(metadatas))
+	if q.Limit > 0 && len(metadatas) > q.Limit {
+		metadatas = metadatas[len(metadatas)-q.Limit:]
+	}
+	return metadatas
+}
+
+// Storage of tasks metadata. Get returns error satisfying
+// os.IsNotExist for unknown tasks. List returns tasks sorted
+// by start time.
+type MetadataStore interface {
+	Get(taskId TaskId) (*JobMetadata, error)
+	Save(metadata *JobMetadata) error
+	Delete(taskId TaskId) error
+	List(query MetadataQuery) ([]JobMetadata, error)
+}
+
+func NewMetadataStore(cfg *Config) MetadataStore {
+	if cfg.MetadataStore == METADATA_STORE_INDEXED {
+		return NewIndexedMetadataStore(cfg.MetadataDir)
+	}
+	return &FileMetadataStore{Dir: cfg.MetadataDir}
+}
+
+// One JSON file per task named by task id. Used as default store
+// and as export format of other stores.
+type FileMetadataStore struct {
+	Dir string
+}
+
+func (s *FileMetadataStore) Path(taskId TaskId) string {
+	return path.Join(s.Dir, string(taskId))
+}
+
+func (s *FileMetadataStore) Get(taskId TaskId) (*JobMetadata, error) {
+	if !safeTaskId(taskId) {
+		return nil, &os.PathError{Op: "get", Path: string(taskId), Err: os.ErrNotExist}
+	}
+	metadata, err := LoadJobMetadata(s.Path(taskId))
+	if err != nil {
+		return nil, err
+	}
+	metadata.Filepath = s.Path(taskId)
+	return metadata, nil
+}
+
+func (s *FileMetadataStore) Save(metadata *JobMetadata) error {
+	return metadata.Save(s.Path(metadata.TaskId))
+}
+
+func (s *FileMetadataStore) Delete(taskId TaskId) error {
+	return os.Remove(s.Path(taskId))
+}
+
+func (s *FileMetadataStore) List(query MetadataQuery) ([]JobMetadata, error) {
+	metadatas, _, err := s.LoadAll()
+	if err != nil {
+		return nil, err
+	}
+	matched := []JobMetadata{}
+	for i := range metadatas {
+		if query.Match(&metadatas[i]) {
+			matched = append(matched, metadatas[i])
+		}
+	}
+	return query.finish(matched), nil
+}
+
+// All tasks and paths of files which cannot be loaded
+func (s *FileMetadataStore) LoadAll() ([]JobMetadata, []string, error) {
+	if _, err := os.Stat(s.Dir); os.IsNotExist(err) {
+		return []JobMetadata{}, []string{}, nil
+	}
+	return LoadMetadataDir(s.Dir)
+}
@@ -0,0 +1,452 @@
+package bakapy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+	"syscall"
+)
+
+// Record of indexed store log, either saved metadata or deleted task id
+type metadataLogEntry struct {
+	Metadata *JobMetadata `json:",omitempty"`
+	Delete   TaskId       `json:",omitempty"`
+}
+
+// Metadata store keeping all tasks in one append-only log file
+// $metadata_dir/metadata.log, loaded to memory and indexed by job,
+// namespace, status and start time. Each process reads only log
+// records appended since its last access, so several processes
+// (scheduler, bakapy-run-job) may share the store. Log is rewritten
+// without deleted and replaced records when they take more than
+// half of it. Records saved by newer bakapy are kept as is.
+type IndexedMetadataStore struct {
+	Dir         string
+	mu          sync.Mutex
+	records     map[TaskId]*JobMetadata
+	newer       map[TaskId][]byte
+	byJob       map[string]map[TaskId]bool
+	byNamespace map[string]map[TaskId]bool
+	byStatus    map[bool]map[TaskId]bool
+	// task ids sorted by start time, nil if must be rebuilt
+	byTime  []TaskId
+	offset  int64
+	logInfo os.FileInfo
+	garbage int
+	logger  *logging.Logger
+}
+
+func NewIndexedMetadataStore(dir string) *IndexedMetadataStore {
+	s := &IndexedMetadataStore{
+		Dir:    dir,
+		logger: logging.MustGetLogger("bakapy.metadata"),
+	}
+	s.reset()
+	return s
+}
+
+func (s *IndexedMetadataStore) logPath() string {
+	return path.Join(s.Dir, "metadata.log")
+}
+
+func (s *IndexedMetadataStore) reset() {
+	s.records = map[TaskId]*JobMetadata{}
+	s.newer = map[TaskId][]byte{}
+	s.byJob = map[string]map[TaskId]bool{}
+	s.byNamespace = map[string]map[TaskId]bool{}
+	s.byStatus = map[bool]map[TaskId]bool{}
+	s.byTime = nil
+	s.offset = 0
+	s.logInfo = nil
+	s.garbage = 0
+}
+
+func addIndex(index map[string]map[TaskId]bool, key string, taskId TaskId) {
+	if index[key] == nil {
+		index[key] = map[TaskId]bool{}
+	}
+	index[key][taskId] = true
+}
+
+func removeIndex(index map[string]map[TaskId]bool, key string, taskId TaskId) {
+	delete(index[key], taskId)
+	if len(index[key]) == 0 {
+		delete(index, key)
+	}
+}
+
+func (s *IndexedMetadataStore) remove(taskId TaskId) {
+	metadata, exist := s.records[taskId]
+	if !exist {
+		return
+	}
+	removeIndex(s.byJob, metadata.JobName, taskId)
+	removeIndex(s.byNamespace, path.Clean(metadata.Namespace), taskId)
+	delete(s.byStatus[metadata.Success], taskId)
+	delete(s.records, taskId)
+	s.byTime = nil
+}
+
+func (s *IndexedMetadataStore) exist(taskId TaskId) bool {
+	_, loaded := s.records[taskId]
+	_, newer := s.newer[taskId]
+	return loaded || newer
+}
+
+// Garbage is counted once per replaced or deleted task
+func (s *IndexedMetadataStore) apply(entry *metadataLogEntry) {
+	if entry.Metadata == nil {
+		s.remove(entry.Delete)
+		delete(s.newer, entry.Delete)
+		s.garbage++
+		return
+	}
+	metadata := entry.Metadata
+	if s.exist(metadata.TaskId) {
+		s.garbage++
+	}
+	s.remove(metadata.TaskId)
+	delete(s.newer, metadata.TaskId)
+	s.records[metadata.TaskId] = metadata
+	addIndex(s.byJob, metadata.JobName, metadata.TaskId)
+	addIndex(s.byNamespace, path.Clean(metadata.Namespace), metadata.TaskId)
+	if s.byStatus[metadata.Success] == nil {
+		s.byStatus[metadata.Success] = map[TaskId]bool{}
+	}
+	s.byStatus[metadata.Success][metadata.TaskId] = true
+	s.byTime = nil
+}
+
+// Read records appended to log since last refresh. Log is
+// reloaded if it was rewritten by other process.
+func (s *IndexedMetadataStore) refresh() error {
+	file, err := os.Open(s.logPath())
+	if os.IsNotExist(err) {
+		s.reset()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if s.logInfo == nil || !os.SameFile(info, s.logInfo) || info.Size() < s.offset {
+		s.reset()
+	}
+	s.logInfo = info
+	if info.Size() == s.offset {
+		return nil
+	}
+	if _, err := file.Seek(s.offset, 0); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			// incomplete record is being written now
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entryOffset := s.offset
+		s.offset += int64(len(line))
+		entry := &metadataLogEntry{}
+		err = json.Unmarshal(line, entry)
+		if _, newer := err.(*MetadataVersionError); newer {
+			if taskId := newerRecordTaskId(line); taskId != "" {
+				s.keepNewer(taskId, line)
+				continue
+			}
+		}
+		if err != nil || (entry.Metadata == nil && entry.Delete == "") {
+			s.logger.Warning("skipping corrupted record at offset %d of %s", entryOffset, s.logPath())
+			s.garbage++
+			continue
+		}
+		s.apply(entry)
+	}
+}
+
+// Task id of record which cannot be decoded by this version
+func newerRecordTaskId(line []byte) TaskId {
+	peek := struct {
+		Metadata struct {
+			TaskId TaskId
+		}
+	}{}
+	json.Unmarshal(line, &peek)
+	if !safeTaskId(peek.Metadata.TaskId) {
+		return ""
+	}
+	return peek.Metadata.TaskId
+}
+
+func (s *IndexedMetadataStore) keepNewer(taskId TaskId, line []byte) {
+	if s.exist(taskId) {
+		s.garbage++
+	}
+	s.remove(taskId)
+	s.newer[taskId] = line
+}
+
+// Call f with exclusive lock shared between processes
+func (s *IndexedMetadataStore) withLock(f func() error) error {
+	if err := os.MkdirAll(s.Dir, 0750); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(path.Join(s.Dir, "metadata.lock"), os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+	return f()
+}
+
+func (s *IndexedMetadataStore) append(entry *metadataLogEntry) error {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	return s.withLock(func() error {
+		file, err := os.OpenFile(s.logPath(), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0640)
+		if err != nil {
+			return err
+		}
+		_, err = file.Write(line)
+		if closeErr := file.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return err
+		}
+		if err := s.refresh(); err != nil {
+			return err
+		}
+		if s.garbage > METADATA_LOG_COMPACT_MIN && s.garbage > len(s.records)+len(s.newer) {
+			return s.compact()
+		}
+		return nil
+	})
+}
+
+// Rewrite log with current records only, lock must be held
+func (s *IndexedMetadataStore) compact() error {
+	s.logger.Info("compacting %s, %d records, %d garbage", s.logPath(), len(s.records)+len(s.newer), s.garbage)
+	tmpPath := s.logPath() + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0640)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, taskId := range s.sortedIds() {
+		line, err := json.Marshal(&metadataLogEntry{Metadata: s.records[taskId]})
+		if err == nil {
+			writer.Write(line)
+			err = writer.WriteByte('\n')
+		}
+		if err != nil {
+			file.Close()
+			os.Remove(tmpPath)
+			return err
+		}
+	}
+	for _, taskId := range s.newerIds() {
+		writer.Write(s.newer[taskId])
+	}
+	err = writer.Flush()
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, s.logPath())
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return errors.New(fmt.Sprintf("cannot compact metadata log: %s", err))
+	}
+	s.reset()
+	return s.refresh()
+}
+
+func (s *IndexedMetadataStore) sortedIds() []TaskId {
+	if s.byTime == nil {
+		s.byTime = make([]TaskId, 0, len(s.records))
+		for taskId := range s.records {
+			s.byTime = append(s.byTime, taskId)
+		}
+		sort.Slice(s.byTime, func(i, j int) bool {
+			a, b := s.records[s.byTime[i]], s.records[s.byTime[j]]
+			if a.StartTime.Equal(b.StartTime) {
+				return a.TaskId < b.TaskId
+			}
+			return a.StartTime.Before(b.StartTime)
+		})
+	}
+	return s.byTime
+}
+
+func (s *IndexedMetadataStore) newerIds() []TaskId {
+	taskIds := make([]TaskId, 0, len(s.newer))
+	for taskId := range s.newer {
+		taskIds = append(taskIds, taskId)
+	}
+	sort.Slice(taskIds, func(i, j int) bool { return taskIds[i] < taskIds[j] })
+	return taskIds
+}
+
+func copyMetadata(metadata *JobMetadata) JobMetadata {
+	copied := *metadata
+	copied.Files = append([]JobMetadataFile(nil), metadata.Files...)
+	return copied
+}
+
+func (s *IndexedMetadataStore) Get(taskId TaskId) (*JobMetadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	if line, newer := s.newer[taskId]; newer {
+		return nil, json.Unmarshal(line, &metadataLogEntry{})
+	}
+	metadata, exist := s.records[taskId]
+	if !exist {
+		return nil, &os.PathError{Op: "get", Path: string(taskId), Err: os.ErrNotExist}
+	}
+	copied := copyMetadata(metadata)
+	return &copied, nil
+}
+
+func (s *IndexedMetadataStore) Save(metadata *JobMetadata) error {
+	if !safeTaskId(metadata.TaskId) {
+		return errors.New("bad task id '" + string(metadata.TaskId) + "'")
+	}
+	copied := copyMetadata(metadata)
+	copied.Filepath = ""
+	copied.SchemaVersion = METADATA_SCHEMA_VERSION
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.append(&metadataLogEntry{Metadata: &copied})
+}
+
+func (s *IndexedMetadataStore) Delete(taskId TaskId) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return err
+	}
+	if !s.exist(taskId) {
+		return &os.PathError{Op: "delete", Path: string(taskId), Err: os.ErrNotExist}
+	}
+	return s.append(&metadataLogEntry{Delete: taskId})
+}
+
+func (s *IndexedMetadataStore) List(query MetadataQuery) ([]JobMetadata, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+
+	// smallest index matching query
+	var candidates map[TaskId]bool
+	narrow := func(set map[TaskId]bool) {
+		if set == nil {
+			set = map[TaskId]bool{}
+		}
+		if candidates == nil || len(set) < len(candidates) {
+			candidates = set
+		}
+	}
+	if query.JobName != "" {
+		narrow(s.byJob[query.JobName])
+	}
+	if query.Namespace != "" {
+		namespace := path.Clean(query.Namespace)
+		set := map[TaskId]bool{}
+		for ns, taskIds := range s.byNamespace {
+			if inNamespace(ns, namespace) {
+				for taskId := range taskIds {
+					set[taskId] = true
+				}
+			}
+		}
+		narrow(set)
+	}
+	switch query.Status {
+	case METADATA_STATUS_SUCCESS:
+		narrow(s.byStatus[true])
+	case METADATA_STATUS_FAILED:
+		narrow(s.byStatus[false])
+	}
+
+	// start time range of sorted ids
+	taskIds := s.sortedIds()
+	first, last := 0, len(taskIds)
+	if !query.Since.IsZero() {
+		first = sort.Search(len(taskIds), func(i int) bool {
+			return !s.records[taskIds[i]].StartTime.Before(query.Since)
+		})
+	}
+	if !query.Until.IsZero() {
+		last = sort.Search(len(taskIds), func(i int) bool {
+			return !s.records[taskIds[i]].StartTime.Before(query.Until)
+		})
+	}
+	if last < first {
+		last = first
+	}
+
+	matched := []JobMetadata{}
+	for _, taskId := range taskIds[first:last] {
+		if candidates != nil && !candidates[taskId] {
+			continue
+		}
+		if metadata := s.records[taskId]; query.Match(metadata) {
+			matched = append(matched, copyMetadata(metadata))
+		}
+	}
+	return query.finish(matched), nil
+}
+
+// Task ids of records saved by newer bakapy
+func (s *IndexedMetadataStore) Newer() ([]TaskId, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.refresh(); err != nil {
+		return nil, err
+	}
+	return s.newerIds(), nil
+}
+
+// Rewrite log now
+func (s *IndexedMetadataStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.withLock(func() error {
+		if err := s.refresh(); err != nil {
+			return err
+		}
+		return s.compact()
+	})
+}
@@ -0,0 +1,273 @@
+package bakapy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func metadataStoreTestDir(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatal("cannot create temp dir:", err)
+	}
+	return dir, func() { os.RemoveAll(dir) }
+}
+
+func fillMetadataStore(t *testing.T, store MetadataStore) time.Time {
+	start := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	tasks := []JobMetadata{
+		{TaskId: "a1", JobName: "a", Namespace: "web/a", Success: true, StartTime: start},
+		{TaskId: "b1", JobName: "b", Namespace: "db", Success: false, StartTime: start.Add(time.Hour)},
+		{TaskId: "a2", JobName: "a", Namespace: "web/a", Success: true, StartTime: start.Add(2 * time.Hour)},
+		{TaskId: "c1", JobName: "c", Namespace: "web/c", Success: false, StartTime: start.Add(3 * time.Hour)},
+	}
+	for i := range tasks {
+		if err := store.Save(&tasks[i]); err != nil {
+			t.Fatal("cannot save metadata:", err)
+		}
+	}
+	return start
+}
+
+func metadataTaskIds(metadatas []JobMetadata) []TaskId {
+	taskIds := []TaskId{}
+	for _, metadata := range metadatas {
+		taskIds = append(taskIds, metadata.TaskId)
+	}
+	return taskIds
+}
+
+func checkMetadataQueries(t *testing.T, store MetadataStore) {
+	start := fillMetadataStore(t, store)
+	cases := []struct {
+		query    MetadataQuery
+		expected string
+	}{
+		{MetadataQuery{}, "[a1 b1 a2 c1]"},
+		{MetadataQuery{JobName: "a"}, "[a1 a2]"},
+		{MetadataQuery{Namespace: "web"}, "[a1 a2 c1]"},
+		{MetadataQuery{Namespace: "web/c/"}, "[c1]"},
+		{MetadataQuery{Status: METADATA_STATUS_FAILED}, "[b1 c1]"},
+		{MetadataQuery{Namespace: "web", Status: METADATA_STATUS_SUCCESS}, "[a1 a2]"},
+		{MetadataQuery{Since: start.Add(time.Hour), Until: start.Add(3 * time.Hour)}, "[b1 a2]"},
+		{MetadataQuery{Since: start.Add(90 * time.Minute)}, "[a2 c1]"},
+		{MetadataQuery{Until: start.Add(time.Minute)}, "[a1]"},
+		{MetadataQuery{JobName: "a", Since: start.Add(time.Minute)}, "[a2]"},
+		{MetadataQuery{Since: start.Add(3 * time.Hour), Until: start.Add(time.Hour)}, "[]"},
+		{MetadataQuery{Limit: 2}, "[a2 c1]"},
+		{MetadataQuery{JobName: "unknown"}, "[]"},
+	}
+	for _, c := range cases {
+		metadatas, err := store.List(c.query)
+		if err != nil {
+			t.Fatal("list failed:", err)
+		}
+		if got := fmt.Sprint(metadataTaskIds(metadatas)); got != c.expected {
+			t.Fatal("bad result for", c.query, "expected", c.expected, "got", got)
+		}
+	}
+}
+
+func TestIndexedMetadataStore_Query(t *testing.T) {
+	dir, cleanup := metadataStoreTestDir(t)
+	defer cleanup()
+	checkMetadataQueries(t, NewIndexedMetadataStore(dir))
+}
+
+func TestFileMetadataStore_Query(t *testing.T) {
+	dir, cleanup := metadataStoreTestDir(t)
+	defer cleanup()
+	checkMetadataQueries(t, &FileMetadataStore{Dir: dir})
+}
+
+func TestIndexedMetadataStore_GetSaveDelete(t *testing.T) {
+	dir, cleanup := metadataStoreTestDir(t)
+	defer cleanup()
+	store := NewIndexedMetadataStore(dir)
+	if _, err := store.Get("missing"); !os.IsNotExist(err) {
+		t.Fatal("bad error for missing task:", err)
+	}
+	if err := store.Save(&JobMetadata{TaskId: "../x"}); err == nil {
+		t.Fatal("bad task id accepted")
+	}
+
+	metadata := &JobMetadata{TaskId: "one", JobName: "job", Files: []JobMetadataFile{{Name: "a", Size: 1}}}
+	if err := store.Save(metadata); err != nil {
+		t.Fatal("cannot save:", err)
+	}
+	got, err := store.Get("one")
+	if err != nil || got.JobName != "job" || len(got.Files) != 1 {
+		t.Fatal("bad metadata:", got, err)
+	}
+	// returned metadata is a copy
+	got.Files[0].Name = "changed"
+	got, _ = store.Get("one")
+	if got.Files[0].Name != "a" {
+		t.Fatal("stored metadata modified by caller")
+	}
+
+	metadata.Success = true
+	store.Save(metadata)
+	if metadatas, _ := store.List(MetadataQuery{Status: METADATA_STATUS_FAILED}); len(metadatas) != 0 {
+		t.Fatal("status index not updated:", metadatas)
+	}
+	if store.garbage != 1 {
+		t.Fatal("bad garbage count after replace:", store.garbage)
+	}
+	if err := store.Delete("one"); err != nil {
+		t.Fatal("cannot delete:", err)
+	}
+	if store.garbage != 2 {
+		t.Fatal("bad garbage count after delete:", store.garbage)
+	}
+	if _, err := store.Get("one"); !os.IsNotExist(err) {
+		t.Fatal("deleted task still present:", err)
+	}
+	if err := store.Delete("one"); !os.IsNotExist(err) {
+		t.Fatal("bad error for deleting missing task:", err)
+	}
+}
+
+func TestIndexedMetadataStore_SharedLog(t *testing.T) {
+	dir, cleanup := metadataStoreTestDir(t)
+	defer cleanup()
+	first := NewIndexedMetadataStore(dir)
+	second := NewIndexedMetadataStore(dir)
+	first.Save(&JobMetadata{TaskId: "one", JobName: "job"})
+	if _, err := second.Get("one"); err != nil {
+		t.Fatal("task saved by other instance not found:", err)
+	}
+	second.Save(&JobMetadata{TaskId: "two", JobName: "job"})
+	second.Delete("one")
+	metadatas, err := first.List(MetadataQuery{JobName: "job"})
+	if err != nil || fmt.Sprint(metadataTaskIds(metadatas)) != "[two]" {
+		t.Fatal("changes of other instance not seen:", metadatas, err)
+	}
+
+	// compaction by other instance replaces log file
+	if err := second.Compact(); err != nil {
+		t.Fatal("cannot compact:", err)
+	}
+	first.Save(&JobMetadata{TaskId: "three", JobName: "job"})
+	metadatas, _ = second.List(MetadataQuery{})
+	if fmt.Sprint(metadataTaskIds(metadatas)) != "[three two]" && fmt.Sprint(metadataTaskIds(metadatas)) != "[two three]" {
+		t.Fatal("bad tasks after compaction:", metadataTaskIds(metadatas))
+	}
+}
+
+func TestIndexedMetadataStore_Compact(t *testing.T) {
+	dir, cleanup := metadataStoreTestDir(t)
+	defer cleanup()
+	store := NewIndexedMetadataStore(dir)
+	metadata := &JobMetadata{TaskId: "one", JobName: "job"}
+	for i := 0; i < METADATA_LOG_COMPACT_MIN+2; i++ {
+		metadata.TotalSize = int64(i)
+		if err := store.Save(metadata); err != nil {
+			t.Fatal("cannot save:", err)
+		}
+	}
+	info, err := os.Stat(path.Join(dir, "metadata.log"))
+	if err != nil {
+		t.Fatal("cannot stat log:", err)
+	}
+	if info.Size() > 1024 {
+		t.Fatal("log was not compacted, size", info.Size())
+	}
+	got, err := NewIndexedMetadataStore(dir).Get("one")
+	if err != nil || got.TotalSize != METADATA_LOG_COMPACT_MIN+1 {
+		t.Fatal("bad metadata after compaction:", got, err)
+	}
+}
+
+func TestIndexedMetadataStore_CorruptedRecord(t *testing.T) {
+	dir, cleanup := metadataStoreTestDir(t)
+	defer cleanup()
+	ioutil.WriteFile(path.Join(dir, "metadata.log"), []byte("garbage\n"), 0640)
+	store := NewIndexedMetadataStore(dir)
+	store.Save(&JobMetadata{TaskId: "one"})
+	if _, err := store.Get("one"); err != nil {
+		t.Fatal("record after corrupted one not loaded:", err)
+	}
+}
+
+func TestAPIHandler(t *testing.T) {
+	storage, cleanup := replicationStorage(t)
+	defer cleanup()
+	fillMetadataStore(t, storage.Metadata)
+	cfg := NewConfig()
+	cfg.HTTP.API = true
+	handler := NewHTTPHandler(cfg, storage)
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/metadata?namespace=web&limit=2", nil))
+	metadatas := []JobMetadata{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &metadatas); err != nil {
+		t.Fatal("bad response:", recorder.Body.String())
+	}
+	if fmt.Sprint(metadataTaskIds(metadatas)) != "[a2 c1]" {
+		t.Fatal("bad list:", metadataTaskIds(metadatas))
+	}
+
+	recorder = httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/metadata/b1", nil))
+	metadata := JobMetadata{}
+	if err := json.Unmarshal(recorder.Body.Bytes(), &metadata); err != nil || metadata.JobName != "b" {
+		t.Fatal("bad task response:", recorder.Body.String())
+	}
+
+	for url, code := range map[string]int{
+		"/api/metadata/missing":         404,
+		"/api/metadata/.hidden":         404,
+		"/api/metadata?status=unknown":  400,
+		"/api/metadata?since=yesterday": 400,
+	} {
+		recorder = httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", url, nil))
+		if recorder.Code != code {
+			t.Fatal("bad status for", url, "expected", code, "got", recorder.Code)
+		}
+	}
+}
+
+func TestIndexedMetadataStore_NewerRecord(t *testing.T) {
+	dir, cleanup := metadataStoreTestDir(t)
+	defer cleanup()
+	newer := `{"Metadata":{"TaskId":"newer","SchemaVersion":99,"Files":[{"Chunks":["abc"]}]}}` + "\n"
+	ioutil.WriteFile(path.Join(dir, "metadata.log"), []byte(newer), 0640)
+	store := NewIndexedMetadataStore(dir)
+	store.Save(&JobMetadata{TaskId: "one"})
+	if _, err := store.Get("newer"); err == nil || err.Error() != "unsupported metadata schema version 99, newest known is 1" {
+		t.Fatal("bad error for newer record:", err)
+	}
+	if metadatas, err := store.List(MetadataQuery{}); err != nil || len(metadatas) != 1 {
+		t.Fatal("bad tasks:", metadataTaskIds(metadatas), err)
+	}
+	if store.garbage != 0 {
+		t.Fatal("newer record counted as garbage:", store.garbage)
+	}
+
+	if err := store.Compact(); err != nil {
+		t.Fatal("cannot compact:", err)
+	}
+	content, _ := ioutil.ReadFile(path.Join(dir, "metadata.log"))
+	if !strings.HasSuffix(string(content), newer) {
+		t.Fatal("newer record dropped by compaction:", string(content))
+	}
+	if taskIds, err := NewIndexedMetadataStore(dir).Newer(); err != nil || len(taskIds) != 1 || taskIds[0] != "newer" {
+		t.Fatal("bad newer records:", taskIds, err)
+	}
+
+	if err := store.Delete("newer"); err != nil {
+		t.Fatal("cannot delete newer record:", err)
+	}
+	if _, err := store.Get("newer"); !os.IsNotExist(err) {
+		t.Fatal("newer record not deleted:", err)
+	}
+}
@@ -0,0 +1,229 @@
+package bakapy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+type jobMetrics struct {
+	runs         int64
+	failures     int64
+	running      int
+	lastSuccess  time.Time
+	lastDuration time.Duration
+	lastSize     int64
+}
+
+// Counters of this process exported in prometheus text format.
+// Last job results are loaded from metadata on first scrape, so
+// they survive restarts.
+type Metrics struct {
+	mu             sync.Mutex
+	jobs           map[string]*jobMetrics
+	bytesReceived  int64
+	cleanupDeleted int64
+	seeded         bool
+	diskUsage      map[string]int64
+	diskUsageTime  time.Time
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{jobs: map[string]*jobMetrics{}}
+}
+
+func (m *Metrics) job(jobName string) *jobMetrics {
+	job, exist := m.jobs[jobName]
+	if !exist {
+		job = &jobMetrics{}
+		m.jobs[jobName] = job
+	}
+	return job
+}
+
+func (m *Metrics) JobStarted(jobName string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.job(jobName).running++
+}
+
+func (m *Metrics) JobFinished(metadata *JobMetadata) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job := m.job(metadata.JobName)
+	job.running--
+	job.runs++
+	job.lastDuration = metadata.Duration()
+	if !metadata.Success {
+		job.failures++
+		return
+	}
+	job.lastSuccess = metadata.EndTime
+	job.lastSize = metadata.TotalSize
+}
+
+func (m *Metrics) AddReceived(size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytesReceived += size
+}
+
+func (m *Metrics) AddCleanupDeleted(size int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.cleanupDeleted += size
+}
+
+// Take last results of jobs not run by this process yet
+func (m *Metrics) seed(metadatas []JobMetadata) {
+	for i := range metadatas {
+		metadata := &metadatas[i]
+		job := m.job(metadata.JobName)
+		if job.runs != 0 {
+			continue
+		}
+		job.lastDuration = metadata.Duration()
+		if metadata.Success {
+			job.lastSuccess = metadata.EndTime
+			job.lastSize = metadata.TotalSize
+		}
+	}
+	m.seeded = true
+}
+
+// Sizes of namespace directories, walked at most once per interval
+func (m *Metrics) refreshDiskUsage(storage *Storage, metadatas []JobMetadata) {
+	if time.Since(m.diskUsageTime) < METRICS_DISK_USAGE_INTERVAL {
+		return
+	}
+	usage := map[string]int64{}
+	for _, metadata := range metadatas {
+		namespace := path.Clean(metadata.Namespace)
+		if _, done := usage[namespace]; done || !safeRelPath(namespace) {
+			continue
+		}
+		size, err := dirSize(path.Join(storage.RootDir, namespace))
+		if err != nil {
+			storage.logger.Warning("cannot get size of namespace %s: %s", namespace, err)
+			continue
+		}
+		usage[namespace] = size
+	}
+	m.diskUsage = usage
+	m.diskUsageTime = time.Now()
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+type metricWriter struct {
+	output io.Writer
+}
+
+func (w *metricWriter) header(name, metricType, help string) {
+	fmt.Fprintf(w.output, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func (w *metricWriter) value(name, label, labelValue string, value float64) {
+	if label == "" {
+		fmt.Fprintf(w.output, "%s %g\n", name, value)
+	} else {
+		fmt.Fprintf(w.output, "%s{%s=\"%s\"} %g\n", name, label, escapeLabel(labelValue), value)
+	}
+}
+
+func (w *metricWriter) jobs(name, metricType, help string, jobNames []string, jobs map[string]*jobMetrics, value func(job *jobMetrics) float64) {
+	w.header(name, metricType, help)
+	for _, jobName := range jobNames {
+		w.value(name, "job", jobName, value(jobs[jobName]))
+	}
+}
+
+func (m *Metrics) Write(output io.Writer, connections int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	jobNames := []string{}
+	for jobName := range m.jobs {
+		jobNames = append(jobNames, jobName)
+	}
+	sort.Strings(jobNames)
+
+	w := &metricWriter{output}
+	w.jobs("bakapy_job_last_success_timestamp_seconds", "gauge", "End time of last successful run.", jobNames, m.jobs, func(job *jobMetrics) float64 {
+		if job.lastSuccess.IsZero() {
+			return 0
+		}
+		return float64(job.lastSuccess.UnixNano()) / 1e9
+	})
+	w.jobs("bakapy_job_last_duration_seconds", "gauge", "Duration of last run.", jobNames, m.jobs, func(job *jobMetrics) float64 {
+		return job.lastDuration.Seconds()
+	})
+	w.jobs("bakapy_job_last_size_bytes", "gauge", "Total size of last successful run.", jobNames, m.jobs, func(job *jobMetrics) float64 {
+		return float64(job.lastSize)
+	})
+	w.jobs("bakapy_job_runs_total", "counter", "Runs finished by this process.", jobNames, m.jobs, func(job *jobMetrics) float64 {
+		return float64(job.runs)
+	})
+	w.jobs("bakapy_job_failures_total", "counter", "Failed runs finished by this process.", jobNames, m.jobs, func(job *jobMetrics) float64 {
+		return float64(job.failures)
+	})
+	w.jobs("bakapy_job_running", "gauge", "Runs in progress.", jobNames, m.jobs, func(job *jobMetrics) float64 {
+		return float64(job.running)
+	})
+
+	w.header("bakapy_storage_connections", "gauge", "Active storage connections.")
+	w.value("bakapy_storage_connections", "", "", float64(connections))
+	w.header("bakapy_storage_received_bytes_total", "counter", "Bytes of files received by storage.")
+	w.value("bakapy_storage_received_bytes_total", "", "", float64(m.bytesReceived))
+	w.header("bakapy_cleanup_deleted_bytes_total", "counter", "Bytes of files removed by cleanup.")
+	w.value("bakapy_cleanup_deleted_bytes_total", "", "", float64(m.cleanupDeleted))
+
+	namespaces := []string{}
+	for namespace := range m.diskUsage {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	w.header("bakapy_storage_namespace_bytes", "gauge", "Disk usage of namespace directory, including nested namespaces.")
+	for _, namespace := range namespaces {
+		w.value("bakapy_storage_namespace_bytes", "namespace", namespace, float64(m.diskUsage[namespace]))
+	}
+}
+
+// Serves /metrics in prometheus text format
+type MetricsHandler struct {
+	storage *Storage
+	jobs    map[string]*JobConfig
+}
+
+func NewMetricsHandler(cfg *Config, storage *Storage) *MetricsHandler {
+	return &MetricsHandler{storage: storage, jobs: cfg.Jobs}
+}
+
+func (h *MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	metrics := h.storage.Metrics
+	metrics.mu.Lock()
+	for jobName := range h.jobs {
+		metrics.job(jobName)
+	}
+	if !metrics.seeded || time.Since(metrics.diskUsageTime) >= METRICS_DISK_USAGE_INTERVAL {
+		metadatas, err := h.storage.Metadata.List(MetadataQuery{})
+		if err != nil {
+			h.storage.logger.Warning("cannot load metadata for metrics: %s", err)
+		} else {
+			if !metrics.seeded {
+				metrics.seed(metadatas)
+			}
+			metrics.refreshDiskUsage(h.storage, metadatas)
+		}
+	}
+	metrics.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	metrics.Write(w, h.storage.ConnectionCount())
+}
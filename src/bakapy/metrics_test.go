@@ -0,0 +1,72 @@
+package bakapy
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func scrapeMetrics(t *testing.T, cfg *Config, storage *Storage) string {
+	recorder := httptest.NewRecorder()
+	NewHTTPHandler(cfg, storage).ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if recorder.Code != 200 {
+		t.Fatal("bad status:", recorder.Code)
+	}
+	return recorder.Body.String()
+}
+
+func checkMetric(t *testing.T, body, line string) {
+	for _, l := range strings.Split(body, "\n") {
+		if l == line {
+			return
+		}
+	}
+	t.Fatal("metric line", line, "not found in:\n"+body)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	storage, cleanup := replicationStorage(t)
+	defer cleanup()
+	start := time.Unix(1500000000, 0)
+	storage.Metadata.Save(&JobMetadata{
+		TaskId: "old", JobName: "db", Namespace: "ns", Success: true,
+		StartTime: start, EndTime: start.Add(time.Minute), TotalSize: 100,
+	})
+	os.MkdirAll(path.Join(storage.RootDir, "ns"), 0755)
+	ioutil.WriteFile(path.Join(storage.RootDir, "ns", "dump.sql"), []byte("hello"), 0644)
+
+	cfg := NewConfig()
+	cfg.Jobs = map[string]*JobConfig{"web": {}, "db": {}}
+	storage.Metrics.JobStarted("web")
+	storage.Metrics.JobFinished(&JobMetadata{JobName: "web", StartTime: start, EndTime: start.Add(time.Second)})
+	storage.Metrics.JobStarted("web")
+	storage.Metrics.AddReceived(42)
+	storage.AddConnection("task")
+
+	body := scrapeMetrics(t, cfg, storage)
+	checkMetric(t, body, "# TYPE bakapy_job_runs_total counter")
+	checkMetric(t, body, `bakapy_job_last_success_timestamp_seconds{job="db"} 1.50000006e+09`)
+	checkMetric(t, body, `bakapy_job_last_duration_seconds{job="db"} 60`)
+	checkMetric(t, body, `bakapy_job_last_size_bytes{job="db"} 100`)
+	checkMetric(t, body, `bakapy_job_runs_total{job="db"} 0`)
+	checkMetric(t, body, `bakapy_job_runs_total{job="web"} 1`)
+	checkMetric(t, body, `bakapy_job_failures_total{job="web"} 1`)
+	checkMetric(t, body, `bakapy_job_running{job="web"} 1`)
+	checkMetric(t, body, `bakapy_job_last_success_timestamp_seconds{job="web"} 0`)
+	checkMetric(t, body, "bakapy_storage_connections 1")
+	checkMetric(t, body, "bakapy_storage_received_bytes_total 42")
+	checkMetric(t, body, `bakapy_storage_namespace_bytes{namespace="ns"} 5`)
+
+	storage.removeTask(JobMetadata{TaskId: "old", Namespace: "ns", Files: []JobMetadataFile{{Name: "dump.sql"}}})
+	checkMetric(t, scrapeMetrics(t, cfg, storage), "bakapy_cleanup_deleted_bytes_total 5")
+}
+
+func TestEscapeLabel(t *testing.T) {
+	if escaped := escapeLabel("a\"b\\c\nd"); escaped != `a\"b\\c\nd` {
+		t.Fatal("bad escaped label:", escaped)
+	}
+}
@@ -0,0 +1,367 @@
+package bakapy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Notification events
+const (
+	EVENT_FAILURE  = "failure"
+	EVENT_SUCCESS  = "success"
+	EVENT_RECOVERY = "recovery"
+	EVENT_STALE    = "stale"
+	EVENT_REPORT   = "report"
+)
+
+// Notifier types
+const (
+	NOTIFIER_SMTP    = "smtp"
+	NOTIFIER_WEBHOOK = "webhook"
+	NOTIFIER_COMMAND = "command"
+)
+
+var notificationEvents = []string{EVENT_FAILURE, EVENT_SUCCESS, EVENT_RECOVERY, EVENT_STALE, EVENT_REPORT}
+
+func isNotificationEvent(event string) bool {
+	for _, e := range notificationEvents {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// Events routed to all notifiers when routing is not configured
+var defaultNotifyEvents = []string{EVENT_FAILURE, EVENT_RECOVERY, EVENT_STALE, EVENT_REPORT}
+
+type NotifierConfig struct {
+	Name string
+	Type string
+	// webhook, may be !secret or !env reference
+	URL     SecretString
+	Headers map[string]SecretString
+	// command, notification JSON is written to its stdin
+	Command string
+	Args    []string
+	Timeout time.Duration
+}
+
+func (n *NotifierConfig) Sanitize(secretsDir string) error {
+	if n.Name == "" {
+		return errors.New("notifier name required")
+	}
+	switch n.Type {
+	case NOTIFIER_SMTP:
+	case NOTIFIER_WEBHOOK:
+		if n.URL == "" {
+			return errors.New("notifier " + n.Name + ": webhook notifier requires url")
+		}
+		if _, err := n.URL.Resolve(secretsDir); err != nil {
+			return errors.New("notifier " + n.Name + ": " + err.Error())
+		}
+		for _, value := range n.Headers {
+			if _, err := value.Resolve(secretsDir); err != nil {
+				return errors.New("notifier " + n.Name + ": " + err.Error())
+			}
+		}
+	case NOTIFIER_COMMAND:
+		if n.Command == "" {
+			return errors.New("notifier " + n.Name + ": command notifier requires command")
+		}
+	default:
+		return errors.New("notifier " + n.Name + ": unknown type '" + n.Type + "'")
+	}
+	if n.Timeout == 0 {
+		n.Timeout = NOTIFY_DEFAULT_TIMEOUT
+	}
+	return nil
+}
+
+// Notifier names by event
+type NotifyRoutes map[string][]string
+
+func (r NotifyRoutes) Validate(notifiers map[string]bool) error {
+	for event, names := range r {
+		if !isNotificationEvent(event) {
+			return errors.New("unknown notification event '" + event + "'")
+		}
+		for _, name := range names {
+			if !notifiers[name] {
+				return errors.New(fmt.Sprintf("unknown notifier '%s' for %s event", name, event))
+			}
+		}
+	}
+	return nil
+}
+
+type Notification struct {
+	Event   string
+	JobName string
+	Host    string
+	Message string
+	// Run summary, without script, output, errput and log
+	Metadata *JobMetadata `json:",omitempty"`
+	Stale    *StaleJob    `json:",omitempty"`
+	Report   *Report      `json:",omitempty"`
+	// Failed runs in a row, for failure event
+	Failures int `json:",omitempty"`
+	// Report format, Message holds rendered report
+	Format string `json:",omitempty"`
+	// Not sent by webhook and command
+	Output []byte `json:"-"`
+	Errput []byte `json:"-"`
+	// Mail recipients of job, smtp to if empty
+	MailTo []string `json:"-"`
+}
+
+func NewJobNotification(event string, metadata *JobMetadata) *Notification {
+	summary := *metadata
+	summary.Script, summary.Output, summary.Errput, summary.Log = nil, nil, nil, nil
+	return &Notification{
+		Event:    event,
+		JobName:  metadata.JobName,
+		Host:     metadata.Host,
+		Message:  metadata.Message,
+		Metadata: &summary,
+		Output:   metadata.Output,
+		Errput:   metadata.Errput,
+	}
+}
+
+func NewStaleNotification(stale StaleJob) *Notification {
+	return &Notification{
+		Event:   EVENT_STALE,
+		JobName: stale.JobName,
+		Host:    stale.Host,
+		Message: stale.String(),
+		Stale:   &stale,
+	}
+}
+
+type Notifier interface {
+	Notify(n *Notification) error
+}
+
+func NewNotifier(cfg NotifierConfig, smtp SMTPConfig, secretsDir string) Notifier {
+	switch cfg.Type {
+	case NOTIFIER_WEBHOOK:
+		return &WebhookNotifier{URL: cfg.URL, Headers: cfg.Headers, Timeout: cfg.Timeout, SecretsDir: secretsDir}
+	case NOTIFIER_COMMAND:
+		return &CommandNotifier{Command: cfg.Command, Args: cfg.Args, Timeout: cfg.Timeout}
+	default:
+		return &SMTPNotifier{Config: smtp, SecretsDir: secretsDir}
+	}
+}
+
+// Mails notification using smtp from main config
+type SMTPNotifier struct {
+	Config     SMTPConfig
+	SecretsDir string
+}
+
+func (s *SMTPNotifier) Notify(n *Notification) error {
+	tmpl := MAIL_TEMPLATE_JOB_EVENT
+	subject := fmt.Sprintf("[bakapy] job %s %s", n.JobName, n.Event)
+	switch n.Event {
+	case EVENT_FAILURE:
+		tmpl, subject = MAIL_TEMPLATE_JOB_FAILED, fmt.Sprintf("[bakapy] job %s failed", n.JobName)
+		if n.Failures > 1 {
+			subject = fmt.Sprintf("[bakapy] job %s failed %d times in a row", n.JobName, n.Failures)
+		}
+	case EVENT_STALE:
+		tmpl, subject = MAIL_TEMPLATE_JOB_STALE, fmt.Sprintf("[bakapy] job %s is stale", n.Stale.Key())
+	case EVENT_RECOVERY:
+		subject = fmt.Sprintf("[bakapy] job %s recovered", n.JobName)
+	case EVENT_SUCCESS:
+		subject = fmt.Sprintf("[bakapy] job %s succeeded", n.JobName)
+	case EVENT_REPORT:
+		tmpl, subject = MAIL_TEMPLATE_REPORT, fmt.Sprintf("[bakapy] %s report", n.Report.Name)
+	}
+	contentType := "text/plain"
+	if n.Format == REPORT_FORMAT_HTML {
+		contentType = "text/html"
+	}
+	to := n.MailTo
+	if len(to) == 0 {
+		to = s.Config.To
+	}
+	return sendNotification(s.Config, s.SecretsDir, to, s.Config.Template(n.Event, tmpl), NotificationTemplateContext{
+		Subject:     subject,
+		ContentType: contentType,
+		JobName:     n.JobName,
+		Host:        n.Host,
+		Event:       n.Event,
+		Message:     n.Message,
+		Output:      string(n.Output),
+		Errput:      string(n.Errput),
+	})
+}
+
+// Posts notification JSON to url. Secret references of url and
+// headers are resolved on each notification.
+type WebhookNotifier struct {
+	URL        SecretString
+	Headers    map[string]SecretString
+	Timeout    time.Duration
+	SecretsDir string
+}
+
+func (w *WebhookNotifier) Notify(n *Notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	url, err := w.URL.Resolve(w.SecretsDir)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range w.Headers {
+		header, err := value.Resolve(w.SecretsDir)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(name, header)
+	}
+	client := &http.Client{Timeout: w.Timeout}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.New(fmt.Sprintf("webhook returned %s: %s", resp.Status, strings.TrimSpace(string(message))))
+	}
+	return nil
+}
+
+// Runs command with notification JSON on stdin and
+// BAKAPY_EVENT, BAKAPY_JOB, BAKAPY_HOST, BAKAPY_MESSAGE variables
+type CommandNotifier struct {
+	Command string
+	Args    []string
+	Timeout time.Duration
+}
+
+func (c *CommandNotifier) Notify(n *Notification) error {
+	payload, err := json.Marshal(n)
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(c.Command, c.Args...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Env = append(os.Environ(),
+		"BAKAPY_EVENT="+n.Event,
+		"BAKAPY_JOB="+n.JobName,
+		"BAKAPY_HOST="+n.Host,
+		"BAKAPY_MESSAGE="+n.Message,
+	)
+	output := new(bytes.Buffer)
+	cmd.Stdout = output
+	cmd.Stderr = output
+	// own process group to kill children on timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+	select {
+	case err = <-done:
+	case <-time.After(c.Timeout):
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		err = errors.New("timed out after " + c.Timeout.String())
+	}
+	if err != nil {
+		return errors.New(fmt.Sprintf("command %s failed: %s: %s", c.Command, err, strings.TrimSpace(output.String())))
+	}
+	return nil
+}
+
+// Sends notifications to notifiers selected by job routes, or by
+// global routes for events job has no routes for. Without
+// configured notifiers failures and stale jobs are mailed.
+type NotificationRouter struct {
+	notifiers map[string]Notifier
+	routes    NotifyRoutes
+	logger    *logging.Logger
+}
+
+func NewNotificationRouter(cfg *Config) *NotificationRouter {
+	r := &NotificationRouter{
+		notifiers: map[string]Notifier{},
+		routes:    cfg.Notify,
+		logger:    logging.MustGetLogger("bakapy.notify"),
+	}
+	notifiers := cfg.Notifiers
+	if len(notifiers) == 0 {
+		notifiers = []NotifierConfig{{Name: NOTIFIER_SMTP, Type: NOTIFIER_SMTP}}
+	}
+	for _, notifierConfig := range notifiers {
+		r.notifiers[notifierConfig.Name] = NewNotifier(notifierConfig, cfg.SMTP, cfg.SecretsDir)
+	}
+	if r.routes == nil {
+		r.routes = NotifyRoutes{}
+		for _, event := range defaultNotifyEvents {
+			for _, notifierConfig := range notifiers {
+				r.routes[event] = append(r.routes[event], notifierConfig.Name)
+			}
+		}
+	}
+	return r
+}
+
+// Notifier names for event of job
+func (r *NotificationRouter) Route(jobConfig *JobConfig, event string) []string {
+	if jobConfig != nil {
+		if names, exist := jobConfig.Notify[event]; exist {
+			return names
+		}
+	}
+	return r.routes[event]
+}
+
+// Notify all routed notifiers, returns first error
+func (r *NotificationRouter) Send(jobConfig *JobConfig, n *Notification) error {
+	if jobConfig != nil && len(jobConfig.NotifyTo) != 0 {
+		n.MailTo = jobConfig.NotifyTo
+	}
+	return r.SendTo(r.Route(jobConfig, n.Event), n)
+}
+
+// Notify named notifiers, returns first error
+func (r *NotificationRouter) SendTo(names []string, n *Notification) error {
+	var firstErr error
+	for _, name := range names {
+		notifier, exist := r.notifiers[name]
+		if !exist {
+			continue
+		}
+		r.logger.Debug("sending %s notification of job %s to %s", n.Event, n.JobName, name)
+		if err := notifier.Notify(n); err != nil {
+			r.logger.Critical("cannot send %s notification of job %s to %s: %s", n.Event, n.JobName, name, err)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,158 @@
+package bakapy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Notification state of job on host, used to alert once per
+// failure episode and to notice recovery
+type NotifyState struct {
+	Key string
+	// Failed runs since last success
+	Failures     int
+	FirstFailure time.Time
+	// Last failure alert and failures count at that moment,
+	// zero if failures were not alerted yet
+	LastAlert       time.Time
+	AlertedFailures int
+	// Stale alert sent and job is still stale
+	Stale bool
+}
+
+// Events to notify about finished run. Failure is alerted on first
+// failure of episode, then again after realert_failures more failures
+// or realert_interval since last alert. Success after failures is
+// also recovery.
+func (s *NotifyState) RunFinished(metadata *JobMetadata, jobConfig *JobConfig) []string {
+	if metadata.Success {
+		events := []string{EVENT_SUCCESS}
+		if s.Failures != 0 {
+			events = append(events, EVENT_RECOVERY)
+		}
+		*s = NotifyState{Key: s.Key, Stale: s.Stale}
+		return events
+	}
+
+	s.Failures++
+	if s.Failures == 1 {
+		s.FirstFailure = metadata.StartTime
+	}
+	switch {
+	case s.AlertedFailures == 0:
+	case jobConfig.RealertFailures > 0 && s.Failures-s.AlertedFailures >= int(jobConfig.RealertFailures):
+	case jobConfig.RealertInterval > 0 && metadata.EndTime.Sub(s.LastAlert) >= jobConfig.RealertInterval:
+	default:
+		return nil
+	}
+	return []string{EVENT_FAILURE}
+}
+
+// Record failure alert sent at given time
+func (s *NotifyState) Alerted(now time.Time) {
+	s.LastAlert = now
+	s.AlertedFailures = s.Failures
+}
+
+// Keeps NotifyState of each job and host as JSON file in
+// $metadata_dir_notify, so scheduler restarts do not repeat
+// or lose alerts
+type NotifyStateStore struct {
+	Dir string
+}
+
+func NewNotifyStateStore(cfg *Config) *NotifyStateStore {
+	dir := cfg.NotifyStateDir
+	if dir == "" {
+		dir = cfg.MetadataDir + "_notify"
+	}
+	return &NotifyStateStore{Dir: dir}
+}
+
+// State key of job run on host, host is empty for local jobs
+func NotifyStateKey(jobName, host string) string {
+	if host == "" {
+		return jobName
+	}
+	return jobName + "@" + host
+}
+
+func (s *NotifyStateStore) Path(key string) string {
+	return path.Join(s.Dir, strings.Replace(key, "/", "_", -1)+".json")
+}
+
+func (s *NotifyStateStore) Get(key string) (*NotifyState, error) {
+	state := &NotifyState{}
+	raw, err := ioutil.ReadFile(s.Path(key))
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return nil, errors.New("bad notify state " + s.Path(key) + ": " + err.Error())
+	}
+	return state, nil
+}
+
+// All saved states by key
+func (s *NotifyStateStore) List() (map[string]*NotifyState, error) {
+	states := map[string]*NotifyState{}
+	paths, err := filepath.Glob(path.Join(s.Dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, statePath := range paths {
+		raw, err := ioutil.ReadFile(statePath)
+		if err != nil {
+			return nil, err
+		}
+		state := &NotifyState{}
+		if err := json.Unmarshal(raw, state); err != nil {
+			return nil, errors.New("bad notify state " + statePath + ": " + err.Error())
+		}
+		states[state.Key] = state
+	}
+	return states, nil
+}
+
+// Load state, modify it by f and save. Processes sharing
+// store are serialized by lock file.
+func (s *NotifyStateStore) Update(key string, f func(state *NotifyState)) error {
+	if err := os.MkdirAll(s.Dir, 0750); err != nil {
+		return err
+	}
+	lock, err := os.OpenFile(path.Join(s.Dir, "notify.lock"), os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(lock.Fd()), syscall.LOCK_UN)
+
+	state, err := s.Get(key)
+	if err != nil {
+		return err
+	}
+	f(state)
+	state.Key = key
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := s.Path(key) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, raw, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.Path(key))
+}
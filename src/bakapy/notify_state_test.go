@@ -0,0 +1,77 @@
+package bakapy
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotifyState_RunFinished(t *testing.T) {
+	jobConfig := &JobConfig{RealertFailures: 3, RealertInterval: 24 * time.Hour}
+	state := &NotifyState{}
+	now := time.Now()
+	run := func(success bool, at time.Duration) string {
+		metadata := &JobMetadata{Success: success, StartTime: now.Add(at), EndTime: now.Add(at)}
+		events := state.RunFinished(metadata, jobConfig)
+		if len(events) != 0 && events[0] == EVENT_FAILURE {
+			state.Alerted(metadata.EndTime)
+		}
+		return strings.Join(events, ",")
+	}
+	results := []string{
+		run(true, 0),
+		run(false, time.Hour),
+		run(false, 2*time.Hour),
+		run(false, 3*time.Hour),
+		run(false, 4*time.Hour),
+		run(false, 30*time.Hour),
+		run(false, 31*time.Hour),
+		run(true, 32*time.Hour),
+		run(false, 33*time.Hour),
+	}
+	expected := "success|failure|||failure|failure||success,recovery|failure"
+	if strings.Join(results, "|") != expected {
+		t.Fatal("bad events:", results)
+	}
+	if state.Failures != 1 || !state.FirstFailure.Equal(now.Add(33*time.Hour)) {
+		t.Fatal("bad state:", state)
+	}
+}
+
+func TestNotifyState_NotAlerted(t *testing.T) {
+	state := &NotifyState{}
+	for i := 0; i < 3; i++ {
+		events := state.RunFinished(&JobMetadata{}, &JobConfig{})
+		if len(events) != 1 || events[0] != EVENT_FAILURE {
+			t.Fatal("failure must be alerted until alert is sent:", events)
+		}
+	}
+}
+
+func TestNotifyStateStore(t *testing.T) {
+	dir, cleanup := metadataStoreTestDir(t)
+	defer cleanup()
+	store := &NotifyStateStore{Dir: dir}
+	key := NotifyStateKey("db/main", "root@db1")
+	err := store.Update(key, func(state *NotifyState) {
+		state.Failures = 2
+	})
+	if err != nil {
+		t.Fatal("cannot update:", err)
+	}
+	store.Update(key, func(state *NotifyState) {
+		state.Failures++
+	})
+	state, err := (&NotifyStateStore{Dir: dir}).Get(key)
+	if err != nil || state.Failures != 3 || state.Key != "db/main@root@db1" {
+		t.Fatal("bad state:", state, err)
+	}
+	states, err := store.List()
+	if err != nil || len(states) != 1 || states[key].Failures != 3 {
+		t.Fatal("bad states:", states, err)
+	}
+	state, err = store.Get("missing")
+	if err != nil || state.Failures != 0 {
+		t.Fatal("bad missing state:", state, err)
+	}
+}
@@ -0,0 +1,317 @@
+package bakapy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Webhook stand-in collecting received notifications
+func notifyTestServer(t *testing.T) (*httptest.Server, chan Notification) {
+	received := make(chan Notification, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "secret" {
+			http.Error(w, "bad token", http.StatusForbidden)
+			return
+		}
+		n := Notification{}
+		if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+			t.Fatal("bad payload:", err)
+		}
+		received <- n
+	}))
+	return server, received
+}
+
+// SMTP stand-in serving one session, sends received commands
+// and mail data when session ends
+func smtpTestServer(t *testing.T, extensions ...string) (SMTPConfig, chan []string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("cannot listen:", err)
+	}
+	received := make(chan []string, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		session := []string{}
+		defer func() { received <- session }()
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 localhost ready")
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			session = append(session, line)
+			switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+			case "EHLO":
+				for _, ext := range extensions {
+					text.PrintfLine("250-%s", ext)
+				}
+				text.PrintfLine("250 localhost")
+			case "AUTH":
+				text.PrintfLine("235 authenticated")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, err := text.ReadDotLines()
+				if err != nil {
+					return
+				}
+				session = append(session, data...)
+				text.PrintfLine("250 queued")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				return
+			default:
+				text.PrintfLine("250 ok")
+			}
+		}
+	}()
+	addr := listener.Addr().(*net.TCPAddr)
+	return SMTPConfig{Host: "127.0.0.1", Port: addr.Port}, received
+}
+
+func TestSMTPNotifier(t *testing.T) {
+	cfg, received := smtpTestServer(t, "AUTH PLAIN")
+	cfg.From = "bakapy@example.com"
+	cfg.To = []string{"admins@example.com"}
+	cfg.Username = "bakapy"
+	cfg.Password = "secret"
+	notifier := &SMTPNotifier{Config: cfg}
+	n := NewJobNotification(EVENT_FAILURE, &JobMetadata{JobName: "db", Host: "db1", Message: "exit 1", Output: []byte("dumping")})
+	n.MailTo = []string{"dba@example.com", "ops@example.com"}
+	if err := notifier.Notify(n); err != nil {
+		t.Fatal("cannot notify:", err)
+	}
+	session := strings.Join(<-received, "\n")
+	for _, expected := range []string{
+		"AUTH PLAIN AGJha2FweQBzZWNyZXQ=",
+		"MAIL FROM:<bakapy@example.com>",
+		"RCPT TO:<dba@example.com>\nRCPT TO:<ops@example.com>\nDATA",
+		"To: dba@example.com, ops@example.com",
+		"Subject: [bakapy] job db failed",
+		"dumping",
+	} {
+		if !strings.Contains(session, expected) {
+			t.Fatal("no", expected, "in session:", session)
+		}
+	}
+}
+
+func TestSMTPNotifier_Template(t *testing.T) {
+	dir, cleanup := metadataStoreTestDir(t)
+	defer cleanup()
+	ioutil.WriteFile(path.Join(dir, "stale.tmpl"), []byte("To: {{.To}}\n\n{{.JobName}} at {{.Host}} {{.Event}}\n"), 0644)
+	cfg, received := smtpTestServer(t)
+	cfg.To = []string{"admins@example.com"}
+	cfg.Templates = map[string]string{EVENT_STALE: "stale.tmpl"}
+	if err := cfg.Sanitize(dir, ""); err != nil {
+		t.Fatal("cannot sanitize:", err)
+	}
+	notifier := &SMTPNotifier{Config: cfg}
+	if err := notifier.Notify(NewStaleNotification(StaleJob{JobName: "db", Host: "db1"})); err != nil {
+		t.Fatal("cannot notify:", err)
+	}
+	session := strings.Join(<-received, "\n")
+	if !strings.Contains(session, "To: admins@example.com\n\ndb at db1 stale") {
+		t.Fatal("template not used:", session)
+	}
+
+	cfg.Templates = map[string]string{"boom": "stale.tmpl"}
+	if err := cfg.Sanitize(dir, ""); err == nil || err.Error() != "smtp: unknown template event 'boom'" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestSMTPNotifier_StartTLSUnsupported(t *testing.T) {
+	cfg, received := smtpTestServer(t)
+	cfg.StartTLS = true
+	err := (&SMTPNotifier{Config: cfg}).Notify(NewStaleNotification(StaleJob{JobName: "db"}))
+	expected := fmt.Sprintf("smtp server 127.0.0.1:%d does not support STARTTLS", cfg.Port)
+	if err == nil || err.Error() != expected {
+		t.Fatal("bad error:", err)
+	}
+	if session := <-received; len(session) != 1 {
+		t.Fatal("mail sent without STARTTLS:", session)
+	}
+}
+
+func TestWebhookNotifier(t *testing.T) {
+	server, received := notifyTestServer(t)
+	defer server.Close()
+	notifier := &WebhookNotifier{URL: SecretString(server.URL), Headers: map[string]SecretString{"X-Token": "secret"}, Timeout: time.Second}
+	metadata := &JobMetadata{TaskId: "one", JobName: "db", Host: "db1", Message: "exit 1", Output: []byte("secret output")}
+	if err := notifier.Notify(NewJobNotification(EVENT_FAILURE, metadata)); err != nil {
+		t.Fatal("cannot notify:", err)
+	}
+	n := <-received
+	if n.Event != EVENT_FAILURE || n.JobName != "db" || n.Host != "db1" || n.Message != "exit 1" {
+		t.Fatal("bad notification:", n)
+	}
+	if n.Metadata == nil || n.Metadata.TaskId != "one" || n.Metadata.Output != nil || n.Output != nil {
+		t.Fatal("bad metadata summary:", n.Metadata)
+	}
+
+	notifier.Headers = nil
+	err := notifier.Notify(NewJobNotification(EVENT_FAILURE, metadata))
+	if err == nil || err.Error() != "webhook returned 403 Forbidden: bad token" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestCommandNotifier(t *testing.T) {
+	dir, cleanup := metadataStoreTestDir(t)
+	defer cleanup()
+	out := path.Join(dir, "out")
+	notifier := &CommandNotifier{
+		Command: "/bin/sh",
+		Args:    []string{"-c", `echo "$BAKAPY_EVENT $BAKAPY_JOB" > ` + out + `; cat >> ` + out},
+		Timeout: time.Second,
+	}
+	if err := notifier.Notify(NewStaleNotification(StaleJob{JobName: "web", MaxStaleness: time.Hour})); err != nil {
+		t.Fatal("cannot notify:", err)
+	}
+	raw, _ := ioutil.ReadFile(out)
+	lines := strings.SplitN(string(raw), "\n", 2)
+	if lines[0] != "stale web" || !strings.Contains(lines[1], `"Event":"stale"`) {
+		t.Fatal("bad command input:", string(raw))
+	}
+
+	notifier.Args = []string{"-c", "echo broken; exit 3"}
+	err := notifier.Notify(NewStaleNotification(StaleJob{JobName: "web"}))
+	if err == nil || err.Error() != "command /bin/sh failed: exit status 3: broken" {
+		t.Fatal("bad error:", err)
+	}
+	notifier.Args = []string{"-c", "sleep 10"}
+	notifier.Timeout = 100 * time.Millisecond
+	err = notifier.Notify(NewStaleNotification(StaleJob{JobName: "web"}))
+	if err == nil || !strings.Contains(err.Error(), "timed out") {
+		t.Fatal("bad timeout error:", err)
+	}
+}
+
+func TestNotificationRouter_Route(t *testing.T) {
+	cfg := NewConfig()
+	router := NewNotificationRouter(cfg)
+	if r := router.Route(nil, EVENT_FAILURE); len(r) != 1 || r[0] != NOTIFIER_SMTP {
+		t.Fatal("failures must be mailed by default:", r)
+	}
+	if r := router.Route(nil, EVENT_RECOVERY); len(r) != 1 || r[0] != NOTIFIER_SMTP {
+		t.Fatal("recovery must be mailed by default:", r)
+	}
+	if r := router.Route(nil, EVENT_SUCCESS); len(r) != 0 {
+		t.Fatal("success must not be routed by default:", r)
+	}
+
+	cfg.Notifiers = []NotifierConfig{{Name: "chat", Type: NOTIFIER_WEBHOOK}, {Name: "mail", Type: NOTIFIER_SMTP}}
+	cfg.Notify = NotifyRoutes{EVENT_FAILURE: {"mail"}, EVENT_RECOVERY: {"chat"}}
+	router = NewNotificationRouter(cfg)
+	jobConfig := &JobConfig{Notify: NotifyRoutes{EVENT_FAILURE: {"chat"}, EVENT_STALE: {}}}
+	if r := router.Route(jobConfig, EVENT_FAILURE); len(r) != 1 || r[0] != "chat" {
+		t.Fatal("job route must override main config:", r)
+	}
+	if r := router.Route(jobConfig, EVENT_RECOVERY); len(r) != 1 || r[0] != "chat" {
+		t.Fatal("main config route must be used for events not routed by job:", r)
+	}
+	if r := router.Route(jobConfig, EVENT_STALE); len(r) != 0 {
+		t.Fatal("empty job route must disable event:", r)
+	}
+}
+
+func TestRunJob_RecoveryNotification(t *testing.T) {
+	server, received := notifyTestServer(t)
+	defer server.Close()
+	gConfig := NewConfig()
+	gConfig.Listen = "1.1.1.1:1234"
+	gConfig.MetadataDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(gConfig.MetadataDir)
+	defer os.RemoveAll(gConfig.MetadataDir + "_artifacts")
+	defer os.RemoveAll(gConfig.MetadataDir + "_notify")
+	gConfig.CommandDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(gConfig.CommandDir)
+	os.Create(path.Join(gConfig.CommandDir, "job.cmd"))
+	gConfig.Notifiers = []NotifierConfig{{Name: "hook", Type: NOTIFIER_WEBHOOK, URL: SecretString(server.URL), Headers: map[string]SecretString{"X-Token": "secret"}}}
+	gConfig.Notify = NotifyRoutes{EVENT_FAILURE: {"hook"}, EVENT_RECOVERY: {"hook"}}
+	storage := NewStorage(gConfig)
+
+	RunJob("job", &JobConfig{Command: "job.cmd", executor: &TestOkExecutor{}}, gConfig, storage)
+	RunJob("job", &JobConfig{Command: "job.cmd", executor: &TestFailExecutor{}}, gConfig, storage)
+	RunJob("job", &JobConfig{Command: "job.cmd", executor: &TestFailExecutor{}}, gConfig, storage)
+	// state is kept by storage, not by router or job config
+	storage = NewStorage(gConfig)
+	RunJob("job", &JobConfig{Command: "job.cmd", executor: &TestFailExecutor{}, RealertFailures: 2}, gConfig, storage)
+	RunJob("job", &JobConfig{Command: "job.cmd", executor: &TestOkExecutor{}}, gConfig, storage)
+	RunJob("job", &JobConfig{Command: "job.cmd", executor: &TestOkExecutor{}}, gConfig, storage)
+	events := []string{}
+	for len(received) != 0 {
+		n := <-received
+		events = append(events, fmt.Sprintf("%s:%d", n.Event, n.Failures))
+	}
+	if strings.Join(events, " ") != "failure:1 failure:3 recovery:0" {
+		t.Fatal("bad events:", events)
+	}
+}
+
+func TestRunJob_DefaultRoutesRecovery(t *testing.T) {
+	server, received := notifyTestServer(t)
+	defer server.Close()
+	gConfig := NewConfig()
+	gConfig.Listen = "1.1.1.1:1234"
+	gConfig.MetadataDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(gConfig.MetadataDir)
+	defer os.RemoveAll(gConfig.MetadataDir + "_artifacts")
+	defer os.RemoveAll(gConfig.MetadataDir + "_notify")
+	gConfig.CommandDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(gConfig.CommandDir)
+	os.Create(path.Join(gConfig.CommandDir, "job.cmd"))
+	// no notify routes configured
+	gConfig.Notifiers = []NotifierConfig{{Name: "hook", Type: NOTIFIER_WEBHOOK, URL: SecretString(server.URL), Headers: map[string]SecretString{"X-Token": "secret"}}}
+	storage := NewStorage(gConfig)
+
+	RunJob("job", &JobConfig{Command: "job.cmd", executor: &TestFailExecutor{}}, gConfig, storage)
+	RunJob("job", &JobConfig{Command: "job.cmd", executor: &TestFailExecutor{}}, gConfig, storage)
+	RunJob("job", &JobConfig{Command: "job.cmd", executor: &TestOkExecutor{}}, gConfig, storage)
+	events := []string{}
+	for len(received) != 0 {
+		n := <-received
+		events = append(events, n.Event)
+	}
+	if strings.Join(events, " ") != "failure recovery" {
+		t.Fatal("bad events:", events)
+	}
+}
+
+func TestParseConfig_Notifiers(t *testing.T) {
+	cases := map[string]string{
+		"notifiers: [{name: a, type: sms}]":                         "notifier a: unknown type 'sms'",
+		"notifiers: [{name: a, type: webhook}]":                     "notifier a: webhook notifier requires url",
+		"notifiers: [{name: a, type: smtp}, {name: a, type: smtp}]": "duplicated notifier name a",
+		"notify: {failure: [chat]}":                                 "unknown notifier 'chat' for failure event",
+		"notify: {boom: [smtp]}":                                    "unknown notification event 'boom'",
+		"jobs: {wow: {notify: {stale: [chat]}}}":                    "job wow: unknown notifier 'chat' for stale event",
+	}
+	for content, expected := range cases {
+		cfg, _ := ioutil.TempFile("", "test_config")
+		cfg.Write([]byte(content))
+		cfg.Close()
+		_, err := ParseConfig(cfg.Name())
+		os.Remove(cfg.Name())
+		if err == nil || err.Error() != expected {
+			t.Fatal("bad error for", content, ":", err)
+		}
+	}
+}
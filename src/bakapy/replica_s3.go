@@ -0,0 +1,277 @@
+package bakapy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Files over part size are uploaded by multipart upload, single PUT
+// is limited to 5G. Part must be at least 5M, upload has at most
+// 10000 parts.
+const (
+	S3_DEFAULT_PART_SIZE = 64 * 1024 * 1024
+	S3_MIN_PART_SIZE     = 5 * 1024 * 1024
+	S3_MAX_PARTS         = 10000
+)
+
+// Replica in S3 compatible object store, objects are named
+// <prefix>data/<namespace>/<file> and <prefix>metadata/<task id>.
+// Path style urls are used, so endpoint may be any S3 compatible
+// service.
+type S3Replica struct {
+	Config     S3Config
+	Client     *http.Client
+	secretsDir string
+}
+
+func (s *S3Replica) fileKey(metadata *JobMetadata, fileMeta JobMetadataFile) string {
+	return s.Config.Prefix + path.Join("data", metadata.Namespace, replicaFileName(metadata, fileMeta))
+}
+
+func (s *S3Replica) metadataKey(metadata *JobMetadata) string {
+	return s.Config.Prefix + path.Join("metadata", string(metadata.TaskId))
+}
+
+func (s *S3Replica) Put(storage *Storage, metadata *JobMetadata) error {
+	for _, fileMeta := range metadata.Files {
+		content, size, err := storage.OpenFile(metadata, fileMeta)
+		if err != nil {
+			return errors.New(fmt.Sprintf("cannot open file %s: %s", fileMeta.Name, err))
+		}
+		if size > s.partSize(size) {
+			err = s.multipartUpload(s.fileKey(metadata, fileMeta), content, size)
+		} else {
+			err = s.request("PUT", s.fileKey(metadata, fileMeta), content, size)
+		}
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	raw, err := json.Marshal(replicaMetadata(metadata))
+	if err != nil {
+		return err
+	}
+	return s.request("PUT", s.metadataKey(metadata), bytes.NewReader(raw), int64(len(raw)))
+}
+
+func (s *S3Replica) Remove(metadata *JobMetadata) error {
+	for _, fileMeta := range metadata.Files {
+		if err := s.request("DELETE", s.fileKey(metadata, fileMeta), nil, 0); err != nil {
+			return err
+		}
+	}
+	return s.request("DELETE", s.metadataKey(metadata), nil, 0)
+}
+
+// Part size for file of given size
+func (s *S3Replica) partSize(size int64) int64 {
+	partSize := int64(s.Config.PartSize)
+	if partSize == 0 {
+		partSize = S3_DEFAULT_PART_SIZE
+	}
+	if minSize := (size + S3_MAX_PARTS - 1) / S3_MAX_PARTS; partSize < minSize {
+		partSize = minSize
+	}
+	return partSize
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// Upload content by parts. Upload is aborted on failure, so
+// uploaded parts do not take space.
+func (s *S3Replica) multipartUpload(key string, content io.Reader, size int64) error {
+	_, body, err := s.requestQuery("POST", key, url.Values{"uploads": {""}}, nil, 0)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadId string
+	}
+	if err := xml.Unmarshal(body, &initiated); err != nil || initiated.UploadId == "" {
+		return errors.New(fmt.Sprintf("s3 POST %s: bad initiate multipart upload response: %s", key, body))
+	}
+
+	err = s.uploadParts(key, initiated.UploadId, content, size)
+	if err != nil {
+		if _, _, abortErr := s.requestQuery("DELETE", key, url.Values{"uploadId": {initiated.UploadId}}, nil, 0); abortErr != nil {
+			return errors.New(err.Error() + ", abort failed: " + abortErr.Error())
+		}
+	}
+	return err
+}
+
+func (s *S3Replica) uploadParts(key, uploadId string, content io.Reader, size int64) error {
+	partSize := s.partSize(size)
+	parts := []s3CompletedPart{}
+	for offset := int64(0); offset < size; offset += partSize {
+		length := partSize
+		if size-offset < length {
+			length = size - offset
+		}
+		query := url.Values{
+			"partNumber": {strconv.Itoa(len(parts) + 1)},
+			"uploadId":   {uploadId},
+		}
+		header, _, err := s.requestQuery("PUT", key, query, io.LimitReader(content, length), length)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, s3CompletedPart{PartNumber: len(parts) + 1, ETag: header.Get("ETag")})
+	}
+
+	complete, err := xml.Marshal(struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	_, body, err := s.requestQuery("POST", key, url.Values{"uploadId": {uploadId}}, bytes.NewReader(complete), int64(len(complete)))
+	if err != nil {
+		return err
+	}
+	// complete request may fail after 200 OK sent
+	if bytes.Contains(body, []byte("<Error>")) {
+		return errors.New(fmt.Sprintf("s3 POST %s: complete multipart upload failed: %s", key, body))
+	}
+	return nil
+}
+
+func (s *S3Replica) request(method, key string, body io.Reader, size int64) error {
+	_, _, err := s.requestQuery(method, key, nil, body, size)
+	return err
+}
+
+// Send signed request, returns response headers and body
+func (s *S3Replica) requestQuery(method, key string, query url.Values, body io.Reader, size int64) (http.Header, []byte, error) {
+	accessKey, err := s.Config.AccessKey.Resolve(s.secretsDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	secretKey, err := s.Config.SecretKey.Resolve(s.secretsDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	escapedPath := s3EscapePath("/" + s.Config.Bucket + "/" + key)
+	req, err := http.NewRequest(method, strings.TrimRight(s.Config.Endpoint, "/")+escapedPath, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.URL.RawQuery = query.Encode()
+	if body != nil && size > 0 {
+		req.Body = ioutil.NopCloser(body)
+		req.ContentLength = size
+	}
+	signS3Request(req, accessKey, secretKey, s.Config.Region, time.Now())
+
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, nil, errors.New(fmt.Sprintf("s3 %s %s: %s: %s", method, key, resp.Status, message))
+	}
+	respBody, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1024*1024))
+	if err != nil {
+		return nil, nil, err
+	}
+	return resp.Header, respBody, nil
+}
+
+// Escape path as required by AWS signature version 4
+func s3EscapePath(p string) string {
+	escaped := new(bytes.Buffer)
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || strings.IndexByte("-_.~/", c) != -1 {
+			escaped.WriteByte(c)
+		} else {
+			fmt.Fprintf(escaped, "%%%02X", c)
+		}
+	}
+	return escaped.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Sign request with AWS signature version 4. All request headers are
+// signed, payload is not signed unless x-amz-content-sha256 is set.
+func signS3Request(req *http.Request, accessKey, secretKey, region string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("x-amz-date", amzDate)
+	if req.Header.Get("x-amz-content-sha256") == "" {
+		req.Header.Set("x-amz-content-sha256", "UNSIGNED-PAYLOAD")
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := []string{}
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	canonicalHeaders := ""
+	for _, name := range names {
+		canonicalHeaders += name + ":" + headers[name] + "\n"
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3EscapePath(req.URL.Path),
+		strings.Replace(req.URL.Query().Encode(), "+", "%20", -1),
+		canonicalHeaders,
+		signedHeaders,
+		req.Header.Get("x-amz-content-sha256"),
+	}, "\n")
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	scope := date + "/" + region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+secretKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		accessKey, scope, signedHeaders, signature))
+}
@@ -0,0 +1,199 @@
+package bakapy
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// Name of file in replica, gzipped files are copied as is
+func replicaFileName(metadata *JobMetadata, fileMeta JobMetadataFile) string {
+	if metadata.Gzip && fileMeta.Chunks == nil {
+		return fileMeta.Name + ".gz"
+	}
+	return fileMeta.Name
+}
+
+// Metadata saved to replicas without storage layout, dedup
+// files are assembled and saved as regular files.
+func replicaMetadata(metadata *JobMetadata) *JobMetadata {
+	replicated := *metadata
+	replicated.Files = make([]JobMetadataFile, len(metadata.Files))
+	for i, fileMeta := range metadata.Files {
+		fileMeta.Chunks = nil
+		replicated.Files[i] = fileMeta
+	}
+	return &replicated
+}
+
+// Replica in local directory or mount with the same layout as
+// storage: $path/data/<namespace>/<file> and $path/metadata/<task id>,
+// so it can be used as storage_dir and metadata_dir directly.
+type DirectoryReplica struct {
+	Path string
+}
+
+func (d *DirectoryReplica) metadataPath(metadata *JobMetadata) string {
+	return path.Join(d.Path, "metadata", string(metadata.TaskId))
+}
+
+func (d *DirectoryReplica) filePath(metadata *JobMetadata, fileMeta JobMetadataFile) string {
+	return path.Join(d.Path, "data", metadata.Namespace, replicaFileName(metadata, fileMeta))
+}
+
+func (d *DirectoryReplica) Put(storage *Storage, metadata *JobMetadata) error {
+	for _, fileMeta := range metadata.Files {
+		if err := d.copyFile(storage, metadata, fileMeta); err != nil {
+			return errors.New(fmt.Sprintf("cannot copy file %s: %s", fileMeta.Name, err))
+		}
+	}
+	return replicaMetadata(metadata).Save(d.metadataPath(metadata))
+}
+
+func (d *DirectoryReplica) copyFile(storage *Storage, metadata *JobMetadata, fileMeta JobMetadataFile) error {
+	content, size, err := storage.OpenFile(metadata, fileMeta)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+
+	dst := d.filePath(metadata, fileMeta)
+	if err := os.MkdirAll(path.Dir(dst), 0750); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(dst), ".tmp-")
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(tmp, content)
+	if err == nil && written != size {
+		err = errors.New(fmt.Sprintf("size mismatch, %d of %d bytes copied", written, size))
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), dst)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+func (d *DirectoryReplica) Remove(metadata *JobMetadata) error {
+	for _, fileMeta := range metadata.Files {
+		err := os.Remove(d.filePath(metadata, fileMeta))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	err := os.Remove(d.metadataPath(metadata))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Request sent to other bakapy storage as content of
+// STORAGE_REPLICA_MAGIC file: JSON line, then files as
+// stream transport frames for put command.
+type replicaRequest struct {
+	Key      string
+	Command  string
+	Metadata JobMetadata
+}
+
+const (
+	replicaCommandPut    = "put"
+	replicaCommandRemove = "remove"
+)
+
+// Replica on other bakapy instance with replica_key configured.
+// Storage replies with "OK" or "ERROR <message>" line after
+// request processed.
+type BakapyReplica struct {
+	Addr       string
+	Key        SecretString
+	secretsDir string
+}
+
+func (b *BakapyReplica) Put(storage *Storage, metadata *JobMetadata) error {
+	return b.send(metadata, replicaCommandPut, func(w io.Writer) error {
+		for _, fileMeta := range metadata.Files {
+			content, size, err := storage.OpenFile(metadata, fileMeta)
+			if err != nil {
+				return err
+			}
+			written, err := writeStreamFile(w, replicaFileName(metadata, fileMeta), content)
+			content.Close()
+			if err == nil && written != size {
+				err = errors.New(fmt.Sprintf("size mismatch, %d of %d bytes sent", written, size))
+			}
+			if err != nil {
+				return errors.New(fmt.Sprintf("cannot send file %s: %s", fileMeta.Name, err))
+			}
+		}
+		return nil
+	})
+}
+
+func (b *BakapyReplica) Remove(metadata *JobMetadata) error {
+	return b.send(metadata, replicaCommandRemove, func(w io.Writer) error { return nil })
+}
+
+func (b *BakapyReplica) send(metadata *JobMetadata, command string, writeBody func(io.Writer) error) error {
+	if len(metadata.TaskId) != STORAGE_TASK_ID_LEN {
+		return errors.New("bad task id '" + string(metadata.TaskId) + "'")
+	}
+	key, err := b.Key.Resolve(b.secretsDir)
+	if err != nil {
+		return err
+	}
+	request, err := json.Marshal(replicaRequest{Key: key, Command: command, Metadata: *metadata})
+	if err != nil {
+		return err
+	}
+
+	conn, err := net.DialTimeout("tcp", b.Addr, STORAGE_AUTH_TIMEOUT*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	w := bufio.NewWriter(conn)
+	fmt.Fprintf(w, "%s%0*d%s", metadata.TaskId, STORAGE_FILENAME_LEN_LEN, len(STORAGE_REPLICA_MAGIC), STORAGE_REPLICA_MAGIC)
+	w.Write(request)
+	w.WriteString("\n")
+	if err := writeBody(w); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	// end of content for storage
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		if err := tcpConn.CloseWrite(); err != nil {
+			return err
+		}
+	}
+
+	conn.SetReadDeadline(time.Now().Add(STORAGE_REPLICA_REPLY_TIMEOUT))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return errors.New("no reply from replica storage: " + err.Error())
+	}
+	reply = strings.TrimSpace(reply)
+	if reply != "OK" {
+		return errors.New("replica storage error: " + strings.TrimPrefix(reply, "ERROR "))
+	}
+	return nil
+}
@@ -0,0 +1,423 @@
+package bakapy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replica target types
+const (
+	REPLICA_TYPE_DIRECTORY = "directory"
+	REPLICA_TYPE_BAKAPY    = "bakapy"
+	REPLICA_TYPE_S3        = "s3"
+)
+
+// Replica states
+const (
+	REPLICA_PENDING  = "pending"
+	REPLICA_DONE     = "done"
+	REPLICA_FAILED   = "failed"
+	REPLICA_REMOVING = "removing"
+)
+
+type S3Config struct {
+	Endpoint  string
+	Region    string
+	Bucket    string
+	Prefix    string
+	AccessKey SecretString `yaml:"access_key"`
+	SecretKey SecretString `yaml:"secret_key"`
+	// Files larger than this are uploaded by parts
+	PartSize ByteSize `yaml:"part_size"`
+}
+
+type ReplicaConfig struct {
+	Name string
+	Type string
+	// directory target
+	Path string
+	// bakapy target, storage address and its replica_key
+	Addr string
+	Key  SecretString
+	S3   S3Config `yaml:"s3"`
+	// Attempts before replica marked as failed
+	Retries       int
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+func (r *ReplicaConfig) Sanitize() error {
+	if r.Name == "" {
+		return errors.New("replica name required")
+	}
+	switch r.Type {
+	case REPLICA_TYPE_DIRECTORY:
+		if r.Path == "" {
+			return errors.New("replica " + r.Name + ": directory replica requires path")
+		}
+	case REPLICA_TYPE_BAKAPY:
+		if r.Addr == "" || r.Key == "" {
+			return errors.New("replica " + r.Name + ": bakapy replica requires addr and key")
+		}
+	case REPLICA_TYPE_S3:
+		if r.S3.Endpoint == "" || r.S3.Bucket == "" || r.S3.AccessKey == "" || r.S3.SecretKey == "" {
+			return errors.New("replica " + r.Name + ": s3 replica requires endpoint, bucket, access_key and secret_key")
+		}
+		if r.S3.Region == "" {
+			r.S3.Region = "us-east-1"
+		}
+		if r.S3.PartSize != 0 && r.S3.PartSize < S3_MIN_PART_SIZE {
+			return errors.New(fmt.Sprintf("replica %s: s3 part_size must be at least %d", r.Name, S3_MIN_PART_SIZE))
+		}
+	default:
+		return errors.New("replica " + r.Name + ": unknown type '" + r.Type + "'")
+	}
+	if r.Retries < 0 {
+		return errors.New(fmt.Sprintf("replica %s: retries must not be negative, got %d", r.Name, r.Retries))
+	}
+	if r.Retries == 0 {
+		r.Retries = REPLICATION_DEFAULT_RETRIES
+	}
+	if r.RetryInterval == 0 {
+		r.RetryInterval = REPLICATION_DEFAULT_RETRY_INTERVAL
+	}
+	return nil
+}
+
+// Secondary storage receiving copies of successful backups
+type ReplicaTarget interface {
+	Put(storage *Storage, metadata *JobMetadata) error
+	Remove(metadata *JobMetadata) error
+}
+
+func NewReplicaTarget(cfg ReplicaConfig, secretsDir string) ReplicaTarget {
+	switch cfg.Type {
+	case REPLICA_TYPE_BAKAPY:
+		return &BakapyReplica{Addr: cfg.Addr, Key: cfg.Key, secretsDir: secretsDir}
+	case REPLICA_TYPE_S3:
+		return &S3Replica{Config: cfg.S3, secretsDir: secretsDir}
+	default:
+		return &DirectoryReplica{Path: cfg.Path}
+	}
+}
+
+type ReplicaStatus struct {
+	State     string
+	Attempts  int
+	LastError string
+	UpdatedAt time.Time
+	NextTry   time.Time
+}
+
+// Replication state of one task, saved as $replication_dir/<task id>
+type ReplicationState struct {
+	TaskId  TaskId
+	Targets map[string]*ReplicaStatus
+	// Copy of removed task metadata, needed to remove replicas
+	Metadata *JobMetadata `json:",omitempty"`
+}
+
+// Copies successful backups to replica targets in background.
+// State is kept on disk, so tasks queued by bakapy-run-job are
+// replicated by scheduler and retries survive restarts.
+type Replicator struct {
+	StateDir string
+	storage  *Storage
+	configs  []ReplicaConfig
+	targets  map[string]ReplicaTarget
+	mu       sync.Mutex
+	wakeup   chan bool
+	logger   *logging.Logger
+}
+
+func NewReplicator(cfg *Config, storage *Storage) *Replicator {
+	stateDir := cfg.ReplicationDir
+	if stateDir == "" {
+		stateDir = cfg.MetadataDir + "_replication"
+	}
+	r := &Replicator{
+		StateDir: stateDir,
+		storage:  storage,
+		configs:  cfg.Replicas,
+		targets:  map[string]ReplicaTarget{},
+		wakeup:   make(chan bool, 1),
+		logger:   logging.MustGetLogger("bakapy.replication"),
+	}
+	for _, replica := range cfg.Replicas {
+		r.targets[replica.Name] = NewReplicaTarget(replica, cfg.SecretsDir)
+	}
+	return r
+}
+
+func (r *Replicator) statePath(taskId TaskId) string {
+	return path.Join(r.StateDir, string(taskId))
+}
+
+func (r *Replicator) loadState(taskId TaskId) (*ReplicationState, error) {
+	raw, err := ioutil.ReadFile(r.statePath(taskId))
+	if err != nil {
+		return nil, err
+	}
+	state := &ReplicationState{}
+	if err := json.Unmarshal(raw, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+func (r *Replicator) saveState(state *ReplicationState) error {
+	if len(state.Targets) == 0 {
+		err := os.Remove(r.statePath(state.TaskId))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if err := os.MkdirAll(r.StateDir, 0750); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := r.statePath(state.TaskId) + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, raw, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, r.statePath(state.TaskId))
+}
+
+func (r *Replicator) notify() {
+	select {
+	case r.wakeup <- true:
+	default:
+	}
+}
+
+// Queue task for copying to all targets
+func (r *Replicator) Enqueue(taskId TaskId) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := &ReplicationState{TaskId: taskId, Targets: map[string]*ReplicaStatus{}}
+	for _, replica := range r.configs {
+		state.Targets[replica.Name] = &ReplicaStatus{State: REPLICA_PENDING, UpdatedAt: time.Now()}
+	}
+	if err := r.saveState(state); err != nil {
+		return err
+	}
+	r.notify()
+	return nil
+}
+
+// Queue removal of task from all targets. Must be called before
+// task metadata removed from storage.
+func (r *Replicator) Remove(metadata JobMetadata) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state, err := r.loadState(metadata.TaskId)
+	if os.IsNotExist(err) {
+		// replicated before state tracking or by another instance
+		state, err = &ReplicationState{TaskId: metadata.TaskId}, nil
+	}
+	if err != nil {
+		return err
+	}
+	state.Targets = map[string]*ReplicaStatus{}
+	for _, replica := range r.configs {
+		state.Targets[replica.Name] = &ReplicaStatus{State: REPLICA_REMOVING, UpdatedAt: time.Now()}
+	}
+	state.Metadata = &metadata
+	if err := r.saveState(state); err != nil {
+		return err
+	}
+	r.notify()
+	return nil
+}
+
+// Replication status per target name, empty if task is fully
+// replicated and status was not tracked.
+func (r *Replicator) Status(taskId TaskId) (map[string]ReplicaStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	status := map[string]ReplicaStatus{}
+	state, err := r.loadState(taskId)
+	if os.IsNotExist(err) {
+		return status, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for name, targetStatus := range state.Targets {
+		status[name] = *targetStatus
+	}
+	return status, nil
+}
+
+func (r *Replicator) taskIds() ([]TaskId, error) {
+	entries, err := ioutil.ReadDir(r.StateDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	taskIds := []TaskId{}
+	for _, entry := range entries {
+		if entry.IsDir() || strings.HasSuffix(entry.Name(), ".tmp") {
+			continue
+		}
+		taskIds = append(taskIds, TaskId(entry.Name()))
+	}
+	return taskIds, nil
+}
+
+type replicaWork struct {
+	taskId   TaskId
+	target   string
+	state    string
+	metadata *JobMetadata
+}
+
+// Collect targets ready for next attempt
+func (r *Replicator) dueWork(now time.Time) ([]replicaWork, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	taskIds, err := r.taskIds()
+	if err != nil {
+		return nil, err
+	}
+	work := []replicaWork{}
+	for _, taskId := range taskIds {
+		state, err := r.loadState(taskId)
+		if err != nil {
+			r.logger.Warning("cannot load replication state of task %s: %s", taskId, err)
+			continue
+		}
+		names := []string{}
+		for name := range state.Targets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			status := state.Targets[name]
+			if status.State != REPLICA_PENDING && status.State != REPLICA_REMOVING {
+				continue
+			}
+			if status.NextTry.After(now) {
+				continue
+			}
+			work = append(work, replicaWork{taskId, name, status.State, state.Metadata})
+		}
+	}
+	return work, nil
+}
+
+// Save attempt result if target state was not changed meanwhile
+func (r *Replicator) finish(w replicaWork, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state, loadErr := r.loadState(w.taskId)
+	if loadErr != nil {
+		return
+	}
+	status, exist := state.Targets[w.target]
+	if !exist || status.State != w.state {
+		return
+	}
+	retries, retryInterval := REPLICATION_DEFAULT_RETRIES, REPLICATION_DEFAULT_RETRY_INTERVAL
+	for _, replica := range r.configs {
+		if replica.Name == w.target {
+			retries, retryInterval = replica.Retries, replica.RetryInterval
+		}
+	}
+
+	now := time.Now()
+	status.UpdatedAt = now
+	if err == nil {
+		if w.state == REPLICA_REMOVING {
+			delete(state.Targets, w.target)
+		} else {
+			status.State = REPLICA_DONE
+			status.Attempts++
+			status.LastError = ""
+		}
+	} else {
+		status.Attempts++
+		status.LastError = err.Error()
+		status.NextTry = now.Add(retryInterval * time.Duration(status.Attempts))
+		if status.Attempts >= retries {
+			r.logger.Critical("replication of task %s to %s failed after %d attempts: %s",
+				w.taskId, w.target, status.Attempts, err)
+			if w.state == REPLICA_REMOVING {
+				delete(state.Targets, w.target)
+			} else {
+				status.State = REPLICA_FAILED
+			}
+		}
+	}
+	if saveErr := r.saveState(state); saveErr != nil {
+		r.logger.Warning("cannot save replication state of task %s: %s", w.taskId, saveErr)
+	}
+}
+
+func (r *Replicator) process(w replicaWork) error {
+	target, exist := r.targets[w.target]
+	if !exist {
+		return errors.New("replica " + w.target + " not configured")
+	}
+	if w.state == REPLICA_REMOVING {
+		if w.metadata == nil {
+			return errors.New("no metadata to remove replica")
+		}
+		r.logger.Info("removing task %s from replica %s", w.taskId, w.target)
+		return target.Remove(w.metadata)
+	}
+	metadata, err := r.storage.Metadata.Get(w.taskId)
+	if err != nil {
+		return errors.New("cannot load metadata: " + err.Error())
+	}
+	// replicas get self-contained metadata
+	if err := r.storage.Artifacts.Inline(metadata); err != nil {
+		return err
+	}
+	r.logger.Info("replicating task %s to %s", w.taskId, w.target)
+	return target.Put(r.storage, metadata)
+}
+
+// Run all attempts due now
+func (r *Replicator) ProcessOnce() error {
+	work, err := r.dueWork(time.Now())
+	if err != nil {
+		return err
+	}
+	for _, w := range work {
+		err := r.process(w)
+		if err != nil {
+			r.logger.Warning("replication of task %s to %s failed: %s", w.taskId, w.target, err)
+		} else {
+			r.logger.Info("task %s %s replica %s done", w.taskId, w.state, w.target)
+		}
+		r.finish(w, err)
+	}
+	return nil
+}
+
+func (r *Replicator) Run() {
+	for {
+		if err := r.ProcessOnce(); err != nil {
+			r.logger.Warning("replication failed: %s", err)
+		}
+		select {
+		case <-r.wakeup:
+		case <-time.After(REPLICATION_CHECK_INTERVAL):
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package bakapy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Report formats
+const (
+	REPORT_FORMAT_TEXT = "text"
+	REPORT_FORMAT_HTML = "html"
+)
+
+type ReportConfig struct {
+	Name  string
+	RunAt RunAtSpec `yaml:"run_at"`
+	// Runs started this long before report are summarized
+	Period time.Duration
+	Format string
+	// Jobs included, all configured jobs if empty
+	Jobs []string
+	// Notifiers, ones routed for report event if empty
+	Notifiers []string
+	// Mail recipients, overrides smtp to
+	NotifyTo []string `yaml:"notify_to"`
+}
+
+func (r *ReportConfig) Sanitize() error {
+	if r.Name == "" {
+		return errors.New("report name required")
+	}
+	if r.RunAt == (RunAtSpec{}) {
+		return errors.New("report " + r.Name + ": run_at required")
+	}
+	if r.Period == 0 {
+		r.Period = REPORT_DEFAULT_PERIOD
+	}
+	switch r.Format {
+	case "":
+		r.Format = REPORT_FORMAT_TEXT
+	case REPORT_FORMAT_TEXT, REPORT_FORMAT_HTML:
+	default:
+		return errors.New("report " + r.Name + ": unknown format '" + r.Format + "'")
+	}
+	return nil
+}
+
+type ReportJob struct {
+	JobName   string
+	Runs      int
+	Successes int
+	Failures  int
+	// Bytes stored by runs of period
+	TotalSize int64
+	// Bytes of all stored runs, before dedup
+	StorageSize int64
+	// Newest successful run, zero if job never succeeded
+	LastSuccess       time.Time
+	LastSuccessTaskId TaskId `json:",omitempty"`
+	// Mean average speed of successful runs of period, bytes/sec
+	AvgSpeed int64
+}
+
+type Report struct {
+	Name        string
+	Since       time.Time
+	Until       time.Time
+	Jobs        []ReportJob
+	Runs        int
+	Failures    int
+	TotalSize   int64
+	StorageSize int64
+}
+
+// Summarize runs of jobs started in [since, until) from all
+// stored metadata. Jobs without runs are reported too.
+func BuildReport(name string, jobNames []string, metadatas []JobMetadata, since, until time.Time) *Report {
+	report := &Report{Name: name, Since: since, Until: until, Jobs: []ReportJob{}}
+	sorted := append([]string(nil), jobNames...)
+	sort.Strings(sorted)
+	index := map[string]int{}
+	for _, jobName := range sorted {
+		index[jobName] = len(report.Jobs)
+		report.Jobs = append(report.Jobs, ReportJob{JobName: jobName})
+	}
+
+	speeds := make([]int64, len(report.Jobs))
+	for i := range metadatas {
+		metadata := &metadatas[i]
+		idx, exist := index[metadata.JobName]
+		if !exist {
+			continue
+		}
+		job := &report.Jobs[idx]
+		job.StorageSize += metadata.TotalSize
+		if metadata.Success && metadata.StartTime.Before(until) && metadata.StartTime.After(job.LastSuccess) {
+			job.LastSuccess = metadata.StartTime
+			job.LastSuccessTaskId = metadata.TaskId
+		}
+		if metadata.StartTime.Before(since) || !metadata.StartTime.Before(until) {
+			continue
+		}
+		job.Runs++
+		job.TotalSize += metadata.TotalSize
+		if metadata.Success {
+			job.Successes++
+			speeds[idx] += metadata.AvgSpeed()
+		} else {
+			job.Failures++
+		}
+	}
+
+	for i := range report.Jobs {
+		job := &report.Jobs[i]
+		if job.Successes != 0 {
+			job.AvgSpeed = speeds[i] / int64(job.Successes)
+		}
+		report.Runs += job.Runs
+		report.Failures += job.Failures
+		report.TotalSize += job.TotalSize
+		report.StorageSize += job.StorageSize
+	}
+	return report
+}
+
+func (r *Report) Render(format string) (string, error) {
+	output := new(bytes.Buffer)
+	var err error
+	switch format {
+	case REPORT_FORMAT_HTML:
+		err = REPORT_TEMPLATE_HTML.Execute(output, r)
+	case REPORT_FORMAT_TEXT, "":
+		err = REPORT_TEMPLATE_TEXT.Execute(output, r)
+	default:
+		err = errors.New("unknown report format '" + format + "'")
+	}
+	if err != nil {
+		return "", err
+	}
+	return output.String(), nil
+}
+
+// Human readable size, "1.5 GiB"
+func formatByteSize(size int64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	value := float64(size)
+	unit := 0
+	for value >= 1024 && unit < len(units)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, units[unit])
+}
+
+func formatReportTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.Format("2006-01-02 15:04")
+}
+
+var reportTemplateFuncs = map[string]interface{}{
+	"size": formatByteSize,
+	"time": formatReportTime,
+}
+
+// Build report of period ending now
+func (stor *Storage) BuildReport(cfg *Config, reportConfig ReportConfig, now time.Time) (*Report, error) {
+	jobNames := reportConfig.Jobs
+	if len(jobNames) == 0 {
+		for jobName := range cfg.Jobs {
+			jobNames = append(jobNames, jobName)
+		}
+	}
+	metadatas, err := stor.Metadata.List(MetadataQuery{})
+	if err != nil {
+		return nil, err
+	}
+	return BuildReport(reportConfig.Name, jobNames, metadatas, now.Add(-reportConfig.Period), now), nil
+}
+
+// Build, render and send report to its notifiers
+func (stor *Storage) SendReport(cfg *Config, reportConfig ReportConfig, now time.Time) error {
+	report, err := stor.BuildReport(cfg, reportConfig, now)
+	if err != nil {
+		return err
+	}
+	body, err := report.Render(reportConfig.Format)
+	if err != nil {
+		return err
+	}
+	n := &Notification{
+		Event:   EVENT_REPORT,
+		Message: body,
+		Report:  report,
+		Format:  reportConfig.Format,
+		MailTo:  reportConfig.NotifyTo,
+	}
+	router := NewNotificationRouter(cfg)
+	names := reportConfig.Notifiers
+	if len(names) == 0 {
+		names = router.Route(nil, EVENT_REPORT)
+	}
+	return router.SendTo(names, n)
+}
@@ -0,0 +1,126 @@
+package bakapy
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func reportTestMetadatas(now time.Time) []JobMetadata {
+	run := func(taskId TaskId, job string, success bool, ago time.Duration, size int64) JobMetadata {
+		return JobMetadata{
+			TaskId:    taskId,
+			JobName:   job,
+			Success:   success,
+			TotalSize: size,
+			StartTime: now.Add(-ago),
+			EndTime:   now.Add(-ago + 10*time.Second),
+		}
+	}
+	return []JobMetadata{
+		run("old", "db", true, 48*time.Hour, 1000),
+		run("one", "db", true, 20*time.Hour, 2000),
+		run("two", "db", true, 10*time.Hour, 4000),
+		run("three", "db", false, 2*time.Hour, 0),
+		run("web", "web", false, 30*time.Hour, 0),
+		run("other", "other", true, time.Hour, 100),
+	}
+}
+
+func TestBuildReport(t *testing.T) {
+	now := time.Now()
+	report := BuildReport("daily", []string{"web", "db"}, reportTestMetadatas(now), now.Add(-24*time.Hour), now)
+	if len(report.Jobs) != 2 || report.Jobs[0].JobName != "db" || report.Jobs[1].JobName != "web" {
+		t.Fatal("bad jobs:", report.Jobs)
+	}
+	db := report.Jobs[0]
+	if db.Runs != 3 || db.Successes != 2 || db.Failures != 1 {
+		t.Fatal("bad db runs:", db)
+	}
+	if db.TotalSize != 6000 || db.StorageSize != 7000 {
+		t.Fatal("bad db sizes:", db)
+	}
+	if db.LastSuccessTaskId != "two" || db.AvgSpeed != 300 {
+		t.Fatal("bad db last success or speed:", db)
+	}
+	web := report.Jobs[1]
+	if web.Runs != 0 || !web.LastSuccess.IsZero() {
+		t.Fatal("bad web:", web)
+	}
+	if report.Runs != 3 || report.Failures != 1 || report.TotalSize != 6000 || report.StorageSize != 7000 {
+		t.Fatal("bad totals:", report)
+	}
+}
+
+func TestReport_Render(t *testing.T) {
+	now := time.Now()
+	report := BuildReport("daily", []string{"db", "web<script>"}, reportTestMetadatas(now), now.Add(-24*time.Hour), now)
+	text, err := report.Render(REPORT_FORMAT_TEXT)
+	if err != nil {
+		t.Fatal("cannot render text:", err)
+	}
+	for _, expected := range []string{"3 runs, 1 failed, 5.9 KiB stored", "runs:          3 (2 ok, 1 failed)", "last success:  never", "average speed: 300 B/s"} {
+		if !strings.Contains(text, expected) {
+			t.Fatal("no", expected, "in text report:", text)
+		}
+	}
+	html, err := report.Render(REPORT_FORMAT_HTML)
+	if err != nil {
+		t.Fatal("cannot render html:", err)
+	}
+	if !strings.Contains(html, "<td>db</td><td>3</td><td>2</td><td>1</td>") || !strings.Contains(html, "web&lt;script&gt;") {
+		t.Fatal("bad html report:", html)
+	}
+	if _, err := report.Render("pdf"); err == nil || err.Error() != "unknown report format 'pdf'" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestStorage_SendReport(t *testing.T) {
+	storage, cleanup := replicationStorage(t)
+	defer cleanup()
+	now := time.Now()
+	for _, metadata := range reportTestMetadatas(now) {
+		storage.Metadata.Save(&metadata)
+	}
+	server, received := notifyTestServer(t)
+	defer server.Close()
+	cfg := NewConfig()
+	cfg.Jobs["db"] = &JobConfig{}
+	cfg.Notifiers = []NotifierConfig{{Name: "chat", Type: NOTIFIER_WEBHOOK, URL: SecretString(server.URL), Headers: map[string]SecretString{"X-Token": "secret"}, Timeout: time.Second}}
+	reportConfig := ReportConfig{Name: "daily", Period: 24 * time.Hour, Format: REPORT_FORMAT_TEXT}
+	if err := storage.SendReport(cfg, reportConfig, now); err != nil {
+		t.Fatal("cannot send report:", err)
+	}
+	n := <-received
+	if n.Event != EVENT_REPORT || n.Report == nil || len(n.Report.Jobs) != 1 || n.Report.Jobs[0].Runs != 3 {
+		t.Fatal("bad report notification:", n)
+	}
+	if !strings.HasPrefix(n.Message, "Bakapy report daily") {
+		t.Fatal("bad rendered report:", n.Message)
+	}
+}
+
+func TestParseConfig_Reports(t *testing.T) {
+	cases := map[string]string{
+		"reports: [{run_at: {hour: 8}}]":                                         "report name required",
+		"reports: [{name: daily}]":                                               "report daily: run_at required",
+		"reports: [{name: daily, run_at: {hour: 8}, format: pdf}]":               "report daily: unknown format 'pdf'",
+		"reports: [{name: daily, run_at: {hour: 8}, notifiers: [chat]}]":         "report daily: unknown notifier 'chat'",
+		"reports: [{name: daily, run_at: {hour: 8}, jobs: [db]}]":                "report daily: unknown job 'db'",
+		"notify: {failure: [smtp]}\nreports: [{name: daily, run_at: {hour: 8}}]": "report daily: no notifiers and no report route",
+		"reports: [{name: a, run_at: {hour: 8}}, {name: a, run_at: {hour: 9}}]":  "duplicated report name a",
+	}
+	for content, expected := range cases {
+		cfg, _ := ioutil.TempFile("", "test_config")
+		cfg.Write([]byte(content))
+		cfg.Close()
+		_, err := ParseConfig(cfg.Name())
+		os.Remove(cfg.Name())
+		if err == nil || err.Error() != expected {
+			t.Fatal("bad error for", content, ":", err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package bakapy
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// GFS-style retention policy. Backup is kept if any of rules selects it.
+// Each keep_<period> rule keeps newest backup of last N periods
+// having backups.
+type RetentionConfig struct {
+	KeepLast    int `yaml:"keep_last"`
+	KeepDaily   int `yaml:"keep_daily"`
+	KeepWeekly  int `yaml:"keep_weekly"`
+	KeepMonthly int `yaml:"keep_monthly"`
+	KeepYearly  int `yaml:"keep_yearly"`
+	// Never keep less than min_keep successful backups
+	MinKeep int `yaml:"min_keep"`
+}
+
+func (r RetentionConfig) Enabled() bool {
+	return r != RetentionConfig{}
+}
+
+func (r RetentionConfig) Validate() error {
+	rules := map[string]int{
+		"keep_last":    r.KeepLast,
+		"keep_daily":   r.KeepDaily,
+		"keep_weekly":  r.KeepWeekly,
+		"keep_monthly": r.KeepMonthly,
+		"keep_yearly":  r.KeepYearly,
+		"min_keep":     r.MinKeep,
+	}
+	for name, value := range rules {
+		if value < 0 {
+			return errors.New(fmt.Sprintf("retention %s must not be negative, got %d", name, value))
+		}
+	}
+	return nil
+}
+
+type retentionRule struct {
+	count  int
+	bucket func(t time.Time) string
+}
+
+func (r RetentionConfig) rules() []retentionRule {
+	return []retentionRule{
+		{r.KeepDaily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{r.KeepWeekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-%02d", year, week)
+		}},
+		{r.KeepMonthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{r.KeepYearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+}
+
+// Returns indexes of metadatas kept by policy. Failed tasks are
+// never selected.
+func (r RetentionConfig) Select(metadatas []JobMetadata) map[int]bool {
+	successful := []int{}
+	for i, m := range metadatas {
+		if m.Success {
+			successful = append(successful, i)
+		}
+	}
+	// newest first
+	sort.SliceStable(successful, func(i, j int) bool {
+		return metadatas[successful[i]].StartTime.After(metadatas[successful[j]].StartTime)
+	})
+
+	keep := map[int]bool{}
+	for n, i := range successful {
+		if n < r.KeepLast || n < r.MinKeep {
+			keep[i] = true
+		}
+	}
+	for _, rule := range r.rules() {
+		lastBucket := ""
+		kept := 0
+		for _, i := range successful {
+			if kept >= rule.count {
+				break
+			}
+			bucket := rule.bucket(metadatas[i].StartTime)
+			if bucket == lastBucket {
+				continue
+			}
+			lastBucket = bucket
+			keep[i] = true
+			kept++
+		}
+	}
+	return keep
+}
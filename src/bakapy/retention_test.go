@@ -0,0 +1,175 @@
+package bakapy
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"testing"
+	"time"
+)
+
+// One successful run per day, newest is 2015-03-31
+func dailyRuns(days int) []JobMetadata {
+	last := time.Date(2015, 3, 31, 3, 0, 0, 0, time.UTC)
+	metas := []JobMetadata{}
+	for i := 0; i < days; i++ {
+		start := last.AddDate(0, 0, -i)
+		metas = append(metas, JobMetadata{
+			TaskId:    TaskId(start.Format("2006-01-02")),
+			Success:   true,
+			StartTime: start,
+		})
+	}
+	return metas
+}
+
+func keptIds(metas []JobMetadata, keep map[int]bool) []string {
+	ids := []string{}
+	for i := range keep {
+		ids = append(ids, string(metas[i].TaskId))
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func TestRetentionConfig_Select_KeepLast(t *testing.T) {
+	metas := dailyRuns(10)
+	ids := keptIds(metas, RetentionConfig{KeepLast: 3}.Select(metas))
+	if len(ids) != 3 || ids[0] != "2015-03-29" || ids[2] != "2015-03-31" {
+		t.Fatal("bad kept:", ids)
+	}
+}
+
+func TestRetentionConfig_Select_GFS(t *testing.T) {
+	metas := dailyRuns(400)
+	ids := keptIds(metas, RetentionConfig{KeepDaily: 7, KeepWeekly: 4, KeepMonthly: 3, KeepYearly: 2}.Select(metas))
+	// rules overlap: newest backup is daily, weekly, monthly and yearly one
+	expected := []string{
+		// yearly
+		"2014-12-31",
+		// monthly
+		"2015-01-31", "2015-02-28",
+		// weekly (sundays)
+		"2015-03-15", "2015-03-22",
+		// daily
+		"2015-03-25", "2015-03-26", "2015-03-27", "2015-03-28",
+		"2015-03-29", "2015-03-30", "2015-03-31",
+	}
+	if len(ids) != len(expected) {
+		t.Fatal("bad kept:", ids)
+	}
+	for i := range expected {
+		if ids[i] != expected[i] {
+			t.Fatal("bad kept:", ids)
+		}
+	}
+}
+
+func TestRetentionConfig_Select_SkipsFailed(t *testing.T) {
+	metas := dailyRuns(5)
+	metas[0].Success = false
+	ids := keptIds(metas, RetentionConfig{KeepLast: 1}.Select(metas))
+	if len(ids) != 1 || ids[0] != "2015-03-30" {
+		t.Fatal("bad kept:", ids)
+	}
+}
+
+func TestRetentionConfig_Select_MinKeep(t *testing.T) {
+	metas := dailyRuns(5)
+	ids := keptIds(metas, RetentionConfig{KeepMonthly: 1, MinKeep: 3}.Select(metas))
+	if len(ids) != 3 || ids[0] != "2015-03-29" {
+		t.Fatal("bad kept:", ids)
+	}
+}
+
+func TestRetentionConfig_Validate(t *testing.T) {
+	err := RetentionConfig{KeepDaily: -1}.Validate()
+	if err == nil || err.Error() != "retention keep_daily must not be negative, got -1" {
+		t.Fatal("bad error:", err)
+	}
+	jConfig := &JobConfig{MaxAge: time.Hour, Retention: RetentionConfig{KeepLast: 1}}
+	err = jConfig.Sanitize()
+	if err == nil || err.Error() != "both retention and max_age defined, use only one of them" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestStorage_CleanupExpired_Retention(t *testing.T) {
+	config := NewConfig()
+	config.MetadataDir, _ = ioutil.TempDir("", "")
+	config.StorageDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(config.MetadataDir)
+	defer os.RemoveAll(config.StorageDir)
+	storage := NewStorage(config)
+
+	for _, m := range dailyRuns(10) {
+		m.JobName = "job"
+		m.Config.Retention = RetentionConfig{KeepLast: 2}
+		m.Save(path.Join(config.MetadataDir, string(m.TaskId)))
+	}
+	if err := storage.CleanupExpired(); err != nil {
+		t.Fatal("error:", err)
+	}
+	files, _ := ioutil.ReadDir(config.MetadataDir)
+	if len(files) != 2 || files[0].Name() != "2015-03-30" || files[1].Name() != "2015-03-31" {
+		t.Fatal("bad metadata left:", files)
+	}
+}
+
+func TestStorage_PlanCleanup_RetentionPerHost(t *testing.T) {
+	config := NewConfig()
+	config.MetadataDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(config.MetadataDir)
+	storage := NewStorage(config)
+
+	for _, host := range []string{"web1", "web2", "web3"} {
+		for _, m := range dailyRuns(3) {
+			m.TaskId = TaskId(host + "-" + string(m.TaskId))
+			m.JobName = "job"
+			m.Host = host
+			m.Config.Retention = RetentionConfig{KeepDaily: 7}
+			m.Save(path.Join(config.MetadataDir, string(m.TaskId)))
+		}
+	}
+	plan, err := storage.PlanCleanup()
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	if len(plan.Tasks) != 0 {
+		t.Fatal("runs of other hosts removed:", len(plan.Tasks), plan.Tasks[0].TaskId)
+	}
+}
+
+func TestStorage_PlanCleanup_LastRunFailedPerHost(t *testing.T) {
+	config := NewConfig()
+	config.MetadataDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(config.MetadataDir)
+	storage := NewStorage(config)
+
+	for _, host := range []string{"web1", "web2"} {
+		for i, m := range dailyRuns(3) {
+			m.TaskId = TaskId(host + "-" + string(m.TaskId))
+			m.JobName = "job"
+			m.Host = host
+			m.Success = !(host == "web2" && i == 0)
+			m.Config.Retention = RetentionConfig{KeepLast: 1}
+			m.Save(path.Join(config.MetadataDir, string(m.TaskId)))
+		}
+	}
+	plan, err := storage.PlanCleanup()
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	if len(plan.Skipped) != 1 || plan.Skipped[0] != "job@web2" {
+		t.Fatal("bad skipped:", plan.Skipped)
+	}
+	removed := []string{}
+	for _, m := range plan.Tasks {
+		removed = append(removed, string(m.TaskId))
+	}
+	sort.Strings(removed)
+	if len(removed) != 2 || removed[0] != "web1-2015-03-29" || removed[1] != "web1-2015-03-30" {
+		t.Fatal("bad removed tasks:", removed)
+	}
+}
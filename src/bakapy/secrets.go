@@ -0,0 +1,122 @@
+package bakapy
+
+import (
+	"bytes"
+	"errors"
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+)
+
+const SECRET_TAG = "!secret "
+const SECRET_ENV_TAG = "!env "
+const SECRET_REDACTED = "********"
+
+// Config value which may be secret reference. Tag of "key: !secret name"
+// is kept as value prefix, "!secret name".
+type SecretString string
+
+func (s *SecretString) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode && (node.Tag == "!secret" || node.Tag == "!env") {
+		*s = SecretString(node.Tag + " " + node.Value)
+		return nil
+	}
+	var value string
+	if err := node.Decode(&value); err != nil {
+		return err
+	}
+	*s = SecretString(value)
+	return nil
+}
+
+func (s SecretString) Resolve(secretsDir string) (string, error) {
+	return ResolveSecret(string(s), secretsDir)
+}
+
+// Plain values are redacted in config dumps, secret references
+// are kept
+func (s SecretString) MarshalYAML() (interface{}, error) {
+	if s == "" || IsSecretRef(string(s)) {
+		return string(s), nil
+	}
+	return SECRET_REDACTED, nil
+}
+
+// Job args, values may be secret references
+type SecretMap map[string]string
+
+func (m *SecretMap) UnmarshalYAML(node *yaml.Node) error {
+	values := map[string]SecretString{}
+	if err := node.Decode(&values); err != nil {
+		return err
+	}
+	*m = SecretMap{}
+	for name, value := range values {
+		(*m)[name] = string(value)
+	}
+	return nil
+}
+
+func IsSecretRef(value string) bool {
+	return strings.HasPrefix(value, SECRET_TAG) || strings.HasPrefix(value, SECRET_ENV_TAG)
+}
+
+// Resolve secret reference. "!secret name" is read from file
+// secretsDir/name, "!env NAME" from environment variable NAME.
+func ResolveSecret(value string, secretsDir string) (string, error) {
+	switch {
+	case strings.HasPrefix(value, SECRET_TAG):
+		name := strings.TrimSpace(strings.TrimPrefix(value, SECRET_TAG))
+		if secretsDir == "" {
+			return "", errors.New("secret " + name + " requested but secrets_dir not configured")
+		}
+		if name == "" || strings.Contains(name, "/") || strings.HasPrefix(name, ".") {
+			return "", errors.New("bad secret name '" + name + "'")
+		}
+		data, err := ioutil.ReadFile(path.Join(secretsDir, name))
+		if err != nil {
+			return "", errors.New("cannot read secret " + name + ": " + err.Error())
+		}
+		return strings.TrimRight(string(data), "\r\n"), nil
+	case strings.HasPrefix(value, SECRET_ENV_TAG):
+		name := strings.TrimSpace(strings.TrimPrefix(value, SECRET_ENV_TAG))
+		secret, exist := os.LookupEnv(name)
+		if !exist {
+			return "", errors.New("environment variable " + name + " for secret is not set")
+		}
+		return secret, nil
+	}
+	return value, nil
+}
+
+// Returns args with secret references replaced by its values
+// and list of resolved secret values for redaction.
+func ResolveArgs(args map[string]string, secretsDir string) (map[string]string, []string, error) {
+	resolved := make(map[string]string, len(args))
+	secrets := []string{}
+	for name, value := range args {
+		if !IsSecretRef(value) {
+			resolved[name] = value
+			continue
+		}
+		secret, err := ResolveSecret(value, secretsDir)
+		if err != nil {
+			return nil, nil, errors.New("arg " + name + ": " + err.Error())
+		}
+		resolved[name] = secret
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+	return resolved, secrets, nil
+}
+
+// Replaces all secret values in data with SECRET_REDACTED
+func RedactSecrets(data []byte, secrets []string) []byte {
+	for _, secret := range secrets {
+		data = bytes.Replace(data, []byte(secret), []byte(SECRET_REDACTED), -1)
+	}
+	return data
+}
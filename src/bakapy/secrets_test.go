@@ -0,0 +1,264 @@
+package bakapy
+
+import (
+	"gopkg.in/yaml.v3"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+)
+
+type TestEchoSecretExecutor struct{}
+
+func (e *TestEchoSecretExecutor) Execute(script []byte, output io.Writer, errput io.Writer) error {
+	output.Write([]byte("password is s3cr3t-pwd"))
+	errput.Write([]byte("s3cr3t-pwd"))
+	return nil
+}
+
+func TestParseConfig_SecretTagsPreserved(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+replicas:
+  - {name: offsite, type: bakapy, addr: "backup2:9876", key: !secret replica}
+jobs:
+    wow:
+      args:
+        mysql_pwd: !secret mysql_root
+        token: !env BAKAPY_TEST_TOKEN
+        plain: value
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	config, err := ParseConfig(cfg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Replicas[0].Key != "!secret replica" {
+		t.Fatal("bad replica key:", config.Replicas[0].Key)
+	}
+	args := config.Jobs["wow"].Args
+	if args["mysql_pwd"] != "!secret mysql_root" {
+		t.Fatal("bad mysql_pwd arg:", args["mysql_pwd"])
+	}
+	if args["token"] != "!env BAKAPY_TEST_TOKEN" {
+		t.Fatal("bad token arg:", args["token"])
+	}
+	if args["plain"] != "value" {
+		t.Fatal("bad plain arg:", args["plain"])
+	}
+}
+
+func TestSecretString_UnmarshalYAML(t *testing.T) {
+	var values struct {
+		Key   SecretString
+		Env   SecretString
+		Plain SecretString
+		Args  SecretMap
+	}
+	raw := "key: !secret name\nenv: !env NAME\nplain: value\nargs: {pwd: !secret pwd, db: main}\n"
+	if err := yaml.Unmarshal([]byte(raw), &values); err != nil {
+		t.Fatal("cannot unmarshal:", err)
+	}
+	if values.Key != "!secret name" || values.Env != "!env NAME" || values.Plain != "value" {
+		t.Fatal("bad values:", values)
+	}
+	if values.Args["pwd"] != "!secret pwd" || values.Args["db"] != "main" {
+		t.Fatal("bad args:", values.Args)
+	}
+	if err := yaml.Unmarshal([]byte("key: [a, b]\n"), &values); err == nil {
+		t.Fatal("sequence accepted as secret string")
+	}
+}
+
+func TestParseConfig_SecretTagsOtherValuesUntouched(t *testing.T) {
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+notifiers:
+  - name: hook
+    type: command
+    command: /bin/sh
+    args:
+      - -c
+      - |
+        echo token: !secret name
+        echo - !env NAME
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	config, err := ParseConfig(cfg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := config.Notifiers[0].Args[1]
+	if script != "echo token: !secret name\necho - !env NAME\n" {
+		t.Fatal("bad script arg:", script)
+	}
+}
+
+func TestConfig_PrettyFmtRedactsSecrets(t *testing.T) {
+	secretsDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(secretsDir)
+	ioutil.WriteFile(path.Join(secretsDir, "replica"), []byte("resolved-replica-key\n"), 0600)
+	cfg, _ := ioutil.TempFile("", "test_config")
+	cfg.Write([]byte(`
+secrets_dir: ` + secretsDir + `
+replica_key: !secret replica
+smtp: {username: bakapy, password: !secret replica}
+http: {sync_key: plain-sync-key}
+notifiers:
+  - name: chat
+    type: webhook
+    url: https://chat.example.com/hooks/plain-webhook-token
+    headers: {Authorization: plain-header-token, X-Key: !secret replica}
+replicas:
+  - {name: offsite, type: bakapy, addr: "backup2:9876", key: plain-offsite-key}
+`))
+	cfg.Close()
+	defer os.Remove(cfg.Name())
+
+	config, err := ParseConfig(cfg.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	dump := string(config.PrettyFmt())
+	for _, secret := range []string{"resolved-replica-key", "plain-offsite-key", "plain-sync-key", "plain-webhook-token", "plain-header-token"} {
+		if strings.Contains(dump, secret) {
+			t.Fatal("secret", secret, "in config dump:", dump)
+		}
+	}
+	if !strings.Contains(dump, "replica_key: '!secret replica'") || !strings.Contains(dump, "X-Key: '!secret replica'") ||
+		!strings.Contains(dump, "password: '!secret replica'") {
+		t.Fatal("secret reference not in config dump:", dump)
+	}
+}
+
+func TestResolveArgs_Ok(t *testing.T) {
+	secretsDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(secretsDir)
+	ioutil.WriteFile(path.Join(secretsDir, "mysql_root"), []byte("filepwd\n"), 0600)
+	os.Setenv("BAKAPY_TEST_TOKEN", "envpwd")
+	defer os.Unsetenv("BAKAPY_TEST_TOKEN")
+
+	args, secrets, err := ResolveArgs(map[string]string{
+		"mysql_pwd": "!secret mysql_root",
+		"token":     "!env BAKAPY_TEST_TOKEN",
+		"plain":     "value",
+	}, secretsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if args["mysql_pwd"] != "filepwd" {
+		t.Fatal("bad mysql_pwd:", args["mysql_pwd"])
+	}
+	if args["token"] != "envpwd" {
+		t.Fatal("bad token:", args["token"])
+	}
+	if args["plain"] != "value" {
+		t.Fatal("bad plain:", args["plain"])
+	}
+	if len(secrets) != 2 {
+		t.Fatal("secrets length must be 2, not", len(secrets))
+	}
+}
+
+func TestResolveArgs_SecretDoesNotExist(t *testing.T) {
+	secretsDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(secretsDir)
+
+	_, _, err := ResolveArgs(map[string]string{"pwd": "!secret nope"}, secretsDir)
+	if err == nil || !strings.HasPrefix(err.Error(), "arg pwd: cannot read secret nope:") {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestResolveArgs_SecretBadName(t *testing.T) {
+	_, _, err := ResolveArgs(map[string]string{"pwd": "!secret ../../etc/passwd"}, "/tmp")
+	if err == nil || err.Error() != "arg pwd: bad secret name '../../etc/passwd'" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestResolveArgs_NoSecretsDir(t *testing.T) {
+	_, _, err := ResolveArgs(map[string]string{"pwd": "!secret wow"}, "")
+	if err == nil || err.Error() != "arg pwd: secret wow requested but secrets_dir not configured" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	data := RedactSecrets([]byte("user=root password=qwe123 qwe123"), []string{"qwe123"})
+	if string(data) != "user=root password="+SECRET_REDACTED+" "+SECRET_REDACTED {
+		t.Fatal("bad redacted data:", string(data))
+	}
+}
+
+func TestRunJob_SecretsRedacted(t *testing.T) {
+	os.Setenv("BAKAPY_TEST_PWD", "s3cr3t-pwd")
+	defer os.Unsetenv("BAKAPY_TEST_PWD")
+
+	gConfig := NewConfig()
+	gConfig.Listen = "1.1.1.1:1234"
+	gConfig.MetadataDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(gConfig.MetadataDir)
+	defer os.RemoveAll(gConfig.MetadataDir + "_artifacts")
+	defer os.RemoveAll(gConfig.MetadataDir + "_notify")
+	gConfig.CommandDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(gConfig.CommandDir)
+
+	storage := NewStorage(gConfig)
+	jConfig := &JobConfig{
+		Command:  "wow.cmd",
+		Args:     map[string]string{"mysql_pwd": "!env BAKAPY_TEST_PWD"},
+		executor: &TestEchoSecretExecutor{},
+	}
+	os.Create(gConfig.CommandDir + "/" + "wow.cmd")
+	taskId := RunJob("testjob", jConfig, gConfig, storage)
+
+	raw, err := ioutil.ReadFile(path.Join(gConfig.MetadataDir, string(taskId)))
+	if err != nil {
+		t.Fatal("cannot read metadata:", err)
+	}
+	meta, _ := storage.Metadata.Get(taskId)
+	if err := storage.Artifacts.Inline(meta); err != nil {
+		t.Fatal("cannot load artifacts:", err)
+	}
+	if strings.Contains(string(meta.Output)+string(meta.Errput)+string(raw), "s3cr3t-pwd") {
+		t.Fatal("secret value found in metadata")
+	}
+	if meta.Config.Args["mysql_pwd"] != "!env BAKAPY_TEST_PWD" {
+		t.Fatal("metadata config must keep secret reference, not", meta.Config.Args["mysql_pwd"])
+	}
+}
+
+func TestRunJob_SecretResolveFailed(t *testing.T) {
+	gConfig := NewConfig()
+	gConfig.Listen = "1.1.1.1:1234"
+	gConfig.MetadataDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(gConfig.MetadataDir)
+	defer os.RemoveAll(gConfig.MetadataDir + "_artifacts")
+	defer os.RemoveAll(gConfig.MetadataDir + "_notify")
+
+	storage := NewStorage(gConfig)
+	jConfig := &JobConfig{
+		Command:  "wow.cmd",
+		Args:     map[string]string{"mysql_pwd": "!env BAKAPY_TEST_DOES_NOT_EXIST"},
+		executor: &TestOkExecutor{},
+	}
+	taskId := RunJob("testjob", jConfig, gConfig, storage)
+	meta, err := storage.Metadata.Get(taskId)
+	if err != nil {
+		t.Fatal("cannot load metadata:", err)
+	}
+	if meta.Success {
+		t.Fatal("job with unresolved secret must fail")
+	}
+	expected := "arg mysql_pwd: environment variable BAKAPY_TEST_DOES_NOT_EXIST for secret is not set"
+	if meta.Message != expected {
+		t.Fatal("bad message:", meta.Message)
+	}
+}
@@ -0,0 +1,469 @@
+package bakapy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/user"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Host key policies
+const (
+	HOST_KEY_POLICY_STRICT     = "strict"
+	HOST_KEY_POLICY_ACCEPT_NEW = "accept-new"
+	HOST_KEY_POLICY_INSECURE   = "insecure"
+)
+
+const SSH_DEFAULT_CONNECT_TIMEOUT = 30 * time.Second
+const SSH_DEFAULT_KEEPALIVE_MAX_MISSED = 3
+
+type SSHExecutor struct {
+	Args      map[string]string
+	Host      string
+	Port      uint
+	Sudo      bool
+	Secrets   []string
+	Config    SSHConfig
+	Transport string
+	stream    *StreamDemuxer
+	logger    *logging.Logger
+
+	// reverse tunnel state, see OpenTunnel
+	client    *ssh.Client
+	tunnel    net.Listener
+	forwarded sync.WaitGroup
+}
+
+func NewSSHExecutor(args map[string]string, host string, port uint, sudo bool, cfg SSHConfig) *SSHExecutor {
+	return &SSHExecutor{
+		Args:   args,
+		Host:   host,
+		Port:   port,
+		Sudo:   sudo,
+		Config: cfg,
+		logger: logging.MustGetLogger("bakapy.executor.native_ssh"),
+	}
+}
+
+// Split "user@host:port" into parts. Missing parts are returned empty/zero.
+func splitSSHAddr(addr string) (string, string, uint, error) {
+	var sshUser string
+	var port uint
+	if idx := strings.LastIndex(addr, "@"); idx != -1 {
+		sshUser = addr[:idx]
+		addr = addr[idx+1:]
+	}
+	host := addr
+	if h, p, err := net.SplitHostPort(addr); err == nil {
+		parsed, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return "", "", 0, errors.New("bad port in address " + addr)
+		}
+		host = h
+		port = uint(parsed)
+	}
+	return sshUser, host, port, nil
+}
+
+func (e *SSHExecutor) currentUser() string {
+	if e.Config.User != "" {
+		return e.Config.User
+	}
+	curUser, err := user.Current()
+	if err != nil {
+		return "root"
+	}
+	return curUser.Username
+}
+
+func (e *SSHExecutor) knownHostsPath() string {
+	if e.Config.KnownHosts != "" {
+		return e.Config.KnownHosts
+	}
+	curUser, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return path.Join(curUser.HomeDir, ".ssh", "known_hosts")
+}
+
+func (e *SSHExecutor) HostKeyCallback() (ssh.HostKeyCallback, error) {
+	policy := e.Config.HostKeyPolicy
+	if policy == "" {
+		policy = HOST_KEY_POLICY_STRICT
+	}
+
+	if policy == HOST_KEY_POLICY_INSECURE {
+		return ssh.InsecureIgnoreHostKey(), nil
+	}
+
+	knownHostsPath := e.knownHostsPath()
+	if policy == HOST_KEY_POLICY_ACCEPT_NEW {
+		if err := os.MkdirAll(path.Dir(knownHostsPath), 0700); err != nil {
+			return nil, err
+		}
+		fd, err := os.OpenFile(knownHostsPath, os.O_CREATE|os.O_RDONLY, 0600)
+		if err != nil {
+			return nil, err
+		}
+		fd.Close()
+	}
+
+	callback, err := knownhosts.New(knownHostsPath)
+	if err != nil {
+		return nil, err
+	}
+
+	switch policy {
+	case HOST_KEY_POLICY_STRICT:
+		return callback, nil
+	case HOST_KEY_POLICY_ACCEPT_NEW:
+		var mu sync.Mutex
+		return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			mu.Lock()
+			defer mu.Unlock()
+			err := callback(hostname, remote, key)
+			keyErr, ok := err.(*knownhosts.KeyError)
+			if !ok || len(keyErr.Want) != 0 {
+				return err
+			}
+			e.logger.Warning("adding new host key for %s to %s", hostname, knownHostsPath)
+			fd, err := os.OpenFile(knownHostsPath, os.O_APPEND|os.O_WRONLY, 0600)
+			if err != nil {
+				return err
+			}
+			defer fd.Close()
+			line := knownhosts.Line([]string{knownhosts.Normalize(hostname)}, key)
+			_, err = fd.Write([]byte(line + "\n"))
+			return err
+		}, nil
+	}
+	return nil, errors.New("unknown host key policy '" + policy + "'")
+}
+
+// Auth methods and function closing ssh agent connection, it must
+// be called when handshake is done
+func (e *SSHExecutor) AuthMethods() ([]ssh.AuthMethod, func(), error) {
+	var methods []ssh.AuthMethod
+	if e.Config.KeyFile != "" {
+		rawKey, err := ioutil.ReadFile(e.Config.KeyFile)
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(rawKey)
+		if err != nil {
+			return nil, nil, errors.New("cannot parse key file " + e.Config.KeyFile + ": " + err.Error())
+		}
+		methods = append(methods, ssh.PublicKeys(signer))
+	}
+
+	closeAgent := func() {}
+	if agentSock := os.Getenv("SSH_AUTH_SOCK"); agentSock != "" {
+		conn, err := net.Dial("unix", agentSock)
+		if err != nil {
+			e.logger.Warning("cannot connect to ssh agent: %s", err)
+		} else {
+			closeAgent = func() { conn.Close() }
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	if len(methods) == 0 {
+		return nil, nil, errors.New("no ssh key_file configured and ssh agent is not available")
+	}
+	return methods, closeAgent, nil
+}
+
+// Client config and function closing ssh agent connection
+func (e *SSHExecutor) clientConfig(sshUser string) (*ssh.ClientConfig, func(), error) {
+	hostKeyCallback, err := e.HostKeyCallback()
+	if err != nil {
+		return nil, nil, err
+	}
+	auth, closeAgent, err := e.AuthMethods()
+	if err != nil {
+		return nil, nil, err
+	}
+	if sshUser == "" {
+		sshUser = e.currentUser()
+	}
+	timeout := e.Config.ConnectTimeout
+	if timeout == 0 {
+		timeout = SSH_DEFAULT_CONNECT_TIMEOUT
+	}
+	return &ssh.ClientConfig{
+		User:            sshUser,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	}, closeAgent, nil
+}
+
+func (e *SSHExecutor) dialJumpHost() (*ssh.Client, error) {
+	jumpUser, jumpHost, jumpPort, err := splitSSHAddr(e.Config.JumpHost)
+	if err != nil {
+		return nil, err
+	}
+	if jumpPort == 0 {
+		jumpPort = 22
+	}
+	config, closeAgent, err := e.clientConfig(jumpUser)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+	jumpAddr := net.JoinHostPort(jumpHost, strconv.FormatUint(uint64(jumpPort), 10))
+	e.logger.Debug("connecting to jump host %s@%s", config.User, jumpAddr)
+	client, err := ssh.Dial("tcp", jumpAddr, config)
+	if err != nil {
+		return nil, errors.New("cannot connect to jump host " + jumpAddr + ": " + err.Error())
+	}
+	return client, nil
+}
+
+// Connect to job host, through jump host if configured.
+func (e *SSHExecutor) Dial() (*ssh.Client, error) {
+	sshUser, host, port, err := splitSSHAddr(e.Host)
+	if err != nil {
+		return nil, err
+	}
+	if port == 0 {
+		port = e.Port
+	}
+	if port == 0 {
+		port = 22
+	}
+	config, closeAgent, err := e.clientConfig(sshUser)
+	if err != nil {
+		return nil, err
+	}
+	defer closeAgent()
+	addr := net.JoinHostPort(host, strconv.FormatUint(uint64(port), 10))
+
+	if e.Config.JumpHost == "" {
+		e.logger.Debug("connecting to %s@%s", config.User, addr)
+		client, err := ssh.Dial("tcp", addr, config)
+		if err != nil {
+			return nil, errors.New("cannot connect to " + addr + ": " + err.Error())
+		}
+		return client, nil
+	}
+
+	jumpClient, err := e.dialJumpHost()
+	if err != nil {
+		return nil, err
+	}
+	e.logger.Debug("connecting to %s@%s through jump host", config.User, addr)
+	conn, err := jumpClient.Dial("tcp", addr)
+	if err != nil {
+		jumpClient.Close()
+		return nil, errors.New("cannot connect to " + addr + " through jump host: " + err.Error())
+	}
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if err != nil {
+		conn.Close()
+		jumpClient.Close()
+		return nil, errors.New("cannot connect to " + addr + " through jump host: " + err.Error())
+	}
+	client := ssh.NewClient(clientConn, chans, reqs)
+	go func() {
+		client.Wait()
+		jumpClient.Close()
+	}()
+	return client, nil
+}
+
+// Send keepalive requests until done closed. Connection is closed
+// and error sent to failed if request fails or server does not reply
+// during keepalive_max_missed intervals.
+func (e *SSHExecutor) keepalive(client *ssh.Client, done chan struct{}, failed chan error) {
+	if e.Config.Keepalive <= 0 {
+		return
+	}
+	maxMissed := e.Config.KeepaliveMaxMissed
+	if maxMissed == 0 {
+		maxMissed = SSH_DEFAULT_KEEPALIVE_MAX_MISSED
+	}
+	ticker := time.NewTicker(e.Config.Keepalive)
+	defer ticker.Stop()
+	// reply of request in flight, nil if there is none
+	var reply chan error
+	var missed uint
+	for {
+		select {
+		case <-done:
+			return
+		case err := <-reply:
+			reply = nil
+			missed = 0
+			if err != nil {
+				e.logger.Warning("keepalive failed, closing connection: %s", err)
+				failed <- errors.New("ssh keepalive failed: " + err.Error())
+				client.Close()
+				return
+			}
+		case <-ticker.C:
+			if reply == nil {
+				reply = make(chan error, 1)
+				go func(reply chan error) {
+					_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+					reply <- err
+				}(reply)
+				continue
+			}
+			missed++
+			if missed >= maxMissed {
+				e.logger.Warning("no keepalive reply from %s, closing connection", e.Host)
+				failed <- errors.New(fmt.Sprintf("no ssh keepalive reply from %s in %s", e.Host, time.Duration(missed)*e.Config.Keepalive))
+				client.Close()
+				return
+			}
+		}
+	}
+}
+
+// Listen on remote host loopback and forward connections to storageAddr
+// over ssh connection. Connection is reused by Execute.
+func (e *SSHExecutor) OpenTunnel(storageAddr string) (string, error) {
+	if !e.Config.ReverseTunnel {
+		return storageAddr, nil
+	}
+	client, err := e.Dial()
+	if err != nil {
+		return "", err
+	}
+	bindAddr := net.JoinHostPort("127.0.0.1", strconv.FormatUint(uint64(e.Config.TunnelPort), 10))
+	tunnel, err := client.Listen("tcp", bindAddr)
+	if err != nil {
+		client.Close()
+		return "", errors.New("cannot listen on remote " + bindAddr + ": " + err.Error())
+	}
+	e.client = client
+	e.tunnel = tunnel
+	e.logger.Info("forwarding remote %s to storage %s", tunnel.Addr(), storageAddr)
+
+	// accept loop is counted too, so forwarded connections are never
+	// added to idle group waited by CloseTunnel
+	e.forwarded.Add(1)
+	go func() {
+		defer e.forwarded.Done()
+		for {
+			remoteConn, err := tunnel.Accept()
+			if err != nil {
+				return
+			}
+			e.forwarded.Add(1)
+			go func() {
+				defer e.forwarded.Done()
+				e.forward(remoteConn, storageAddr)
+			}()
+		}
+	}()
+	return tunnel.Addr().String(), nil
+}
+
+func (e *SSHExecutor) forward(remoteConn net.Conn, storageAddr string) {
+	defer remoteConn.Close()
+	localConn, err := net.Dial("tcp", storageAddr)
+	if err != nil {
+		e.logger.Warning("cannot connect to storage %s: %s", storageAddr, err)
+		return
+	}
+	defer localConn.Close()
+	written, err := io.Copy(localConn, remoteConn)
+	if err != nil {
+		e.logger.Warning("tunnel connection failed after %d bytes: %s", written, err)
+		return
+	}
+	e.logger.Debug("tunnel connection forwarded %d bytes", written)
+}
+
+func (e *SSHExecutor) CloseTunnel() error {
+	if e.tunnel == nil {
+		return nil
+	}
+	e.tunnel.Close()
+	e.forwarded.Wait()
+	err := e.client.Close()
+	e.tunnel = nil
+	e.client = nil
+	return err
+}
+
+func (e *SSHExecutor) SetStream(taskId TaskId, handler StorageConnHandler) {
+	e.stream = NewStreamDemuxer(taskId, handler, e.Host)
+}
+
+func (e *SSHExecutor) Execute(script []byte, output io.Writer, errput io.Writer) error {
+	if e.Transport == TRANSPORT_STDOUT {
+		return executeWithStream(e.stream, e.execute, script, output, errput)
+	}
+	return e.execute(script, output, errput)
+}
+
+func (e *SSHExecutor) execute(script []byte, output io.Writer, errput io.Writer) error {
+	env, err := argsEnvScript(e.Args)
+	if err != nil {
+		return err
+	}
+	script = append(env, script...)
+
+	client := e.client
+	if client == nil {
+		client, err = e.Dial()
+		if err != nil {
+			return err
+		}
+		defer client.Close()
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	keepaliveFailed := make(chan error, 1)
+	go e.keepalive(client, done, keepaliveFailed)
+
+	session, err := client.NewSession()
+	if err != nil {
+		return errors.New("cannot open ssh session: " + err.Error())
+	}
+	defer session.Close()
+
+	session.Stdin = bytes.NewReader(script)
+	session.Stdout = output
+	session.Stderr = errput
+
+	remoteCmd := "/bin/bash"
+	if e.Sudo {
+		remoteCmd = "sudo /bin/bash"
+	}
+
+	e.logger.Debug("%s", RedactSecrets(script, e.Secrets))
+	e.logger.Debug("executing command '%s' on %s", remoteCmd, e.Host)
+
+	err = session.Run(remoteCmd)
+	select {
+	case keepaliveErr := <-keepaliveFailed:
+		return keepaliveErr
+	default:
+	}
+	if exitErr, ok := err.(*ssh.ExitError); ok {
+		return errors.New(fmt.Sprintf("exit status %d", exitErr.ExitStatus()))
+	}
+	if err != nil {
+		return errors.New("ssh session failed: " + err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,499 @@
+package bakapy
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/pem"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// In-process ssh server running commands with local bash
+type TestSSHServer struct {
+	Addr       string
+	HostKey    ssh.Signer
+	ClientKey  string
+	clientPub  ssh.PublicKey
+	listener   net.Listener
+	tmpDir     string
+	mu         sync.Mutex
+	execCount  int
+	tcpipCount int
+	// do not reply keepalive requests, as dead peer
+	ignoreKeepalive bool
+}
+
+func NewTestSSHServer(t *testing.T) *TestSSHServer {
+	_, hostPriv, _ := ed25519.GenerateKey(rand.Reader)
+	hostKey, _ := ssh.NewSignerFromKey(hostPriv)
+
+	clientPub, clientPriv, _ := ed25519.GenerateKey(rand.Reader)
+	sshClientPub, _ := ssh.NewPublicKey(clientPub)
+	pemBlock, err := ssh.MarshalPrivateKey(clientPriv, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpDir, _ := ioutil.TempDir("", "")
+	clientKeyPath := path.Join(tmpDir, "id_ed25519")
+	ioutil.WriteFile(clientKeyPath, pem.EncodeToMemory(pemBlock), 0600)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &TestSSHServer{
+		Addr:      ln.Addr().String(),
+		HostKey:   hostKey,
+		ClientKey: clientKeyPath,
+		clientPub: sshClientPub,
+		listener:  ln,
+		tmpDir:    tmpDir,
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			srv.mu.Lock()
+			defer srv.mu.Unlock()
+			if bytes.Equal(key.Marshal(), srv.clientPub.Marshal()) {
+				return nil, nil
+			}
+			return nil, io.EOF
+		},
+	}
+	config.AddHostKey(hostKey)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go srv.handleConn(conn, config)
+		}
+	}()
+	return srv
+}
+
+func (srv *TestSSHServer) Close() {
+	srv.listener.Close()
+	os.RemoveAll(srv.tmpDir)
+}
+
+func (srv *TestSSHServer) Port() uint {
+	_, port, _ := net.SplitHostPort(srv.Addr)
+	p, _ := strconv.Atoi(port)
+	return uint(p)
+}
+
+func (srv *TestSSHServer) handleConn(conn net.Conn, config *ssh.ServerConfig) {
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	go srv.handleGlobalRequests(sconn, reqs)
+	for newCh := range chans {
+		switch newCh.ChannelType() {
+		case "session":
+			ch, chReqs, err := newCh.Accept()
+			if err != nil {
+				continue
+			}
+			go srv.handleSession(ch, chReqs)
+		case "direct-tcpip":
+			var payload struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			ssh.Unmarshal(newCh.ExtraData(), &payload)
+			target, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+			if err != nil {
+				newCh.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			ch, chReqs, _ := newCh.Accept()
+			go ssh.DiscardRequests(chReqs)
+			srv.mu.Lock()
+			srv.tcpipCount++
+			srv.mu.Unlock()
+			go func() {
+				go func() {
+					io.Copy(target, ch)
+					target.Close()
+				}()
+				io.Copy(ch, target)
+				ch.Close()
+			}()
+		default:
+			newCh.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+// Supports remote port forwarding (tcpip-forward) requests
+func (srv *TestSSHServer) handleGlobalRequests(sconn *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	var forwards []net.Listener
+	defer func() {
+		for _, ln := range forwards {
+			ln.Close()
+		}
+	}()
+	for req := range reqs {
+		srv.mu.Lock()
+		ignore := srv.ignoreKeepalive && req.Type == "keepalive@openssh.com"
+		srv.mu.Unlock()
+		if ignore {
+			continue
+		}
+		if req.Type != "tcpip-forward" {
+			if req.Type == "cancel-tcpip-forward" {
+				req.Reply(true, nil)
+				continue
+			}
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct {
+			BindAddr string
+			BindPort uint32
+		}
+		ssh.Unmarshal(req.Payload, &payload)
+		ln, err := net.Listen("tcp", net.JoinHostPort(payload.BindAddr, strconv.Itoa(int(payload.BindPort))))
+		if err != nil {
+			req.Reply(false, nil)
+			continue
+		}
+		forwards = append(forwards, ln)
+		_, port, _ := net.SplitHostPort(ln.Addr().String())
+		p, _ := strconv.Atoi(port)
+		req.Reply(true, ssh.Marshal(struct{ Port uint32 }{uint32(p)}))
+		go func(ln net.Listener, bindAddr string, bindPort uint32) {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				ch, chReqs, err := sconn.OpenChannel("forwarded-tcpip", ssh.Marshal(struct {
+					Addr       string
+					Port       uint32
+					OriginAddr string
+					OriginPort uint32
+				}{bindAddr, bindPort, "127.0.0.1", 1}))
+				if err != nil {
+					conn.Close()
+					continue
+				}
+				go ssh.DiscardRequests(chReqs)
+				go func() {
+					io.Copy(ch, conn)
+					ch.CloseWrite()
+					conn.Close()
+				}()
+			}
+		}(ln, payload.BindAddr, uint32(p))
+	}
+}
+
+func (srv *TestSSHServer) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			req.Reply(false, nil)
+			continue
+		}
+		var payload struct{ Command string }
+		ssh.Unmarshal(req.Payload, &payload)
+		req.Reply(true, nil)
+		srv.mu.Lock()
+		srv.execCount++
+		srv.mu.Unlock()
+
+		cmd := exec.Command("bash", "-c", payload.Command)
+		cmd.Stdin = ch
+		cmd.Stdout = ch
+		cmd.Stderr = ch.Stderr()
+		status := make([]byte, 4)
+		if err := cmd.Run(); err != nil {
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				binary.BigEndian.PutUint32(status, uint32(exitErr.ExitCode()))
+			} else {
+				binary.BigEndian.PutUint32(status, 255)
+			}
+		}
+		ch.SendRequest("exit-status", false, status)
+		return
+	}
+}
+
+func testSSHExecutor(srv *TestSSHServer, args map[string]string, policy string) *SSHExecutor {
+	knownHosts := path.Join(srv.tmpDir, "known_hosts")
+	os.Unsetenv("SSH_AUTH_SOCK")
+	return NewSSHExecutor(args, "tester@127.0.0.1", srv.Port(), false, SSHConfig{
+		KeyFile:       srv.ClientKey,
+		KnownHosts:    knownHosts,
+		HostKeyPolicy: policy,
+	})
+}
+
+func TestSSHExecutor_Execute_Ok(t *testing.T) {
+	srv := NewTestSSHServer(t)
+	defer srv.Close()
+
+	executor := testSSHExecutor(srv, map[string]string{"test": "it's $(hostile)"}, HOST_KEY_POLICY_INSECURE)
+	script := []byte(`printf '%s' "$TEST"; echo -n some errput >&2`)
+	output := new(bytes.Buffer)
+	errput := new(bytes.Buffer)
+	err := executor.Execute(script, output, errput)
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if output.String() != "it's $(hostile)" {
+		t.Fatalf("Output must be 'it's $(hostile)', not '%s'", output)
+	}
+	if errput.String() != "some errput" {
+		t.Fatalf("Errput must be 'some errput', not '%s'", errput)
+	}
+}
+
+func TestSSHExecutor_Execute_CommandFailed(t *testing.T) {
+	srv := NewTestSSHServer(t)
+	defer srv.Close()
+
+	executor := testSSHExecutor(srv, map[string]string{}, HOST_KEY_POLICY_INSECURE)
+	err := executor.Execute([]byte("exit 19"), new(bytes.Buffer), new(bytes.Buffer))
+	if err == nil || err.Error() != "exit status 19" {
+		t.Fatalf("err must be 'exit status 19', not '%s'", err)
+	}
+}
+
+func TestSSHExecutor_Execute_KeepaliveNoReply(t *testing.T) {
+	srv := NewTestSSHServer(t)
+	defer srv.Close()
+	srv.ignoreKeepalive = true
+
+	executor := testSSHExecutor(srv, map[string]string{}, HOST_KEY_POLICY_INSECURE)
+	executor.Config.Keepalive = 50 * time.Millisecond
+	executor.Config.KeepaliveMaxMissed = 2
+	started := time.Now()
+	err := executor.Execute([]byte("sleep 10"), new(bytes.Buffer), new(bytes.Buffer))
+	if err == nil || err.Error() != "no ssh keepalive reply from tester@127.0.0.1 in 100ms" {
+		t.Fatal("bad error:", err)
+	}
+	if time.Since(started) > 5*time.Second {
+		t.Fatal("dead connection noticed too late:", time.Since(started))
+	}
+}
+
+func TestSSHExecutor_Execute_KeepaliveReplied(t *testing.T) {
+	srv := NewTestSSHServer(t)
+	defer srv.Close()
+
+	executor := testSSHExecutor(srv, map[string]string{}, HOST_KEY_POLICY_INSECURE)
+	executor.Config.Keepalive = 20 * time.Millisecond
+	if err := executor.Execute([]byte("sleep 0.2"), new(bytes.Buffer), new(bytes.Buffer)); err != nil {
+		t.Fatal("Error:", err)
+	}
+}
+
+func TestSSHExecutor_Execute_AgentConnectionClosed(t *testing.T) {
+	srv := NewTestSSHServer(t)
+	defer srv.Close()
+	ln, err := net.Listen("unix", path.Join(srv.tmpDir, "agent.sock"))
+	if err != nil {
+		t.Fatal("cannot listen agent socket:", err)
+	}
+	defer ln.Close()
+	closed := make(chan struct{}, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				agent.ServeAgent(agent.NewKeyring(), conn)
+				closed <- struct{}{}
+			}()
+		}
+	}()
+
+	executor := testSSHExecutor(srv, map[string]string{}, HOST_KEY_POLICY_INSECURE)
+	os.Setenv("SSH_AUTH_SOCK", ln.Addr().String())
+	defer os.Unsetenv("SSH_AUTH_SOCK")
+	if err := executor.Execute([]byte("exit 0"), new(bytes.Buffer), new(bytes.Buffer)); err != nil {
+		t.Fatal("Error:", err)
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("ssh agent connection left open")
+	}
+}
+
+func TestSSHExecutor_Execute_StrictUnknownHost(t *testing.T) {
+	srv := NewTestSSHServer(t)
+	defer srv.Close()
+
+	executor := testSSHExecutor(srv, map[string]string{}, HOST_KEY_POLICY_STRICT)
+	ioutil.WriteFile(executor.Config.KnownHosts, []byte{}, 0600)
+	err := executor.Execute([]byte("exit 0"), new(bytes.Buffer), new(bytes.Buffer))
+	if err == nil || !strings.Contains(err.Error(), "knownhosts: key is unknown") {
+		t.Fatal("unknown host key must be rejected, got error:", err)
+	}
+}
+
+func TestSSHExecutor_Execute_AcceptNewHostKey(t *testing.T) {
+	srv := NewTestSSHServer(t)
+	defer srv.Close()
+
+	executor := testSSHExecutor(srv, map[string]string{}, HOST_KEY_POLICY_ACCEPT_NEW)
+	err := executor.Execute([]byte("exit 0"), new(bytes.Buffer), new(bytes.Buffer))
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+
+	knownHosts, _ := ioutil.ReadFile(executor.Config.KnownHosts)
+	if !strings.Contains(string(knownHosts), string(bytes.TrimSpace(ssh.MarshalAuthorizedKey(srv.HostKey.PublicKey())))) {
+		t.Fatal("host key was not saved to known_hosts:", string(knownHosts))
+	}
+
+	// key saved, strict policy must accept it now
+	executor.Config.HostKeyPolicy = HOST_KEY_POLICY_STRICT
+	err = executor.Execute([]byte("exit 0"), new(bytes.Buffer), new(bytes.Buffer))
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+}
+
+func TestSSHExecutor_Execute_AcceptNewKeyMismatch(t *testing.T) {
+	srv := NewTestSSHServer(t)
+	defer srv.Close()
+
+	_, otherPriv, _ := ed25519.GenerateKey(rand.Reader)
+	otherKey, _ := ssh.NewSignerFromKey(otherPriv)
+	executor := testSSHExecutor(srv, map[string]string{}, HOST_KEY_POLICY_ACCEPT_NEW)
+	line := "[127.0.0.1]:" + strconv.Itoa(int(srv.Port())) + " " + string(ssh.MarshalAuthorizedKey(otherKey.PublicKey()))
+	ioutil.WriteFile(executor.Config.KnownHosts, []byte(line), 0600)
+
+	err := executor.Execute([]byte("exit 0"), new(bytes.Buffer), new(bytes.Buffer))
+	if err == nil || !strings.Contains(err.Error(), "knownhosts: key mismatch") {
+		t.Fatal("changed host key must be rejected, got error:", err)
+	}
+}
+
+func TestSSHExecutor_Execute_ConnectFailed(t *testing.T) {
+	srv := NewTestSSHServer(t)
+	defer srv.Close()
+	srv.listener.Close()
+
+	executor := testSSHExecutor(srv, map[string]string{}, HOST_KEY_POLICY_INSECURE)
+	err := executor.Execute([]byte("exit 0"), new(bytes.Buffer), new(bytes.Buffer))
+	if err == nil || !strings.HasPrefix(err.Error(), "cannot connect to 127.0.0.1:") {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestSSHExecutor_Execute_NoAuth(t *testing.T) {
+	os.Unsetenv("SSH_AUTH_SOCK")
+	executor := NewSSHExecutor(nil, "127.0.0.1", 22, false, SSHConfig{
+		HostKeyPolicy: HOST_KEY_POLICY_INSECURE,
+	})
+	err := executor.Execute([]byte("exit 0"), new(bytes.Buffer), new(bytes.Buffer))
+	if err == nil || err.Error() != "no ssh key_file configured and ssh agent is not available" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestSSHExecutor_Execute_JumpHost(t *testing.T) {
+	jump := NewTestSSHServer(t)
+	defer jump.Close()
+	srv := NewTestSSHServer(t)
+	defer srv.Close()
+
+	// both servers accept the same client key
+	jump.mu.Lock()
+	jump.clientPub = srv.clientPub
+	jump.mu.Unlock()
+
+	executor := testSSHExecutor(srv, map[string]string{}, HOST_KEY_POLICY_INSECURE)
+	executor.Config.JumpHost = "jumper@" + jump.Addr
+	output := new(bytes.Buffer)
+	err := executor.Execute([]byte("echo -n hello"), output, new(bytes.Buffer))
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if output.String() != "hello" {
+		t.Fatalf("Output must be 'hello', not '%s'", output)
+	}
+	jump.mu.Lock()
+	defer jump.mu.Unlock()
+	if jump.tcpipCount != 1 || jump.execCount != 0 {
+		t.Fatal("connection must be forwarded through jump host")
+	}
+}
+
+func TestSplitSSHAddr(t *testing.T) {
+	user, host, port, err := splitSSHAddr("root@example.com:2222")
+	if err != nil || user != "root" || host != "example.com" || port != 2222 {
+		t.Fatal("bad split:", user, host, port, err)
+	}
+	user, host, port, err = splitSSHAddr("example.com")
+	if err != nil || user != "" || host != "example.com" || port != 0 {
+		t.Fatal("bad split:", user, host, port, err)
+	}
+}
+
+func TestSSHExecutor_ReverseTunnel_FileSaved(t *testing.T) {
+	srv := NewTestSSHServer(t)
+	defer srv.Close()
+
+	cfg := NewConfig()
+	cfg.StorageDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(cfg.StorageDir)
+	cfg.CommandDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(cfg.CommandDir)
+	cfg.Listen = "127.0.0.1:0"
+	storage := NewStorage(cfg)
+	ln := storage.Listen()
+	defer ln.Close()
+	go storage.Serve(ln)
+
+	ioutil.WriteFile(path.Join(cfg.CommandDir, "tunnel.cmd"), []byte("echo -n tunneled | _send_file hello.txt\n"), 0644)
+
+	executor := testSSHExecutor(srv, map[string]string{}, HOST_KEY_POLICY_INSECURE)
+	executor.Config.ReverseTunnel = true
+	jConfig := &JobConfig{Command: "tunnel.cmd", Namespace: "tun"}
+	job := NewJob("tunnel", jConfig, ln.Addr().String(), cfg.CommandDir, storage, executor)
+	m := job.Run()
+	if !m.Success {
+		t.Fatal("job failed:", m.Message, string(m.Errput))
+	}
+
+	if strings.Contains(string(m.Script), ln.Addr().String()) {
+		t.Fatal("script must use tunnel address, not storage address")
+	}
+	content, err := ioutil.ReadFile(path.Join(cfg.StorageDir, "tun", "hello.txt"))
+	if err != nil {
+		t.Fatal("cannot read saved file:", err)
+	}
+	if string(content) != "tunneled" {
+		t.Fatal("bad file content:", string(content))
+	}
+	if len(m.Files) != 1 || m.Files[0].Size != int64(len("tunneled")) {
+		t.Fatal("bad files metadata:", m.Files)
+	}
+}
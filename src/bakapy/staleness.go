@@ -0,0 +1,165 @@
+package bakapy
+
+import (
+	"fmt"
+	"github.com/op/go-logging"
+	"sort"
+	"time"
+)
+
+type StaleJob struct {
+	JobName string
+	// Empty for single host jobs
+	Host         string
+	MaxStaleness time.Duration
+	// Zero if job never succeeded
+	LastSuccess time.Time
+}
+
+func (s StaleJob) Key() string {
+	if s.Host == "" {
+		return s.JobName
+	}
+	return s.JobName + "@" + s.Host
+}
+
+func (s StaleJob) String() string {
+	if s.LastSuccess.IsZero() {
+		return fmt.Sprintf("job %s has no successful runs, max staleness %s", s.Key(), s.MaxStaleness)
+	}
+	return fmt.Sprintf("last successful run of job %s finished %s, older than max staleness %s",
+		s.Key(), s.LastSuccess.Format(time.RFC3339), s.MaxStaleness)
+}
+
+// Jobs with max_staleness whose newest successful run finished
+// earlier than max_staleness ago, per host for multi-host jobs.
+// Jobs without successful runs are stale if since is earlier
+// than max_staleness ago. Disabled jobs are checked too.
+func FindStaleJobs(jobs map[string]*JobConfig, metadatas []JobMetadata, since, now time.Time) []StaleJob {
+	lastSuccess := map[string]time.Time{}
+	for _, metadata := range metadatas {
+		if !metadata.Success {
+			continue
+		}
+		for _, key := range []string{metadata.JobName, metadata.JobName + "@" + metadata.Host} {
+			if metadata.EndTime.After(lastSuccess[key]) {
+				lastSuccess[key] = metadata.EndTime
+			}
+		}
+	}
+
+	stale := []StaleJob{}
+	for jobName, jobConfig := range jobs {
+		if jobConfig.MaxStaleness <= 0 {
+			continue
+		}
+		candidates := []StaleJob{{JobName: jobName, MaxStaleness: jobConfig.MaxStaleness}}
+		if len(jobConfig.Hosts) != 0 {
+			candidates = candidates[:0]
+			for _, hostConfig := range jobConfig.ExpandHosts() {
+				candidates = append(candidates, StaleJob{JobName: jobName, Host: hostConfig.Host, MaxStaleness: jobConfig.MaxStaleness})
+			}
+		}
+		for _, candidate := range candidates {
+			candidate.LastSuccess = lastSuccess[candidate.Key()]
+			checkFrom := candidate.LastSuccess
+			if checkFrom.IsZero() {
+				checkFrom = since
+			}
+			if now.Sub(checkFrom) > candidate.MaxStaleness {
+				stale = append(stale, candidate)
+			}
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Key() < stale[j].Key() })
+	return stale
+}
+
+// Periodically alerts about stale jobs, once until job gets
+// successful run again. Alerted jobs are kept in storage notify
+// state to survive restarts.
+type StalenessChecker struct {
+	config  *Config
+	storage *Storage
+	started time.Time
+	// Sends alert to notifiers routed for stale event by default
+	Notify func(stale StaleJob) error
+	logger *logging.Logger
+}
+
+func NewStalenessChecker(cfg *Config, storage *Storage) *StalenessChecker {
+	return &StalenessChecker{
+		config:  cfg,
+		storage: storage,
+		started: time.Now(),
+		Notify: func(stale StaleJob) error {
+			return NewNotificationRouter(cfg).Send(cfg.Jobs[stale.JobName], NewStaleNotification(stale))
+		},
+		logger: logging.MustGetLogger("bakapy.staleness"),
+	}
+}
+
+func (c *StalenessChecker) enabled() bool {
+	for _, jobConfig := range c.config.Jobs {
+		if jobConfig.MaxStaleness > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *StalenessChecker) setStale(key string, stale bool) error {
+	return c.storage.NotifyState.Update(key, func(state *NotifyState) {
+		state.Stale = stale
+	})
+}
+
+// Alert about jobs became stale since last check. Returns
+// currently stale jobs.
+func (c *StalenessChecker) CheckOnce(now time.Time) ([]StaleJob, error) {
+	if !c.enabled() {
+		return nil, nil
+	}
+	metadatas, err := c.storage.Metadata.List(MetadataQuery{Status: METADATA_STATUS_SUCCESS})
+	if err != nil {
+		return nil, err
+	}
+	states, err := c.storage.NotifyState.List()
+	if err != nil {
+		return nil, err
+	}
+	stale := FindStaleJobs(c.config.Jobs, metadatas, c.started, now)
+	current := map[string]bool{}
+	for _, job := range stale {
+		current[job.Key()] = true
+		if state, exist := states[job.Key()]; exist && state.Stale {
+			continue
+		}
+		c.logger.Critical("%s", job)
+		if err := c.Notify(job); err != nil {
+			c.logger.Critical("cannot send stale job notification: %s", err)
+			continue
+		}
+		if err := c.setStale(job.Key(), true); err != nil {
+			c.logger.Warning("cannot save stale state of job %s: %s", job.Key(), err)
+		}
+	}
+	for key, state := range states {
+		if state.Stale && !current[key] {
+			c.logger.Info("job %s is not stale anymore", key)
+			if err := c.setStale(key, false); err != nil {
+				c.logger.Warning("cannot save stale state of job %s: %s", key, err)
+			}
+		}
+	}
+	return stale, nil
+}
+
+func (c *StalenessChecker) Run() {
+	for {
+		if _, err := c.CheckOnce(time.Now()); err != nil {
+			c.logger.Warning("staleness check failed: %s", err)
+		}
+		time.Sleep(STALENESS_CHECK_INTERVAL)
+	}
+}
@@ -0,0 +1,101 @@
+package bakapy
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestFindStaleJobs(t *testing.T) {
+	now := time.Date(2016, 1, 10, 12, 0, 0, 0, time.UTC)
+	jobs := map[string]*JobConfig{
+		"fresh":   {MaxStaleness: 24 * time.Hour},
+		"old":     {MaxStaleness: 24 * time.Hour, Disabled: true},
+		"never":   {MaxStaleness: time.Hour},
+		"nocheck": {},
+		"failed":  {MaxStaleness: 24 * time.Hour},
+		"multi":   {MaxStaleness: 24 * time.Hour, Hosts: []string{"web1", "web2"}},
+		"newbie":  {MaxStaleness: 100 * time.Hour},
+	}
+	metadatas := []JobMetadata{
+		{JobName: "fresh", Success: true, EndTime: now.Add(-time.Hour)},
+		{JobName: "old", Success: true, EndTime: now.Add(-48 * time.Hour)},
+		{JobName: "nocheck", Success: true, EndTime: now.Add(-480 * time.Hour)},
+		{JobName: "failed", Success: true, EndTime: now.Add(-30 * time.Hour)},
+		{JobName: "failed", Success: false, EndTime: now.Add(-time.Hour)},
+		{JobName: "multi", Host: "web1", Success: true, EndTime: now.Add(-time.Hour)},
+		{JobName: "multi", Host: "web2", Success: true, EndTime: now.Add(-25 * time.Hour)},
+	}
+	stale := FindStaleJobs(jobs, metadatas, now.Add(-2*time.Hour), now)
+	keys := []string{}
+	for _, job := range stale {
+		keys = append(keys, job.Key())
+	}
+	if fmt.Sprint(keys) != "[failed multi@web2 never old]" {
+		t.Fatal("bad stale jobs:", keys)
+	}
+	if !stale[2].LastSuccess.IsZero() || stale[3].LastSuccess != now.Add(-48*time.Hour) {
+		t.Fatal("bad last success:", stale)
+	}
+}
+
+func TestStalenessChecker_AlertOnce(t *testing.T) {
+	storage, cleanup := replicationStorage(t)
+	defer cleanup()
+	cfg := NewConfig()
+	cfg.Jobs["job"] = &JobConfig{MaxStaleness: time.Hour}
+	checker := NewStalenessChecker(cfg, storage)
+	alerts := []StaleJob{}
+	checker.Notify = func(stale StaleJob) error {
+		alerts = append(alerts, stale)
+		return nil
+	}
+	now := time.Now()
+
+	checker.CheckOnce(now)
+	if len(alerts) != 0 {
+		t.Fatal("new job alerted before max staleness passed:", alerts)
+	}
+	checker.CheckOnce(now.Add(2 * time.Hour))
+	checker.CheckOnce(now.Add(3 * time.Hour))
+	if len(alerts) != 1 || alerts[0].JobName != "job" {
+		t.Fatal("stale job must be alerted once:", alerts)
+	}
+	// restarted checker remembers alert
+	notify := checker.Notify
+	checker = NewStalenessChecker(cfg, storage)
+	checker.Notify = notify
+	checker.CheckOnce(now.Add(4 * time.Hour))
+	if len(alerts) != 1 {
+		t.Fatal("stale job alerted again after restart:", alerts)
+	}
+
+	storage.Metadata.Save(&JobMetadata{TaskId: "ok", JobName: "job", Success: true, EndTime: now.Add(3 * time.Hour)})
+	stale, err := checker.CheckOnce(now.Add(3 * time.Hour))
+	if err != nil || len(stale) != 0 {
+		t.Fatal("job with fresh run is stale:", stale, err)
+	}
+	checker.CheckOnce(now.Add(5 * time.Hour))
+	if len(alerts) != 2 {
+		t.Fatal("job stale again must be alerted:", alerts)
+	}
+}
+
+func TestStalenessChecker_RetryFailedNotify(t *testing.T) {
+	storage, cleanup := replicationStorage(t)
+	defer cleanup()
+	cfg := NewConfig()
+	cfg.Jobs["job"] = &JobConfig{MaxStaleness: time.Hour}
+	checker := NewStalenessChecker(cfg, storage)
+	attempts := 0
+	checker.Notify = func(stale StaleJob) error {
+		attempts++
+		return errors.New("smtp down")
+	}
+	checker.CheckOnce(time.Now().Add(2 * time.Hour))
+	checker.CheckOnce(time.Now().Add(2 * time.Hour))
+	if attempts != 2 {
+		t.Fatal("failed notification must be retried, attempts:", attempts)
+	}
+}
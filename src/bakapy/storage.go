@@ -24,12 +24,24 @@ type StorageCurrentJob struct {
 	FileAddChan chan JobMetadataFile
 	Namespace   string
 	Gzip        bool
+	Dedup       bool
 }
 
 type Storage struct {
 	*StorageJobManager
 	RootDir     string
 	MetadataDir string
+	Metadata    MetadataStore
+	Artifacts   *ArtifactStore
+	Metrics     *Metrics
+	NotifyState *NotifyStateStore
+	Quota       StorageQuotaConfig
+	Dedup       *DedupStore
+	// Key required from other instances sending replicas here,
+	// resolved on each request
+	ReplicaKey  SecretString
+	Replication *Replicator
+	secretsDir  string
 	currentJobs map[TaskId]StorageCurrentJob
 	listenAddr  string
 	connections chan *StorageConn
@@ -37,15 +49,31 @@ type Storage struct {
 }
 
 func NewStorage(cfg *Config) *Storage {
-	return &Storage{
+	chunkDir := cfg.ChunkDir
+	if chunkDir == "" {
+		chunkDir = cfg.StorageDir + "_chunks"
+	}
+	stor := &Storage{
 		StorageJobManager: NewStorageJobManager(),
 		MetadataDir:       cfg.MetadataDir,
+		Metadata:          NewMetadataStore(cfg),
+		Artifacts:         NewArtifactStore(cfg),
+		Metrics:           NewMetrics(),
+		NotifyState:       NewNotifyStateStore(cfg),
 		RootDir:           cfg.StorageDir,
+		Quota:             cfg.Quota,
+		Dedup:             NewDedupStore(chunkDir),
+		ReplicaKey:        cfg.ReplicaKey,
+		secretsDir:        cfg.SecretsDir,
 		currentJobs:       make(map[TaskId]StorageCurrentJob),
 		connections:       make(chan *StorageConn),
 		listenAddr:        cfg.Listen,
 		logger:            logging.MustGetLogger("bakapy.storage"),
 	}
+	if len(cfg.Replicas) != 0 {
+		stor.Replication = NewReplicator(cfg, stor)
+	}
+	return stor
 }
 
 func (stor *Storage) Start() {
@@ -71,17 +99,17 @@ func (stor *Storage) Serve(ln net.Listener) {
 		}
 		stor.logger.Debug("new connection from %s", conn.RemoteAddr().String())
 
-		loggerName := fmt.Sprintf("bakapy.storage.conn[%s]", conn.RemoteAddr().String())
+		loggerName := LoggerName("bakapy.storage.conn", LogFields{RemoteAddr: conn.RemoteAddr().String()})
 		logger := logging.MustGetLogger(loggerName)
-		go func() {
+		go func(conn net.Conn) {
+			defer conn.Close()
 			err := stor.HandleConnection(NewStorageConn(conn, logger))
 			if err != nil {
 				stor.logger.Warning("Error during connection from %s: %s", conn.RemoteAddr(), err)
 			} else {
 				stor.logger.Info("connection from %s handled successfully", conn.RemoteAddr())
 			}
-
-		}()
+		}(conn)
 	}
 }
 
@@ -97,7 +125,18 @@ func (stor *Storage) HandleConnection(conn StorageProtocolHandler) error {
 	currentJob, exist := stor.GetJob(taskId)
 	if !exist {
 		msg := fmt.Sprintf("Cannot find task id '%s' in current job list, closing connection", taskId)
-		return errors.New(msg)
+		if stor.ReplicaKey == "" {
+			return errors.New(msg)
+		}
+		filename, err := conn.ReadFilename()
+		if err != nil {
+			msg := fmt.Sprintf("cannot read filename: %s. closing connection", err)
+			return errors.New(msg)
+		}
+		if filename != STORAGE_REPLICA_MAGIC {
+			return errors.New(msg)
+		}
+		return stor.handleReplica(taskId, conn)
 	}
 
 	stor.AddConnection(taskId)
@@ -114,22 +153,23 @@ func (stor *Storage) HandleConnection(conn StorageProtocolHandler) error {
 		return nil
 	}
 
-	fileSavePath := path.Join(
-		stor.RootDir,
-		currentJob.Namespace,
-		filename,
-	)
-
-	if currentJob.Gzip {
-		fileSavePath += ".gz"
-	}
+	fileSavePath := stor.filePath(currentJob.Namespace, filename, currentJob.Gzip)
 
 	fileMeta := JobMetadataFile{}
 	fileMeta.Name = filename
 	fileMeta.SourceAddr = conn.RemoteAddr().String()
 	fileMeta.StartTime = time.Now()
+	logger := logging.MustGetLogger(LoggerName("bakapy.storage", LogFields{
+		TaskId:     taskId,
+		RemoteAddr: fileMeta.SourceAddr,
+		File:       filename,
+	}))
+
+	if currentJob.Dedup {
+		return stor.saveDedup(conn, currentJob, fileMeta, logger)
+	}
 
-	stor.logger.Info("saving file %s", fileSavePath)
+	logger.Info("saving file %s", fileSavePath)
 	err = os.MkdirAll(path.Dir(fileSavePath), 0750)
 	if err != nil {
 		msg := fmt.Sprintf("cannot create file folder: %s", err)
@@ -142,31 +182,113 @@ func (stor *Storage) HandleConnection(conn StorageProtocolHandler) error {
 		return errors.New(msg)
 	}
 
-	var file io.WriteCloser
+	guard, err := stor.guardSpace(currentJob.Namespace, stor.RootDir, fd)
+	if err != nil {
+		fd.Close()
+		os.Remove(fileSavePath)
+		msg := fmt.Sprintf("cannot save file: %s. closing connection", err)
+		return errors.New(msg)
+	}
+
+	var file io.Writer
 	var gzWriter io.WriteCloser
 	if currentJob.Gzip {
-		gzWriter = gzip.NewWriter(fd)
+		gzWriter = gzip.NewWriter(guard)
 		file = gzWriter
 	} else {
-		file = fd
+		file = guard
 	}
 
 	stream := bufio.NewWriter(file)
 	written, err := conn.ReadContent(stream)
+	if err == nil {
+		err = stream.Flush()
+	}
+	if err == nil && currentJob.Gzip {
+		err = gzWriter.Close()
+	}
+	fd.Close()
 	if err != nil {
+		// do not leave partial file taking space
+		os.Remove(fileSavePath)
 		msg := fmt.Sprintf("cannot save file: %s. closing connection", err)
 		return errors.New(msg)
 	}
 
-	stream.Flush()
-	if currentJob.Gzip {
-		gzWriter.Close()
+	logger.Debug("sending metadata for file %s to job runner", fileMeta.Name)
+	stor.Metrics.AddReceived(written)
+	fileMeta.Size = written
+	fileMeta.EndTime = time.Now()
+	currentJob.FileAddChan <- fileMeta
+	return nil
+}
+
+// Save file content as dedup store chunks
+func (stor *Storage) saveDedup(conn StorageProtocolHandler, currentJob StorageCurrentJob, fileMeta JobMetadataFile, logger *logging.Logger) error {
+	chunks := NewChunkWriter(stor.Dedup)
+	guard, err := stor.guardSpace(currentJob.Namespace, stor.Dedup.RootDir, chunks)
+	if err != nil {
+		msg := fmt.Sprintf("cannot save file: %s. closing connection", err)
+		return errors.New(msg)
+	}
+	logger.Info("saving file %s/%s to dedup store", currentJob.Namespace, fileMeta.Name)
+	written, err := conn.ReadContent(guard)
+	if err == nil {
+		err = chunks.Close()
+	}
+	if err != nil {
+		msg := fmt.Sprintf("cannot save file: %s. closing connection", err)
+		return errors.New(msg)
 	}
-	fd.Close()
 
-	stor.logger.Debug("sending metadata for file %s to job runner", fileMeta.Name)
+	logger.Debug("sending metadata for file %s to job runner", fileMeta.Name)
+	stor.Metrics.AddReceived(written)
 	fileMeta.Size = written
+	fileMeta.Chunks = chunks.Chunks
 	fileMeta.EndTime = time.Now()
 	currentJob.FileAddChan <- fileMeta
 	return nil
 }
+
+// Write saved file content to output, assembling it from
+// dedup store chunks if needed. Gzipped files are written as is.
+func (stor *Storage) RestoreFile(metadata *JobMetadata, fileMeta JobMetadataFile, output io.Writer) (int64, error) {
+	file, _, err := stor.OpenFile(metadata, fileMeta)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return io.Copy(output, file)
+}
+
+// Open saved file for reading as RestoreFile writes it.
+// Returns content size.
+func (stor *Storage) OpenFile(metadata *JobMetadata, fileMeta JobMetadataFile) (io.ReadCloser, int64, error) {
+	if fileMeta.Chunks != nil {
+		reader, writer := io.Pipe()
+		go func() {
+			_, err := stor.Dedup.Restore(fileMeta.Chunks, writer)
+			writer.CloseWithError(err)
+		}()
+		return reader, fileMeta.Size, nil
+	}
+	file, err := os.Open(stor.filePath(metadata.Namespace, fileMeta.Name, metadata.Gzip))
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// Path of file saved to namespace, gzipped files have .gz suffix
+func (stor *Storage) filePath(namespace, filename string, gzip bool) string {
+	filePath := path.Join(stor.RootDir, namespace, filename)
+	if gzip {
+		filePath += ".gz"
+	}
+	return filePath
+}
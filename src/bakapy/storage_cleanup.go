@@ -1,6 +1,7 @@
 package bakapy
 
 import (
+	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
@@ -8,36 +9,175 @@ import (
 	"time"
 )
 
-func (stor *Storage) CleanupExpired() error {
-	jobMetadataList := map[string][]JobMetadata{}
-	corrupted := []string{}
-	corruptedDir := stor.MetadataDir + "_corrupted"
-	if err := os.MkdirAll(corruptedDir, 0755); err != nil {
-		return err
+// Tasks selected for removal by cleanup
+type CleanupPlan struct {
+	Tasks []JobMetadata
+	// Metadata files which cannot be loaded
+	Corrupted []string
+	// Jobs skipped due to last task failure, "job@host" for
+	// multi-host jobs
+	Skipped []string
+	// Why task removed before expiration, by metadata Key
+	Reasons map[string]string
+	// Metadata which may reference dedup chunks but is not loaded:
+	// saved by newer bakapy or moved to corrupted dir before. Files
+	// are listed by path, indexed store records by task id.
+	Unloaded []string
+	// Dedup store chunk references of tasks left after cleanup, nil
+	// if some metadata cannot be loaded and chunks are not collected
+	ChunkRefs map[string]int
+}
+
+// Storage paths of task files. Files saved to dedup store
+// have no own path and skipped.
+func (stor *Storage) TaskFiles(metadata JobMetadata) []string {
+	files := []string{}
+	for _, fileMeta := range metadata.Files {
+		if fileMeta.Chunks != nil {
+			continue
+		}
+		files = append(files, stor.filePath(metadata.Namespace, fileMeta.Name, metadata.Gzip))
 	}
+	return files
+}
 
-	visit := func(metaPath string, f os.FileInfo, err error) error {
-		if err != nil {
-			return err
+// Size of task files on disk, not including dedup chunks
+func (stor *Storage) TasksSize(tasks []JobMetadata) int64 {
+	var size int64
+	for _, metadata := range tasks {
+		for _, filePath := range stor.TaskFiles(metadata) {
+			if info, err := os.Stat(filePath); err == nil {
+				size += info.Size()
+			}
 		}
-		if f.IsDir() {
-			return nil
+	}
+	return size
+}
+
+// Dedup chunks referenced only by removed tasks
+func (plan *CleanupPlan) FreedChunks() []string {
+	freed := []string{}
+	if plan.ChunkRefs == nil {
+		return freed
+	}
+	seen := map[string]bool{}
+	for _, metadata := range plan.Tasks {
+		for _, fileMeta := range metadata.Files {
+			for _, hash := range fileMeta.Chunks {
+				if plan.ChunkRefs[hash] == 0 && !seen[hash] {
+					seen[hash] = true
+					freed = append(freed, hash)
+				}
+			}
 		}
-		metadata, err := LoadJobMetadata(metaPath)
-		if err != nil {
-			corrupted = append(corrupted, metaPath)
-			return nil
+	}
+	return freed
+}
+
+// Select expired tasks without removing anything
+func (stor *Storage) PlanCleanup() (*CleanupPlan, error) {
+	var metadatas []JobMetadata
+	var corrupted []string
+	var err error
+	if files, ok := stor.Metadata.(*FileMetadataStore); ok {
+		metadatas, corrupted, err = files.LoadAll()
+	} else {
+		metadatas, err = stor.Metadata.List(MetadataQuery{})
+	}
+	if err != nil {
+		return nil, err
+	}
+	plan := &CleanupPlan{Corrupted: corrupted, Reasons: map[string]string{}}
+
+	groupMetadataList := map[string][]JobMetadata{}
+	for _, metadata := range metadatas {
+		group := cleanupGroup(&metadata)
+		groupMetadataList[group] = append(groupMetadataList[group], metadata)
+	}
+	groupNames := []string{}
+	for groupName := range groupMetadataList {
+		groupNames = append(groupNames, groupName)
+	}
+	sort.Strings(groupNames)
+
+	// tasks still needed by policy of their job
+	wanted := map[string]bool{}
+	skipped := map[string]bool{}
+	for _, groupName := range groupNames {
+		groupMetadatas := groupMetadataList[groupName]
+		sort.Sort(MetadataSortByStartTime(groupMetadatas))
+
+		if !groupMetadatas[len(groupMetadatas)-1].Success {
+			plan.Skipped = append(plan.Skipped, groupName)
+			skipped[groupName] = true
+			continue
+		}
+
+		// retention policy of latest run is applied to all runs of group
+		retention := groupMetadatas[len(groupMetadatas)-1].Config.Retention
+		if retention.Enabled() {
+			for i := range retention.Select(groupMetadatas) {
+				wanted[groupMetadatas[i].Key()] = true
+			}
+			continue
+		}
+		for _, metadata := range groupMetadatas {
+			if time.Now().Before(metadata.ExpireTime) {
+				wanted[metadata.Key()] = true
+			}
 		}
-		metadata.Filepath = metaPath
-		jobMetadataList[metadata.JobName] = append(jobMetadataList[metadata.JobName], *metadata)
-		return nil
 	}
 
-	if err := filepath.Walk(stor.MetadataDir, visit); err != nil {
-		return err
+	// incremental backups are useless without their parents, so
+	// whole chain is removed when none of its backups is wanted.
+	// Chain may include backups of several jobs.
+	remaining := map[string][]BackupChain{}
+	for _, chain := range BuildBackupChains(metadatas) {
+		if chainSkipped(chain, skipped) {
+			continue
+		}
+		if chainKept(chain, wanted) {
+			group := cleanupGroup(chain.Root())
+			remaining[group] = append(remaining[group], chain)
+			continue
+		}
+		plan.Tasks = append(plan.Tasks, chain...)
+	}
+	stor.planQuotaCleanup(plan, remaining)
+
+	plan.Unloaded, err = stor.unloadedMetadataFiles()
+	if err != nil {
+		return nil, err
+	}
+	if len(plan.Corrupted) != 0 || len(plan.Unloaded) != 0 {
+		// chunks of unknown metadata may be still in use
+		return plan, nil
+	}
+	removed := map[string]bool{}
+	for _, metadata := range plan.Tasks {
+		removed[metadata.Key()] = true
+	}
+	plan.ChunkRefs = map[string]int{}
+	for _, metadata := range metadatas {
+		if removed[metadata.Key()] {
+			continue
+		}
+		for _, fileMeta := range metadata.Files {
+			for _, hash := range fileMeta.Chunks {
+				plan.ChunkRefs[hash]++
+			}
+		}
 	}
+	return plan, nil
+}
 
-	for _, metadataPath := range corrupted {
+// Remove tasks selected by plan and move corrupted metadata away
+func (stor *Storage) ApplyCleanup(plan *CleanupPlan) error {
+	corruptedDir := stor.MetadataDir + "_corrupted"
+	if err := os.MkdirAll(corruptedDir, 0755); err != nil {
+		return err
+	}
+	for _, metadataPath := range plan.Corrupted {
 		_, oldFilename := path.Split(metadataPath)
 		newFullPath := path.Join(corruptedDir, oldFilename)
 		stor.logger.Warning("moving corrupted metadata file %s to %s", metadataPath, newFullPath)
@@ -45,30 +185,152 @@ func (stor *Storage) CleanupExpired() error {
 			stor.logger.Warning("cannot move corrupted metadata file: %s", err)
 		}
 	}
+	for _, jobName := range plan.Skipped {
+		stor.logger.Warning("skipping cleanup for job %s due to last task failure", jobName)
+	}
+	for _, metadata := range plan.Tasks {
+		if reason, exist := plan.Reasons[metadata.Key()]; exist {
+			stor.logger.Warning("%s, removing task %s early", reason, metadata.TaskId)
+		}
+		if stor.Replication != nil {
+			if err := stor.Replication.Remove(metadata); err != nil {
+				stor.logger.Warning("cannot queue replica removal of task %s: %s", metadata.TaskId, err)
+			}
+		}
+		stor.removeTask(metadata)
+	}
 
-	for jobName, jobMetadatas := range jobMetadataList {
-		sort.Sort(MetadataSortByStartTime(jobMetadatas))
-
-		if !jobMetadatas[len(jobMetadatas)-1].Success {
-			stor.logger.Warning("skipping cleanup for job %s due to last task failure", jobName)
-			continue
+	if plan.ChunkRefs == nil {
+		if _, err := os.Stat(stor.Dedup.RootDir); err == nil {
+			stor.logger.Warning("dedup chunks not collected, metadata of %d tasks cannot be loaded", len(plan.Corrupted)+len(plan.Unloaded))
 		}
+		return nil
+	}
+	count, size, err := stor.Dedup.Collect(plan.ChunkRefs, DEDUP_GC_GRACE)
+	if err != nil {
+		return err
+	}
+	if count != 0 {
+		stor.logger.Info("%d unused dedup chunks removed, %d bytes freed", count, size)
+	}
+	return nil
+}
 
-		for _, metadata := range jobMetadatas {
-			if time.Now().Before(metadata.ExpireTime) {
-				continue
+func (stor *Storage) CleanupExpired() error {
+	plan, err := stor.PlanCleanup()
+	if err != nil {
+		return err
+	}
+	return stor.ApplyCleanup(plan)
+}
+
+// Metadata saved by newer bakapy and files in corrupted dir
+func (stor *Storage) unloadedMetadataFiles() ([]string, error) {
+	unloaded := []string{}
+	walk := func(dir string, newerOnly bool) error {
+		return filepath.Walk(dir, func(metaPath string, f os.FileInfo, err error) error {
+			if os.IsNotExist(err) {
+				return nil
 			}
-			for _, fileMeta := range metadata.Files {
-				dataFilePath := path.Join(stor.RootDir, metadata.Namespace, fileMeta.Name)
-				stor.logger.Info("removing file %s", dataFilePath)
-				if err := os.Remove(dataFilePath); err != nil {
-					stor.logger.Warning("failed to remove file %s: %s", dataFilePath, err)
-				}
+			if err != nil {
+				return err
 			}
-			if err := os.Remove(metadata.Filepath); err != nil {
-				stor.logger.Warning("failed to remove metadata file: %s", err)
+			if f.IsDir() {
+				return nil
 			}
+			if newerOnly {
+				data, err := ioutil.ReadFile(metaPath)
+				if err != nil {
+					return err
+				}
+				if _, err := metadataNeedsMigration(data); err == nil {
+					return nil
+				} else if _, newer := err.(*MetadataVersionError); !newer {
+					return nil
+				}
+			}
+			unloaded = append(unloaded, metaPath)
+			return nil
+		})
+	}
+	switch store := stor.Metadata.(type) {
+	case *FileMetadataStore:
+		if err := walk(store.Dir, true); err != nil {
+			return nil, err
+		}
+	case *IndexedMetadataStore:
+		taskIds, err := store.Newer()
+		if err != nil {
+			return nil, err
+		}
+		for _, taskId := range taskIds {
+			unloaded = append(unloaded, string(taskId))
 		}
 	}
-	return nil
+	if err := walk(stor.MetadataDir+"_corrupted", false); err != nil {
+		return nil, err
+	}
+	return unloaded, nil
+}
+
+// Runs of each host of multi-host job have own retention
+// and last run status
+func cleanupGroup(metadata *JobMetadata) string {
+	if metadata.Host == "" {
+		return metadata.JobName
+	}
+	return metadata.JobName + "@" + metadata.Host
+}
+
+func chainSkipped(chain BackupChain, skipped map[string]bool) bool {
+	for i := range chain {
+		if skipped[cleanupGroup(&chain[i])] {
+			return true
+		}
+	}
+	return false
+}
+
+func chainKept(chain BackupChain, kept map[string]bool) bool {
+	for _, metadata := range chain {
+		if kept[metadata.Key()] {
+			return true
+		}
+	}
+	return false
+}
+
+// Size of dedup chunks on disk
+func (stor *Storage) ChunksSize(chunks []string) int64 {
+	var size int64
+	for _, hash := range chunks {
+		if info, err := os.Stat(stor.Dedup.ChunkPath(hash)); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+func (stor *Storage) removeTask(metadata JobMetadata) {
+	for _, dataFilePath := range stor.TaskFiles(metadata) {
+		stor.logger.Info("removing file %s", dataFilePath)
+		info, statErr := os.Stat(dataFilePath)
+		if err := os.Remove(dataFilePath); err != nil {
+			stor.logger.Warning("failed to remove file %s: %s", dataFilePath, err)
+		} else if statErr == nil {
+			stor.Metrics.AddCleanupDeleted(info.Size())
+		}
+	}
+	var err error
+	if metadata.Filepath != "" {
+		err = os.Remove(metadata.Filepath)
+	} else {
+		err = stor.Metadata.Delete(metadata.TaskId)
+	}
+	if err != nil {
+		stor.logger.Warning("failed to remove metadata: %s", err)
+	}
+	if err := stor.Artifacts.Delete(metadata.TaskId); err != nil {
+		stor.logger.Warning("failed to remove artifacts: %s", err)
+	}
 }
@@ -1,6 +1,7 @@
 package bakapy
 
 import (
+	"bytes"
 	"io/ioutil"
 	"os"
 	"path"
@@ -46,8 +47,8 @@ func TestStorage_CleanupExpired_Behavior(t *testing.T) {
 		Success:    true,
 		ExpireTime: time.Now().Add(threeDays),
 		Files: []JobMetadataFile{
-			{"file3.txt", 0, "1.1.1.1", (time.Time{}), (time.Time{})},
-			{"file4.txt", 0, "1.1.1.1", (time.Time{}), (time.Time{})},
+			{Name: "file3.txt", SourceAddr: "1.1.1.1"},
+			{Name: "file4.txt", SourceAddr: "1.1.1.1"},
 		},
 	}).Save(m2f.Name())
 
@@ -67,8 +68,8 @@ func TestStorage_CleanupExpired_Behavior(t *testing.T) {
 		Success:    true,
 		ExpireTime: time.Date(1970, 1, 1, 1, 1, 1, 1, time.UTC),
 		Files: []JobMetadataFile{
-			{"file1.txt", 0, "1.1.1.1", (time.Time{}), (time.Time{})},
-			{"file2.txt", 0, "1.1.1.1", (time.Time{}), (time.Time{})},
+			{Name: "file1.txt", SourceAddr: "1.1.1.1"},
+			{Name: "file2.txt", SourceAddr: "1.1.1.1"},
 		},
 	}).Save(m1f.Name())
 
@@ -83,8 +84,8 @@ func TestStorage_CleanupExpired_Behavior(t *testing.T) {
 		Success:    true,
 		ExpireTime: time.Date(1970, 1, 1, 1, 1, 1, 1, time.UTC),
 		Files: []JobMetadataFile{
-			{"file5.txt", 0, "1.1.1.1", (time.Time{}), (time.Time{})},
-			{"file6.txt", 0, "1.1.1.1", (time.Time{}), (time.Time{})},
+			{Name: "file5.txt", SourceAddr: "1.1.1.1"},
+			{Name: "file6.txt", SourceAddr: "1.1.1.1"},
 		},
 	}).Save(m3f.Name())
 
@@ -152,3 +153,104 @@ func TestStorage_CleanupExpired_Behavior(t *testing.T) {
 	}
 
 }
+
+func TestStorage_PlanCleanup_DoesNotRemove(t *testing.T) {
+	config := NewConfig()
+	config.MetadataDir, _ = ioutil.TempDir("", "")
+	config.StorageDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(config.MetadataDir)
+	defer os.RemoveAll(config.StorageDir)
+	storage := NewStorage(config)
+
+	os.MkdirAll(path.Join(config.StorageDir, "ns"), 0755)
+	ioutil.WriteFile(path.Join(config.StorageDir, "ns", "file1.txt"), []byte("12345"), 0644)
+	metaPath := path.Join(config.MetadataDir, "expired")
+	(&JobMetadata{
+		TaskId:     "expired",
+		Namespace:  "ns",
+		JobName:    "job",
+		Success:    true,
+		ExpireTime: time.Now().Add(-time.Hour),
+		Files:      []JobMetadataFile{{Name: "file1.txt", Size: 5}},
+	}).Save(metaPath)
+	(&JobMetadata{
+		TaskId:     "active",
+		Namespace:  "ns",
+		JobName:    "job2",
+		Success:    true,
+		ExpireTime: time.Now().Add(time.Hour),
+	}).Save(path.Join(config.MetadataDir, "active"))
+
+	plan, err := storage.PlanCleanup()
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	if len(plan.Tasks) != 1 || plan.Tasks[0].TaskId != "expired" {
+		t.Fatal("bad plan tasks:", plan.Tasks)
+	}
+	if storage.TasksSize(plan.Tasks) != 5 {
+		t.Fatal("bad plan size:", storage.TasksSize(plan.Tasks))
+	}
+	files := storage.TaskFiles(plan.Tasks[0])
+	if len(files) != 1 || files[0] != path.Join(config.StorageDir, "ns", "file1.txt") {
+		t.Fatal("bad task files:", files)
+	}
+	if _, err := os.Stat(metaPath); err != nil {
+		t.Fatal("metadata removed by plan:", err)
+	}
+
+	if err := storage.ApplyCleanup(plan); err != nil {
+		t.Fatal("error:", err)
+	}
+	if _, err := os.Stat(metaPath); err == nil {
+		t.Fatal("metadata not removed by apply")
+	}
+	if _, err := os.Stat(files[0]); err == nil {
+		t.Fatal("file not removed by apply")
+	}
+}
+
+func TestStorage_CleanupGzipFiles(t *testing.T) {
+	storage, cleanup := replicationStorage(t)
+	defer cleanup()
+	fileCh := make(chan JobMetadataFile, 1)
+	storage.AddJob(&StorageCurrentJob{
+		TaskId:      TaskId("a70cb394-c22d-4fe7-a5cc-bc0a5e19a24c"),
+		FileAddChan: fileCh,
+		Namespace:   "ns",
+		Gzip:        true,
+	})
+	data := bytes.Repeat([]byte("compressible "), 1000)
+	if err := storage.HandleConnection(&NullStorageProtocol{filename: "dump.sql", content: data}); err != nil {
+		t.Fatal("error:", err)
+	}
+	metadata := &JobMetadata{
+		TaskId:     "expired",
+		JobName:    "job",
+		Namespace:  "ns",
+		Success:    true,
+		Gzip:       true,
+		ExpireTime: time.Now().Add(-time.Hour),
+		Files:      []JobMetadataFile{<-fileCh},
+	}
+	storage.SaveMetadata(metadata)
+
+	plan, err := storage.PlanCleanup()
+	if err != nil || len(plan.Tasks) != 1 {
+		t.Fatal("bad plan:", plan, err)
+	}
+	files := storage.TaskFiles(plan.Tasks[0])
+	info, err := os.Stat(path.Join(storage.RootDir, "ns", "dump.sql.gz"))
+	if err != nil || len(files) != 1 || files[0] != path.Join(storage.RootDir, "ns", "dump.sql.gz") {
+		t.Fatal("bad task files:", files, err)
+	}
+	if size := storage.TasksSize(plan.Tasks); size != info.Size() || size >= int64(len(data)) {
+		t.Fatal("bad plan size:", size, info.Size())
+	}
+	if err := storage.ApplyCleanup(plan); err != nil {
+		t.Fatal("error:", err)
+	}
+	if _, err := os.Stat(files[0]); err == nil {
+		t.Fatal("gzipped file not removed by apply")
+	}
+}
@@ -26,6 +26,7 @@ type StorageProtocolHandler interface {
 type StorageConn struct {
 	RemoteReader
 	currentJob StorageCurrentJob
+	taskId     TaskId
 	logger     *logging.Logger
 	State      StorageConnState
 }
@@ -56,7 +57,8 @@ func (sc *StorageConn) ReadTaskId() (TaskId, error) {
 	taskId := TaskId(taskIdBuf)
 	sc.logger.Debug("task id '%s' successfully readed.", taskId)
 	sc.State = STATE_WAIT_FILENAME
-	loggerName := fmt.Sprintf("bakapy.storage.conn[%s][%s]", sc.RemoteAddr().String(), taskId)
+	sc.taskId = taskId
+	loggerName := LoggerName("bakapy.storage.conn", LogFields{TaskId: taskId, RemoteAddr: sc.RemoteAddr().String()})
 	sc.logger = logging.MustGetLogger(loggerName)
 
 	return taskId, nil
@@ -90,6 +92,8 @@ func (sc *StorageConn) ReadFilename() (string, error) {
 		return "", errors.New(msg)
 	}
 	sc.logger.Debug("readed %d bytes: %s", readed, filename)
+	loggerName := LoggerName("bakapy.storage.conn", LogFields{TaskId: sc.taskId, RemoteAddr: sc.RemoteAddr().String(), File: string(filename)})
+	sc.logger = logging.MustGetLogger(loggerName)
 
 	sc.State = STATE_WAIT_DATA
 	return string(filename), nil
@@ -113,3 +117,13 @@ func (sc *StorageConn) ReadContent(output io.Writer) (int64, error) {
 	sc.State = STATE_END
 	return written, nil
 }
+
+// Send reply line to client, used by replication requests
+func (sc *StorageConn) Reply(msg string) error {
+	writer, ok := sc.RemoteReader.(io.Writer)
+	if !ok {
+		return errors.New("connection does not support replies")
+	}
+	_, err := io.WriteString(writer, msg+"\n")
+	return err
+}
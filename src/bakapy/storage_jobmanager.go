@@ -38,6 +38,17 @@ func (m *StorageJobManager) JobConnectionCount(taskId TaskId) int {
 	return count
 }
 
+// Connections of all jobs
+func (m *StorageJobManager) ConnectionCount() int {
+	m.connMu.RLock()
+	defer m.connMu.RUnlock()
+	total := 0
+	for _, count := range m.jobConnectionCount {
+		total += count
+	}
+	return total
+}
+
 func (m *StorageJobManager) AddJob(job *StorageCurrentJob) {
 	m.jobMu.Lock()
 	defer m.jobMu.Unlock()
@@ -0,0 +1,304 @@
+package bakapy
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Size in bytes, may be written in config with K, M, G or T suffix
+type ByteSize int64
+
+func ParseByteSize(value string) (ByteSize, error) {
+	value = strings.TrimSpace(value)
+	multipliers := map[string]int64{
+		"K": 1 << 10,
+		"M": 1 << 20,
+		"G": 1 << 30,
+		"T": 1 << 40,
+	}
+	multiplier := int64(1)
+	if len(value) > 0 {
+		if m, exist := multipliers[strings.ToUpper(value[len(value)-1:])]; exist {
+			multiplier = m
+			value = value[:len(value)-1]
+		}
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New(fmt.Sprintf("bad size '%s'", value))
+	}
+	return ByteSize(size * multiplier), nil
+}
+
+func (s *ByteSize) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw string
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	size, err := ParseByteSize(raw)
+	if err != nil {
+		return err
+	}
+	*s = size
+	return nil
+}
+
+type StorageQuotaConfig struct {
+	// Max size of namespace directory. Quota for namespace
+	// also covers all nested namespaces.
+	Namespaces map[string]ByteSize
+	// Uploads are aborted when storage free space drops below it
+	MinFree ByteSize `yaml:"min_free"`
+	// Remove oldest backups before expiration when quota is hit
+	ExpireEarly bool `yaml:"expire_early"`
+	// Backups per job never removed early, at least 1
+	MinKeep int `yaml:"min_keep"`
+}
+
+func (q StorageQuotaConfig) Validate() error {
+	if q.MinKeep < 0 {
+		return errors.New(fmt.Sprintf("storage_quota min_keep must not be negative, got %d", q.MinKeep))
+	}
+	return nil
+}
+
+// Returns quota and namespace it was defined for. Most specific
+// quota is used if there are several.
+func (q StorageQuotaConfig) NamespaceQuota(namespace string) (string, ByteSize, bool) {
+	namespace = path.Clean(namespace)
+	for {
+		if quota, exist := q.Namespaces[namespace]; exist {
+			return namespace, quota, true
+		}
+		parent := path.Dir(namespace)
+		if parent == namespace || parent == "." || parent == "/" {
+			return "", 0, false
+		}
+		namespace = parent
+	}
+}
+
+func inNamespace(namespace, quotaNamespace string) bool {
+	namespace = path.Clean(namespace)
+	return namespace == quotaNamespace || strings.HasPrefix(namespace, quotaNamespace+"/")
+}
+
+func dirSize(root string) (int64, error) {
+	var size int64
+	err := filepath.Walk(root, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+	return size, err
+}
+
+func freeSpace(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, err
+	}
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// Writer failing when namespace quota or storage free space exceeded
+type spaceGuardWriter struct {
+	output io.Writer
+	// bytes left in namespace quota, negative if no quota
+	quotaLeft  int64
+	minFree    int64
+	dir        string
+	sinceCheck int64
+	written    int64
+}
+
+func (w *spaceGuardWriter) Write(p []byte) (int, error) {
+	size := int64(len(p))
+	if w.quotaLeft >= 0 && w.written+size > w.quotaLeft {
+		return 0, errors.New("namespace quota exceeded")
+	}
+	if w.minFree > 0 {
+		w.sinceCheck += size
+		if w.sinceCheck >= STORAGE_SPACE_CHECK_INTERVAL {
+			w.sinceCheck = 0
+			if err := checkFreeSpace(w.dir, w.minFree, STORAGE_SPACE_CHECK_INTERVAL); err != nil {
+				return 0, err
+			}
+		}
+	}
+	n, err := w.output.Write(p)
+	w.written += int64(n)
+	return n, err
+}
+
+func checkFreeSpace(dir string, minFree int64, need int64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		return errors.New("cannot get free space: " + err.Error())
+	}
+	if free-need < minFree {
+		return errors.New(fmt.Sprintf("storage free space %d is below min_free %d", free, minFree))
+	}
+	return nil
+}
+
+// Bytes used by namespace: its directory and files of its tasks
+// saved to dedup store, counted by full size
+func (stor *Storage) namespaceSize(namespace string) (int64, error) {
+	size, err := dirSize(path.Join(stor.RootDir, namespace))
+	if err != nil {
+		return 0, err
+	}
+	metadatas, err := stor.Metadata.List(MetadataQuery{Namespace: namespace})
+	if err != nil {
+		return 0, err
+	}
+	for _, metadata := range metadatas {
+		for _, fileMeta := range metadata.Files {
+			if fileMeta.Chunks != nil {
+				size += fileMeta.Size
+			}
+		}
+	}
+	return size, nil
+}
+
+// Returns writer saving file of namespace to dir or error if there
+// is no space for it already.
+func (stor *Storage) guardSpace(namespace string, dir string, output io.Writer) (io.Writer, error) {
+	guard := &spaceGuardWriter{
+		output:    output,
+		quotaLeft: -1,
+		minFree:   int64(stor.Quota.MinFree),
+		dir:       dir,
+	}
+	if guard.minFree > 0 {
+		if err := checkFreeSpace(dir, guard.minFree, 0); err != nil {
+			return nil, err
+		}
+	}
+	quotaNamespace, quota, exist := stor.Quota.NamespaceQuota(namespace)
+	if !exist {
+		return guard, nil
+	}
+	used, err := stor.namespaceSize(quotaNamespace)
+	if err != nil {
+		return nil, errors.New("cannot get namespace size: " + err.Error())
+	}
+	if used >= int64(quota) {
+		return nil, errors.New(fmt.Sprintf("namespace %s quota exceeded: %d of %d bytes used", quotaNamespace, used, quota))
+	}
+	guard.quotaLeft = int64(quota) - used
+	return guard, nil
+}
+
+// Add oldest chains from remaining to cleanup plan until quotas
+// are satisfied. remaining contains not expired chains per job.
+func (stor *Storage) planQuotaCleanup(plan *CleanupPlan, remaining map[string][]BackupChain) {
+	if !stor.Quota.ExpireEarly {
+		return
+	}
+	planned := func(filter func(m *JobMetadata) bool) int64 {
+		var size int64
+		for _, m := range plan.Tasks {
+			if filter(&m) {
+				size += m.TotalSize
+			}
+		}
+		return size
+	}
+
+	namespaces := []string{}
+	for namespace := range stor.Quota.Namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		quota := int64(stor.Quota.Namespaces[namespace])
+		filter := func(m *JobMetadata) bool { return inNamespace(m.Namespace, namespace) }
+		used, err := stor.namespaceSize(namespace)
+		if err != nil {
+			stor.logger.Warning("cannot get namespace %s size: %s", namespace, err)
+			continue
+		}
+		used -= planned(filter)
+		if used > quota {
+			stor.expireOldest(plan, remaining, filter, used-quota, "namespace "+namespace+" quota exceeded")
+		}
+	}
+
+	if stor.Quota.MinFree > 0 {
+		free, err := freeSpace(stor.RootDir)
+		if err != nil {
+			stor.logger.Warning("cannot get storage free space: %s", err)
+			return
+		}
+		free += planned(func(m *JobMetadata) bool { return true })
+		if free < int64(stor.Quota.MinFree) {
+			all := func(m *JobMetadata) bool { return true }
+			stor.expireOldest(plan, remaining, all, int64(stor.Quota.MinFree)-free, "storage free space below min_free")
+		}
+	}
+}
+
+func (stor *Storage) expireOldest(plan *CleanupPlan, remaining map[string][]BackupChain, filter func(m *JobMetadata) bool, need int64, reason string) {
+	minKeep := stor.Quota.MinKeep
+	if minKeep < 1 {
+		minKeep = 1
+	}
+	successful := func(chains []BackupChain) int {
+		count := 0
+		for _, chain := range chains {
+			for _, m := range chain {
+				if m.Success {
+					count++
+				}
+			}
+		}
+		return count
+	}
+
+	for need > 0 {
+		oldestJob, oldestIdx := "", -1
+		for jobName, chains := range remaining {
+			for i, chain := range chains {
+				if !filter(chain.Root()) {
+					continue
+				}
+				left := append(append([]BackupChain{}, chains[:i]...), chains[i+1:]...)
+				if successful(left) < minKeep {
+					continue
+				}
+				if oldestIdx == -1 || chain.Root().StartTime.Before(remaining[oldestJob][oldestIdx].Root().StartTime) {
+					oldestJob, oldestIdx = jobName, i
+				}
+			}
+		}
+		if oldestIdx == -1 {
+			stor.logger.Warning("%s, but nothing can be removed early", reason)
+			return
+		}
+		chain := remaining[oldestJob][oldestIdx]
+		remaining[oldestJob] = append(remaining[oldestJob][:oldestIdx], remaining[oldestJob][oldestIdx+1:]...)
+		for _, m := range chain {
+			plan.Tasks = append(plan.Tasks, m)
+			plan.Reasons[m.Key()] = reason
+		}
+		need -= chain.TotalSize()
+	}
+}
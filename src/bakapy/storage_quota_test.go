@@ -0,0 +1,190 @@
+package bakapy
+
+import (
+	"gopkg.in/yaml.v3"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]ByteSize{
+		"100": 100,
+		"2K":  2048,
+		"3m":  3 * 1048576,
+		"1G":  1073741824,
+		"1T":  1099511627776,
+	}
+	for value, expected := range cases {
+		size, err := ParseByteSize(value)
+		if err != nil || size != expected {
+			t.Fatal("bad size for", value, size, err)
+		}
+	}
+	if _, err := ParseByteSize("1.5G"); err == nil || err.Error() != "bad size '1.5'" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestStorageQuotaConfig_Yaml(t *testing.T) {
+	cfg := NewConfig()
+	err := yaml.Unmarshal([]byte("storage_quota:\n  min_free: 10G\n  namespaces:\n    vhosts: 500\n"), cfg)
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	if cfg.Quota.MinFree != 10*1073741824 || cfg.Quota.Namespaces["vhosts"] != 500 {
+		t.Fatal("bad quota config:", cfg.Quota)
+	}
+}
+
+func TestStorageQuotaConfig_NamespaceQuota(t *testing.T) {
+	quota := StorageQuotaConfig{Namespaces: map[string]ByteSize{"vhosts": 10, "vhosts/big": 20}}
+	ns, size, exist := quota.NamespaceQuota("vhosts/web1")
+	if !exist || ns != "vhosts" || size != 10 {
+		t.Fatal("bad quota:", ns, size, exist)
+	}
+	ns, size, exist = quota.NamespaceQuota("vhosts/big/web1")
+	if !exist || ns != "vhosts/big" || size != 20 {
+		t.Fatal("bad quota:", ns, size, exist)
+	}
+	if _, _, exist = quota.NamespaceQuota("vhostsother"); exist {
+		t.Fatal("quota must not match other namespace")
+	}
+}
+
+func quotaStorage(t *testing.T, quota StorageQuotaConfig) (*Storage, func()) {
+	cfg := NewConfig()
+	cfg.StorageDir, _ = ioutil.TempDir("", "")
+	cfg.MetadataDir, _ = ioutil.TempDir("", "")
+	cfg.Quota = quota
+	storage := NewStorage(cfg)
+	storage.AddJob(&StorageCurrentJob{
+		TaskId:      TaskId("a70cb394-c22d-4fe7-a5cc-bc0a5e19a24c"),
+		FileAddChan: make(chan JobMetadataFile, 20),
+		Namespace:   "ns/web1",
+	})
+	return storage, func() {
+		os.RemoveAll(cfg.StorageDir)
+		os.RemoveAll(cfg.MetadataDir)
+	}
+}
+
+func TestStorage_HandleConnection_QuotaExceededOnWrite(t *testing.T) {
+	storage, cleanup := quotaStorage(t, StorageQuotaConfig{Namespaces: map[string]ByteSize{"ns": 10}})
+	defer cleanup()
+
+	err := storage.HandleConnection(&NullStorageProtocol{filename: "big.txt", content: []byte("12345678901")})
+	if err == nil || !strings.Contains(err.Error(), "namespace quota exceeded") {
+		t.Fatal("bad error:", err)
+	}
+	if _, err := os.Stat(path.Join(storage.RootDir, "ns", "web1", "big.txt")); err == nil {
+		t.Fatal("partial file not removed")
+	}
+
+	err = storage.HandleConnection(&NullStorageProtocol{filename: "small.txt", content: []byte("1234567890")})
+	if err != nil {
+		t.Fatal("file within quota not saved:", err)
+	}
+}
+
+func TestStorage_HandleConnection_QuotaAlreadyExceeded(t *testing.T) {
+	storage, cleanup := quotaStorage(t, StorageQuotaConfig{Namespaces: map[string]ByteSize{"ns": 10}})
+	defer cleanup()
+	os.MkdirAll(path.Join(storage.RootDir, "ns", "web2"), 0755)
+	ioutil.WriteFile(path.Join(storage.RootDir, "ns", "web2", "old.txt"), []byte("1234567890"), 0644)
+
+	protohandle := &NullStorageProtocol{filename: "new.txt", content: []byte("1")}
+	err := storage.HandleConnection(protohandle)
+	if err == nil || !strings.Contains(err.Error(), "namespace ns quota exceeded: 10 of 10 bytes used") {
+		t.Fatal("bad error:", err)
+	}
+	if protohandle.readContentCalled {
+		t.Fatal("content read while quota exceeded")
+	}
+}
+
+func TestStorage_HandleConnection_DedupQuota(t *testing.T) {
+	storage, cleanup := quotaStorage(t, StorageQuotaConfig{Namespaces: map[string]ByteSize{"ns": 10}})
+	defer cleanup()
+	defer os.RemoveAll(storage.Dedup.RootDir)
+	storage.AddJob(&StorageCurrentJob{
+		TaskId:      TaskId("a70cb394-c22d-4fe7-a5cc-bc0a5e19a24c"),
+		FileAddChan: make(chan JobMetadataFile, 20),
+		Namespace:   "ns/web1",
+		Dedup:       true,
+	})
+
+	err := storage.HandleConnection(&NullStorageProtocol{filename: "big.txt", content: []byte("12345678901")})
+	if err == nil || !strings.Contains(err.Error(), "namespace quota exceeded") {
+		t.Fatal("bad error:", err)
+	}
+
+	// dedup files of saved tasks are counted in namespace usage
+	(&JobMetadata{
+		TaskId:    "old",
+		Namespace: "ns/web2",
+		Files:     []JobMetadataFile{{Name: "old.txt", Size: 10, Chunks: []string{"0123"}}},
+	}).Save(path.Join(storage.MetadataDir, "old"))
+	protohandle := &NullStorageProtocol{filename: "new.txt", content: []byte("1")}
+	err = storage.HandleConnection(protohandle)
+	if err == nil || !strings.Contains(err.Error(), "namespace ns quota exceeded: 10 of 10 bytes used") {
+		t.Fatal("bad error:", err)
+	}
+	if protohandle.readContentCalled {
+		t.Fatal("content read while quota exceeded")
+	}
+}
+
+func TestStorage_HandleConnection_MinFree(t *testing.T) {
+	storage, cleanup := quotaStorage(t, StorageQuotaConfig{MinFree: 1 << 62})
+	defer cleanup()
+	err := storage.HandleConnection(&NullStorageProtocol{filename: "new.txt", content: []byte("1")})
+	if err == nil || !strings.Contains(err.Error(), "is below min_free") {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestStorage_PlanCleanup_ExpireEarly(t *testing.T) {
+	storage, cleanup := quotaStorage(t, StorageQuotaConfig{
+		Namespaces:  map[string]ByteSize{"ns": 25},
+		ExpireEarly: true,
+		MinKeep:     2,
+	})
+	defer cleanup()
+	os.MkdirAll(path.Join(storage.RootDir, "ns"), 0755)
+
+	for i, name := range []string{"one", "two", "three", "four"} {
+		ioutil.WriteFile(path.Join(storage.RootDir, "ns", name), []byte("1234567890"), 0644)
+		(&JobMetadata{
+			TaskId:     TaskId(name),
+			JobName:    "job",
+			Namespace:  "ns",
+			Success:    true,
+			TotalSize:  10,
+			StartTime:  time.Now().Add(time.Duration(i) * time.Hour),
+			ExpireTime: time.Now().Add(time.Hour * 24),
+			Files:      []JobMetadataFile{{Name: name, Size: 10}},
+		}).Save(path.Join(storage.MetadataDir, name))
+	}
+
+	plan, err := storage.PlanCleanup()
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	// 40 bytes used, 2 oldest removed to fit 25 bytes quota
+	if len(plan.Tasks) != 2 || plan.Tasks[0].TaskId != "one" || plan.Tasks[1].TaskId != "two" {
+		t.Fatal("bad plan:", plan.Tasks)
+	}
+	if plan.Reasons[plan.Tasks[0].Key()] != "namespace ns quota exceeded" {
+		t.Fatal("bad reason:", plan.Reasons)
+	}
+
+	storage.Quota.Namespaces["ns"] = 5
+	plan, _ = storage.PlanCleanup()
+	if len(plan.Tasks) != 2 {
+		t.Fatal("min_keep backups removed:", plan.Tasks)
+	}
+}
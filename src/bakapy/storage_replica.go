@@ -0,0 +1,187 @@
+package bakapy
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path"
+	"strings"
+)
+
+type storageReplier interface {
+	Reply(msg string) error
+}
+
+func safeRelPath(p string) bool {
+	clean := path.Clean(p)
+	return !path.IsAbs(p) && clean != ".." && !strings.HasPrefix(clean, "../")
+}
+
+// Accepts only files listed in replicated metadata
+type replicaFilesHandler struct {
+	storage  *Storage
+	expected map[string]bool
+}
+
+func (h *replicaFilesHandler) HandleConnection(conn StorageProtocolHandler) error {
+	filename, err := conn.ReadFilename()
+	if err != nil {
+		return err
+	}
+	if !h.expected[filename] {
+		return errors.New("unexpected replica file " + filename)
+	}
+	return h.storage.HandleConnection(conn)
+}
+
+// Receive request sent by BakapyReplica and reply with result
+func (stor *Storage) handleReplica(taskId TaskId, conn StorageProtocolHandler) error {
+	reader, writer := io.Pipe()
+	go func() {
+		_, err := conn.ReadContent(writer)
+		writer.CloseWithError(err)
+	}()
+	err := stor.receiveReplica(taskId, conn.RemoteAddr(), bufio.NewReader(reader))
+	// client waits for reply after whole request sent
+	io.Copy(ioutil.Discard, reader)
+
+	reply := "OK"
+	if err != nil {
+		reply = "ERROR " + strings.Replace(err.Error(), "\n", " ", -1)
+	}
+	if replier, ok := conn.(storageReplier); ok {
+		if replyErr := replier.Reply(reply); err == nil {
+			err = replyErr
+		}
+	}
+	return err
+}
+
+func (stor *Storage) receiveReplica(taskId TaskId, remoteAddr net.Addr, stream *bufio.Reader) error {
+	rawRequest, err := stream.ReadBytes('\n')
+	if err != nil {
+		return errors.New("cannot read replica request: " + err.Error())
+	}
+	request := replicaRequest{}
+	if err := json.Unmarshal(rawRequest, &request); err != nil {
+		return errors.New("cannot parse replica request: " + err.Error())
+	}
+	replicaKey, err := stor.ReplicaKey.Resolve(stor.secretsDir)
+	if err != nil {
+		return errors.New("cannot resolve replica key: " + err.Error())
+	}
+	if replicaKey == "" || subtle.ConstantTimeCompare([]byte(request.Key), []byte(replicaKey)) != 1 {
+		return errors.New("bad replica key")
+	}
+	metadata := &request.Metadata
+	if metadata.TaskId != taskId {
+		return errors.New("replica metadata task id mismatch")
+	}
+	if !safeRelPath(metadata.Namespace) {
+		return errors.New("bad replica namespace '" + metadata.Namespace + "'")
+	}
+	switch request.Command {
+	case replicaCommandRemove:
+		stored, err := stor.Metadata.Get(taskId)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		stor.logger.Info("removing replica of task %s", taskId)
+		if stor.Replication != nil {
+			if err := stor.Replication.Remove(*stored); err != nil {
+				stor.logger.Warning("cannot queue replica removal: %s", err)
+			}
+		}
+		stor.removeTask(*stored)
+		return nil
+	case replicaCommandPut:
+	default:
+		return errors.New("unknown replica command '" + request.Command + "'")
+	}
+
+	// replicas of replicas come back to the origin, stop the loop here
+	if _, err := stor.Metadata.Get(taskId); err == nil {
+		stor.logger.Info("replica of task %s already stored", taskId)
+		return nil
+	}
+	if err := stor.receiveReplicaFiles(metadata, remoteAddr, stream); err != nil {
+		return err
+	}
+	if err := stor.SaveMetadata(metadata); err != nil {
+		return errors.New("cannot save replica metadata: " + err.Error())
+	}
+	stor.logger.Info("replica of task %s saved", taskId)
+	if stor.Replication != nil {
+		if err := stor.Replication.Enqueue(taskId); err != nil {
+			stor.logger.Warning("cannot queue replication of task %s: %s", taskId, err)
+		}
+	}
+	return nil
+}
+
+// Save replica files and update metadata with local dedup chunks
+func (stor *Storage) receiveReplicaFiles(metadata *JobMetadata, remoteAddr net.Addr, stream io.Reader) error {
+	handler := &replicaFilesHandler{storage: stor, expected: map[string]bool{}}
+	dedup := false
+	for _, fileMeta := range metadata.Files {
+		name := replicaFileName(metadata, fileMeta)
+		if !safeRelPath(name) {
+			return errors.New("bad replica file name '" + name + "'")
+		}
+		handler.expected[name] = true
+		dedup = dedup || fileMeta.Chunks != nil
+	}
+
+	fileAddChan := make(chan JobMetadataFile, 20)
+	received := map[string]JobMetadataFile{}
+	collected := make(chan bool)
+	go func() {
+		for fileMeta := range fileAddChan {
+			received[fileMeta.Name] = fileMeta
+		}
+		close(collected)
+	}()
+	stor.AddJob(&StorageCurrentJob{
+		TaskId:      metadata.TaskId,
+		FileAddChan: fileAddChan,
+		Namespace:   metadata.Namespace,
+		Dedup:       dedup,
+	})
+	err := NewStreamDemuxer(metadata.TaskId, handler, remoteAddr.String()).Demux(stream)
+	stor.RemoveJob(metadata.TaskId)
+	close(fileAddChan)
+	<-collected
+
+	for i, fileMeta := range metadata.Files {
+		if err != nil {
+			break
+		}
+		name := replicaFileName(metadata, fileMeta)
+		got, exist := received[name]
+		switch {
+		case !exist:
+			err = errors.New("replica file " + name + " not received")
+		case name == fileMeta.Name && got.Size != fileMeta.Size:
+			err = errors.New("replica file " + name + " size mismatch")
+		default:
+			metadata.Files[i].Chunks = got.Chunks
+		}
+	}
+	if err != nil {
+		for name, fileMeta := range received {
+			if fileMeta.Chunks == nil {
+				os.Remove(path.Join(stor.RootDir, metadata.Namespace, name))
+			}
+		}
+		return err
+	}
+	return nil
+}
@@ -23,8 +23,8 @@ func (p *NullStorageProtocol) ReadTaskId() (TaskId, error) {
 func (p *NullStorageProtocol) ReadFilename() (string, error) { return p.filename, nil }
 func (p *NullStorageProtocol) ReadContent(output io.Writer) (int64, error) {
 	p.readContentCalled = true
-	output.Write(p.content)
-	return int64(len(p.content)), nil
+	n, err := output.Write(p.content)
+	return int64(n), err
 }
 func (p *NullStorageProtocol) RemoteAddr() net.Addr { return dummyAddr("1.1.1.1") }
 
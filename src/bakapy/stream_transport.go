@@ -0,0 +1,246 @@
+package bakapy
+
+import (
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+)
+
+// Job file transports
+const (
+	TRANSPORT_TCP    = "tcp"
+	TRANSPORT_STDOUT = "stdout"
+)
+
+type StorageConnHandler interface {
+	HandleConnection(conn StorageProtocolHandler) error
+}
+
+type streamAddr string
+
+func (a streamAddr) Network() string { return "stream" }
+func (a streamAddr) String() string  { return string(a) }
+
+// One file received from stream, passed to storage
+// as regular storage connection.
+type streamConn struct {
+	taskId     TaskId
+	filename   string
+	content    io.Reader
+	remoteAddr net.Addr
+}
+
+func (c *streamConn) ReadTaskId() (TaskId, error)   { return c.taskId, nil }
+func (c *streamConn) ReadFilename() (string, error) { return c.filename, nil }
+func (c *streamConn) RemoteAddr() net.Addr          { return c.remoteAddr }
+
+func (c *streamConn) ReadContent(output io.Writer) (int64, error) {
+	written, err := io.Copy(output, c.content)
+	if err != nil {
+		msg := fmt.Sprintf("read file content error: %s", err)
+		return written, errors.New(msg)
+	}
+	return written, nil
+}
+
+type streamFile struct {
+	name    string
+	content *io.PipeWriter
+	done    chan error
+	err     error
+}
+
+// Splits job stdout into script output and files. Stream consists of frames:
+// type byte, payload length as STREAM_FRAME_LEN_LEN decimal digits
+// and payload. File is sent as STREAM_FRAME_FILE frame with file name,
+// STREAM_FRAME_DATA frames with content and STREAM_FRAME_END frame.
+type StreamDemuxer struct {
+	TaskId     TaskId
+	Handler    StorageConnHandler
+	Output     io.Writer
+	RemoteAddr net.Addr
+	logger     *logging.Logger
+}
+
+func NewStreamDemuxer(taskId TaskId, handler StorageConnHandler, remoteAddr string) *StreamDemuxer {
+	return &StreamDemuxer{
+		TaskId:     taskId,
+		Handler:    handler,
+		Output:     ioutil.Discard,
+		RemoteAddr: streamAddr(remoteAddr),
+		logger:     logging.MustGetLogger("bakapy.stream"),
+	}
+}
+
+func (d *StreamDemuxer) startFile(name string) *streamFile {
+	reader, writer := io.Pipe()
+	file := &streamFile{
+		name:    name,
+		content: writer,
+		done:    make(chan error, 1),
+	}
+	conn := &streamConn{
+		taskId:     d.TaskId,
+		filename:   name,
+		content:    reader,
+		remoteAddr: d.RemoteAddr,
+	}
+	go func() {
+		err := d.Handler.HandleConnection(conn)
+		// unblock writer if storage stopped reading
+		reader.CloseWithError(errors.New("storage connection closed"))
+		file.done <- err
+	}()
+	return file
+}
+
+func (d *StreamDemuxer) Demux(stream io.Reader) error {
+	var current *streamFile
+	var failed error
+	header := make([]byte, 1+STREAM_FRAME_LEN_LEN)
+
+	abort := func(err error) error {
+		if current != nil {
+			current.content.CloseWithError(err)
+			<-current.done
+		}
+		return err
+	}
+
+	for {
+		_, err := io.ReadFull(stream, header)
+		if err == io.EOF {
+			if current != nil {
+				return abort(errors.New("stream closed while receiving file " + current.name))
+			}
+			return failed
+		}
+		if err != nil {
+			return abort(errors.New("cannot read frame header: " + err.Error()))
+		}
+
+		length, err := strconv.ParseInt(string(header[1:]), 10, 64)
+		if err != nil || length < 0 {
+			return abort(errors.New(fmt.Sprintf("bad frame length %q", header[1:])))
+		}
+		payload := io.LimitReader(stream, length)
+
+		switch header[0] {
+		case STREAM_FRAME_OUTPUT:
+			_, err = io.Copy(d.Output, payload)
+		case STREAM_FRAME_FILE:
+			if current != nil {
+				return abort(errors.New("new file started while receiving file " + current.name))
+			}
+			var name []byte
+			name, err = ioutil.ReadAll(payload)
+			if err == nil {
+				d.logger.Debug("receiving file %s", name)
+				current = d.startFile(string(name))
+			}
+		case STREAM_FRAME_DATA:
+			if current == nil {
+				return abort(errors.New("file data received without file"))
+			}
+			if current.err == nil {
+				_, current.err = io.Copy(current.content, payload)
+			}
+		case STREAM_FRAME_END:
+			if current == nil {
+				return abort(errors.New("file end received without file"))
+			}
+			current.content.Close()
+			err := <-current.done
+			if err == nil {
+				err = current.err
+			}
+			if err != nil {
+				d.logger.Warning("cannot save file %s: %s", current.name, err)
+				if failed == nil {
+					failed = errors.New("cannot save file " + current.name + ": " + err.Error())
+				}
+			}
+			current = nil
+		default:
+			return abort(errors.New(fmt.Sprintf("unknown frame type %q", header[0])))
+		}
+		if err != nil {
+			return abort(errors.New("cannot read frame: " + err.Error()))
+		}
+
+		// skip rest of payload if it was not consumed
+		if _, err := io.Copy(ioutil.Discard, payload); err != nil {
+			return abort(errors.New("cannot read frame: " + err.Error()))
+		}
+	}
+}
+
+// Returns writer for job stdout and channel with demultiplexing result,
+// available after writer closed.
+func (d *StreamDemuxer) Start() (*io.PipeWriter, chan error) {
+	reader, writer := io.Pipe()
+	result := make(chan error, 1)
+	go func() {
+		err := d.Demux(reader)
+		// do not block job if stream broken
+		io.Copy(ioutil.Discard, reader)
+		result <- err
+	}()
+	return writer, result
+}
+
+// Run execute with stdout demultiplexed by stream
+func executeWithStream(stream *StreamDemuxer, execute func([]byte, io.Writer, io.Writer) error, script []byte, output io.Writer, errput io.Writer) error {
+	if stream == nil {
+		return errors.New("stdout transport used but storage stream not set")
+	}
+	stream.Output = output
+	streamWriter, streamResult := stream.Start()
+	err := execute(script, streamWriter, errput)
+	streamWriter.Close()
+	streamErr := <-streamResult
+	if err != nil {
+		return err
+	}
+	if streamErr != nil {
+		return errors.New("stream transport error: " + streamErr.Error())
+	}
+	return nil
+}
+
+func writeStreamFrame(w io.Writer, frameType byte, payload []byte) error {
+	if _, err := fmt.Fprintf(w, "%c%0*d", frameType, STREAM_FRAME_LEN_LEN, len(payload)); err != nil {
+		return err
+	}
+	_, err := w.Write(payload)
+	return err
+}
+
+// Write file as stream frames, returns content size
+func writeStreamFile(w io.Writer, name string, content io.Reader) (int64, error) {
+	if err := writeStreamFrame(w, STREAM_FRAME_FILE, []byte(name)); err != nil {
+		return 0, err
+	}
+	var written int64
+	buf := make([]byte, STREAM_CHUNK_SIZE)
+	for {
+		n, err := io.ReadFull(content, buf)
+		if n > 0 {
+			if err := writeStreamFrame(w, STREAM_FRAME_DATA, buf[:n]); err != nil {
+				return written, err
+			}
+			written += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			break
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, writeStreamFrame(w, STREAM_FRAME_END, nil)
+}
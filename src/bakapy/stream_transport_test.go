@@ -0,0 +1,195 @@
+package bakapy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type TestStreamHandler struct {
+	mu    sync.Mutex
+	files map[string]string
+	err   error
+}
+
+func (h *TestStreamHandler) HandleConnection(conn StorageProtocolHandler) error {
+	if h.err != nil {
+		return h.err
+	}
+	filename, _ := conn.ReadFilename()
+	content := new(bytes.Buffer)
+	_, err := conn.ReadContent(content)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.files[filename] = content.String()
+	return nil
+}
+
+func streamFrame(frameType byte, payload string) string {
+	return fmt.Sprintf("%c%08d%s", frameType, len(payload), payload)
+}
+
+func TestStreamDemuxer_Demux_Ok(t *testing.T) {
+	handler := &TestStreamHandler{files: map[string]string{}}
+	output := new(bytes.Buffer)
+	demuxer := NewStreamDemuxer("taskid", handler, "web1")
+	demuxer.Output = output
+
+	stream := streamFrame('O', "hello ") +
+		streamFrame('F', "one.txt") +
+		streamFrame('D', "first ") +
+		streamFrame('D', "second") +
+		streamFrame('E', "") +
+		streamFrame('F', "two.txt") +
+		streamFrame('E', "") +
+		streamFrame('O', "world")
+
+	err := demuxer.Demux(strings.NewReader(stream))
+	if err != nil {
+		t.Fatal("Error:", err)
+	}
+	if output.String() != "hello world" {
+		t.Fatal("bad output:", output.String())
+	}
+	if handler.files["one.txt"] != "first second" {
+		t.Fatal("bad one.txt content:", handler.files["one.txt"])
+	}
+	if content, exist := handler.files["two.txt"]; !exist || content != "" {
+		t.Fatal("empty two.txt not saved")
+	}
+}
+
+func TestStreamDemuxer_Demux_UnknownFrame(t *testing.T) {
+	handler := &TestStreamHandler{files: map[string]string{}}
+	demuxer := NewStreamDemuxer("taskid", handler, "web1")
+	err := demuxer.Demux(strings.NewReader(streamFrame('X', "wow")))
+	if err == nil || err.Error() != "unknown frame type 'X'" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestStreamDemuxer_Demux_BadLength(t *testing.T) {
+	handler := &TestStreamHandler{files: map[string]string{}}
+	demuxer := NewStreamDemuxer("taskid", handler, "web1")
+	err := demuxer.Demux(strings.NewReader("Oabcdefghwow"))
+	if err == nil || err.Error() != `bad frame length "abcdefgh"` {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestStreamDemuxer_Demux_StreamClosedInFile(t *testing.T) {
+	handler := &TestStreamHandler{files: map[string]string{}}
+	demuxer := NewStreamDemuxer("taskid", handler, "web1")
+	stream := streamFrame('F', "one.txt") + streamFrame('D', "first")
+	err := demuxer.Demux(strings.NewReader(stream))
+	if err == nil || err.Error() != "stream closed while receiving file one.txt" {
+		t.Fatal("bad error:", err)
+	}
+	if _, exist := handler.files["one.txt"]; exist {
+		t.Fatal("incomplete file must not be saved")
+	}
+}
+
+func TestStreamDemuxer_Demux_StorageFailed(t *testing.T) {
+	handler := &TestStreamHandler{err: errors.New("Oops")}
+	output := new(bytes.Buffer)
+	demuxer := NewStreamDemuxer("taskid", handler, "web1")
+	demuxer.Output = output
+	stream := streamFrame('F', "one.txt") +
+		streamFrame('D', strings.Repeat("x", 100000)) +
+		streamFrame('E', "") +
+		streamFrame('O', "after")
+	err := demuxer.Demux(strings.NewReader(stream))
+	if err == nil || err.Error() != "cannot save file one.txt: Oops" {
+		t.Fatal("bad error:", err)
+	}
+	if output.String() != "after" {
+		t.Fatal("stream must be read after storage failure, output:", output.String())
+	}
+}
+
+func TestBashExecutor_Execute_StdoutTransport(t *testing.T) {
+	cfg := NewConfig()
+	cfg.StorageDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(cfg.StorageDir)
+	cfg.CommandDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(cfg.CommandDir)
+	storage := NewStorage(cfg)
+
+	ioutil.WriteFile(path.Join(cfg.CommandDir, "stream.cmd"), []byte(`
+echo "starting"
+echo -n hello | _send_file one.txt
+head -c 3000000 /dev/zero | _send_file big.bin
+echo "finished"
+`), 0644)
+
+	executor := NewBashExecutor(map[string]string{}, "", 0, false)
+	executor.Transport = TRANSPORT_STDOUT
+	jConfig := &JobConfig{Command: "stream.cmd", Namespace: "ns", Transport: TRANSPORT_STDOUT}
+	job := NewJob("stream", jConfig, "127.0.0.1:1", cfg.CommandDir, storage, executor)
+	executor.SetStream(job.TaskId, storage)
+
+	m := job.Run()
+	if !m.Success {
+		t.Fatal("job failed:", m.Message, string(m.Errput))
+	}
+	if string(m.Output) != "starting\nfinished\n" {
+		t.Fatalf("bad output: %q", m.Output)
+	}
+
+	content, err := ioutil.ReadFile(path.Join(cfg.StorageDir, "ns", "one.txt"))
+	if err != nil || string(content) != "hello" {
+		t.Fatal("bad one.txt:", string(content), err)
+	}
+	stat, err := os.Stat(path.Join(cfg.StorageDir, "ns", "big.bin"))
+	if err != nil || stat.Size() != 3000000 {
+		t.Fatal("bad big.bin:", stat, err)
+	}
+	if m.TotalSize != 3000005 {
+		t.Fatal("bad total size:", m.TotalSize)
+	}
+}
+
+func TestBashExecutor_Execute_StdoutTransportFailedScript(t *testing.T) {
+	handler := &TestStreamHandler{files: map[string]string{}}
+	commandDir, _ := ioutil.TempDir("", "")
+	defer os.RemoveAll(commandDir)
+	ioutil.WriteFile(path.Join(commandDir, "fail.cmd"), []byte("echo partial output\nfalse\necho never\n"), 0644)
+	jConfig := &JobConfig{Command: "fail.cmd", Transport: TRANSPORT_STDOUT}
+	job := NewJob("stream", jConfig, "127.0.0.1:1", commandDir, &TestJober{}, &TestOkExecutor{})
+	script, err := job.getScript("127.0.0.1:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	executor := NewBashExecutor(map[string]string{}, "", 0, false)
+	executor.Transport = TRANSPORT_STDOUT
+	executor.SetStream("taskid", handler)
+	output := new(bytes.Buffer)
+	errput := new(bytes.Buffer)
+	err = executor.Execute(script, output, errput)
+	if err == nil || err.Error() != "exit status 1" {
+		t.Fatal("bad error:", err)
+	}
+	if output.String() != "partial output\n" {
+		t.Fatalf("output of failed script must be sent, got %q", output)
+	}
+}
+
+func TestBashExecutor_Execute_StdoutTransportNoStream(t *testing.T) {
+	executor := NewBashExecutor(map[string]string{}, "", 0, false)
+	executor.Transport = TRANSPORT_STDOUT
+	err := executor.Execute([]byte("true"), new(bytes.Buffer), new(bytes.Buffer))
+	if err == nil || err.Error() != "stdout transport used but storage stream not set" {
+		t.Fatal("bad error:", err)
+	}
+}
@@ -0,0 +1,401 @@
+package bakapy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Other bakapy instance runs are pulled from
+type SyncSourceConfig struct {
+	URL      string
+	Key      SecretString
+	Interval time.Duration
+}
+
+func (s *SyncSourceConfig) Sanitize() error {
+	if s.URL == "" {
+		return errors.New("sync_from url required")
+	}
+	if s.Interval == 0 {
+		s.Interval = SYNC_DEFAULT_INTERVAL
+	}
+	return nil
+}
+
+func safeTaskId(taskId TaskId) bool {
+	return taskId != "" && !strings.ContainsAny(string(taskId), "/\\") && !strings.HasPrefix(string(taskId), ".")
+}
+
+// Serves metadata list and files content for other instances
+// pulling runs with SyncClient. Requests must have
+// "Authorization: Bearer <sync_key>" header, key is resolved
+// on each request.
+type SyncHandler struct {
+	storage    *Storage
+	key        SecretString
+	secretsDir string
+	logger     *logging.Logger
+}
+
+func NewSyncHandler(storage *Storage, key SecretString, secretsDir string) *SyncHandler {
+	return &SyncHandler{
+		storage:    storage,
+		key:        key,
+		secretsDir: secretsDir,
+		logger:     logging.MustGetLogger("bakapy.sync"),
+	}
+}
+
+func (h *SyncHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	key, err := h.key.Resolve(h.secretsDir)
+	if err != nil {
+		h.logger.Error("cannot resolve sync key: %s", err)
+		http.Error(w, "cannot resolve sync key", http.StatusInternalServerError)
+		return
+	}
+	auth := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+	if key == "" || subtle.ConstantTimeCompare(auth, []byte(key)) != 1 {
+		http.Error(w, "bad sync key", http.StatusForbidden)
+		return
+	}
+	switch r.URL.Path {
+	case "/sync/metadata":
+		h.serveMetadata(w)
+	case "/sync/task":
+		h.serveTask(w, TaskId(r.FormValue("task")))
+	case "/sync/file":
+		h.serveFile(w, TaskId(r.FormValue("task")), r.FormValue("file"))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (h *SyncHandler) serveMetadata(w http.ResponseWriter) {
+	metadatas, err := h.storage.Metadata.List(MetadataQuery{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadatas)
+}
+
+// Metadata of one task with artifacts inline
+func (h *SyncHandler) serveTask(w http.ResponseWriter, taskId TaskId) {
+	if !safeTaskId(taskId) {
+		http.Error(w, "bad task id", http.StatusBadRequest)
+		return
+	}
+	metadata, err := h.storage.Metadata.Get(taskId)
+	if os.IsNotExist(err) {
+		http.Error(w, "task not found", http.StatusNotFound)
+		return
+	}
+	if err == nil {
+		err = h.storage.Artifacts.Inline(metadata)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(metadata)
+}
+
+// Files are served as RestoreFile writes them, size is sent
+// in header and sha256 of content in trailer.
+func (h *SyncHandler) serveFile(w http.ResponseWriter, taskId TaskId, name string) {
+	if !safeTaskId(taskId) {
+		http.Error(w, "bad task id", http.StatusBadRequest)
+		return
+	}
+	metadata, err := h.storage.Metadata.Get(taskId)
+	if os.IsNotExist(err) {
+		http.Error(w, "task not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var fileMeta *JobMetadataFile
+	for i := range metadata.Files {
+		if metadata.Files[i].Name == name {
+			fileMeta = &metadata.Files[i]
+		}
+	}
+	if fileMeta == nil {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
+	content, size, err := h.storage.OpenFile(metadata, *fileMeta)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer content.Close()
+
+	w.Header().Set("Trailer", SYNC_CHECKSUM_HEADER)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(SYNC_SIZE_HEADER, strconv.FormatInt(size, 10))
+	checksum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, checksum), content); err != nil {
+		// no checksum trailer, client will reject file
+		h.logger.Warning("cannot send file %s of task %s: %s", name, taskId, err)
+		return
+	}
+	w.Header().Set(SYNC_CHECKSUM_HEADER, hex.EncodeToString(checksum.Sum(nil)))
+}
+
+type SyncClient struct {
+	URL    string
+	Key    string
+	Client *http.Client
+}
+
+func NewSyncClient(source SyncSourceConfig, secretsDir string) (*SyncClient, error) {
+	key, err := source.Key.Resolve(secretsDir)
+	if err != nil {
+		return nil, err
+	}
+	return &SyncClient{URL: source.URL, Key: key}, nil
+}
+
+func (c *SyncClient) get(endpoint string, query url.Values) (*http.Response, error) {
+	req, err := http.NewRequest("GET", strings.TrimRight(c.URL, "/")+endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.Key)
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, errors.New(fmt.Sprintf("%s: %s", resp.Status, strings.TrimSpace(string(message))))
+	}
+	return resp, nil
+}
+
+func (c *SyncClient) ListMetadata() ([]JobMetadata, error) {
+	resp, err := c.get("/sync/metadata", url.Values{})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	metadatas := []JobMetadata{}
+	if err := json.NewDecoder(resp.Body).Decode(&metadatas); err != nil {
+		return nil, errors.New("cannot parse metadata list: " + err.Error())
+	}
+	return metadatas, nil
+}
+
+// Task metadata with script, output and errput
+func (c *SyncClient) FetchMetadata(taskId TaskId) (*JobMetadata, error) {
+	resp, err := c.get("/sync/task", url.Values{"task": {string(taskId)}})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	metadata := &JobMetadata{}
+	if err := json.NewDecoder(resp.Body).Decode(metadata); err != nil {
+		return nil, errors.New("cannot parse metadata: " + err.Error())
+	}
+	if metadata.TaskId != taskId {
+		return nil, errors.New("metadata task id mismatch")
+	}
+	return metadata, nil
+}
+
+// Write file content to output, verifying its size and checksum
+func (c *SyncClient) FetchFile(taskId TaskId, name string, output io.Writer) (int64, error) {
+	resp, err := c.get("/sync/file", url.Values{"task": {string(taskId)}, "file": {name}})
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	checksum := sha256.New()
+	written, err := io.Copy(io.MultiWriter(output, checksum), resp.Body)
+	if err != nil {
+		return written, err
+	}
+	return written, verifySyncFile(resp, written, checksum)
+}
+
+func verifySyncFile(resp *http.Response, written int64, checksum hash.Hash) error {
+	size, err := strconv.ParseInt(resp.Header.Get(SYNC_SIZE_HEADER), 10, 64)
+	if err != nil {
+		return errors.New("bad file size header: " + err.Error())
+	}
+	if written != size {
+		return errors.New(fmt.Sprintf("size mismatch, received %d of %d bytes", written, size))
+	}
+	expected := resp.Trailer.Get(SYNC_CHECKSUM_HEADER)
+	if expected == "" {
+		return errors.New("no checksum received, file sending failed")
+	}
+	if expected != hex.EncodeToString(checksum.Sum(nil)) {
+		return errors.New("checksum mismatch")
+	}
+	return nil
+}
+
+// Fetch runs missing locally. Files are saved to namespace layout,
+// dedup files of other instance are saved as regular files.
+// Expired runs and runs local cleanup would remove are not fetched.
+// Returns fetched task ids.
+func (stor *Storage) SyncFrom(client *SyncClient) ([]TaskId, error) {
+	metadatas, err := client.ListMetadata()
+	if err != nil {
+		return nil, errors.New("cannot list metadata: " + err.Error())
+	}
+	local, err := stor.Metadata.List(MetadataQuery{})
+	if err != nil {
+		return nil, errors.New("cannot list local metadata: " + err.Error())
+	}
+	fetched := []TaskId{}
+	missing, failed := 0, 0
+	for i := range metadatas {
+		metadata := &metadatas[i]
+		if !safeTaskId(metadata.TaskId) {
+			stor.logger.Warning("skipping task with bad id '%s'", metadata.TaskId)
+			continue
+		}
+		if !metadata.ExpireTime.IsZero() && metadata.ExpireTime.Before(time.Now()) {
+			continue
+		}
+		if _, err := stor.Metadata.Get(metadata.TaskId); err == nil {
+			continue
+		}
+		if syncUnwanted(metadata, local) {
+			stor.logger.Debug("skipping task %s not kept by local retention policy", metadata.TaskId)
+			continue
+		}
+		missing++
+		stor.logger.Info("fetching task %s of job %s from %s", metadata.TaskId, metadata.JobName, client.URL)
+		if err := stor.syncTask(client, metadata); err != nil {
+			stor.logger.Warning("cannot fetch task %s: %s", metadata.TaskId, err)
+			failed++
+			continue
+		}
+		fetched = append(fetched, metadata.TaskId)
+		local = append(local, *metadata)
+		if stor.Replication != nil {
+			if err := stor.Replication.Enqueue(metadata.TaskId); err != nil {
+				stor.logger.Warning("cannot queue replication of task %s: %s", metadata.TaskId, err)
+			}
+		}
+	}
+	if failed != 0 {
+		return fetched, errors.New(fmt.Sprintf("%d of %d missing tasks failed to sync", failed, missing))
+	}
+	return fetched, nil
+}
+
+// Run missing locally is not kept by retention policy of its job
+// here and has no chained backups here, so it was removed by local
+// cleanup or would be removed after fetching
+func syncUnwanted(metadata *JobMetadata, local []JobMetadata) bool {
+	group := cleanupGroup(metadata)
+	runs := []JobMetadata{*metadata}
+	for i := range local {
+		if local[i].ParentTaskId == metadata.TaskId || (metadata.ParentTaskId != "" && local[i].TaskId == metadata.ParentTaskId) {
+			return false
+		}
+		if cleanupGroup(&local[i]) == group {
+			runs = append(runs, local[i])
+		}
+	}
+	sort.Sort(MetadataSortByStartTime(runs))
+	latest := runs[len(runs)-1]
+	if !latest.Success || !latest.Config.Retention.Enabled() {
+		return false
+	}
+	for i := range latest.Config.Retention.Select(runs) {
+		if runs[i].TaskId == metadata.TaskId {
+			return false
+		}
+	}
+	return true
+}
+
+func (stor *Storage) syncTask(client *SyncClient, metadata *JobMetadata) error {
+	if !safeRelPath(metadata.Namespace) {
+		return errors.New("bad namespace '" + metadata.Namespace + "'")
+	}
+	if len(metadata.Artifacts) != 0 {
+		full, err := client.FetchMetadata(metadata.TaskId)
+		if err != nil {
+			return errors.New("cannot fetch metadata: " + err.Error())
+		}
+		metadata = full
+	}
+	saved := []string{}
+	for _, fileMeta := range metadata.Files {
+		name := replicaFileName(metadata, fileMeta)
+		if !safeRelPath(name) {
+			return errors.New("bad file name '" + name + "'")
+		}
+		filePath := path.Join(stor.RootDir, metadata.Namespace, name)
+		err := stor.syncFile(client, metadata, fileMeta, filePath)
+		if err != nil {
+			for _, savedPath := range saved {
+				os.Remove(savedPath)
+			}
+			return errors.New(fmt.Sprintf("file %s: %s", fileMeta.Name, err))
+		}
+		saved = append(saved, filePath)
+	}
+	return stor.SaveMetadata(replicaMetadata(metadata))
+}
+
+func (stor *Storage) syncFile(client *SyncClient, metadata *JobMetadata, fileMeta JobMetadataFile, filePath string) error {
+	if err := os.MkdirAll(path.Dir(filePath), 0750); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(path.Dir(filePath), ".tmp-")
+	if err != nil {
+		return err
+	}
+	guard, err := stor.guardSpace(metadata.Namespace, stor.RootDir, tmp)
+	if err == nil {
+		var written int64
+		written, err = client.FetchFile(metadata.TaskId, fileMeta.Name, guard)
+		// gzipped files are fetched compressed, their size is unknown
+		if err == nil && replicaFileName(metadata, fileMeta) == fileMeta.Name && written != fileMeta.Size {
+			err = errors.New(fmt.Sprintf("size %d differs from metadata size %d", written, fileMeta.Size))
+		}
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filePath)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
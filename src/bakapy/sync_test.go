@@ -0,0 +1,192 @@
+package bakapy
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func syncTestServer(t *testing.T, storage *Storage) *httptest.Server {
+	cfg := NewConfig()
+	cfg.HTTP.SyncKey = "secret"
+	return httptest.NewServer(NewHTTPHandler(cfg, storage))
+}
+
+func TestSyncFrom(t *testing.T) {
+	remote, remoteCleanup := replicationStorage(t)
+	defer remoteCleanup()
+	saveReplicaTestTask(t, remote, "hello")
+	// dedup file is fetched as regular file
+	data := randomData(4, 1048576)
+	(&JobMetadata{
+		TaskId:    "dedup",
+		JobName:   "dedup",
+		Namespace: "other",
+		Success:   true,
+		Files:     []JobMetadataFile{{Name: "data.bin", Size: int64(len(data)), Chunks: chunkData(t, remote.Dedup, data)}},
+	}).Save(path.Join(remote.MetadataDir, "dedup"))
+	(&JobMetadata{
+		TaskId:     "expired",
+		JobName:    "job",
+		ExpireTime: time.Now().Add(-time.Hour),
+	}).Save(path.Join(remote.MetadataDir, "expired"))
+	server := syncTestServer(t, remote)
+	defer server.Close()
+
+	local, localCleanup := replicationStorage(t)
+	defer localCleanup()
+	fetched, err := local.SyncFrom(&SyncClient{URL: server.URL, Key: "secret"})
+	if err != nil {
+		t.Fatal("error:", err)
+	}
+	if len(fetched) != 2 {
+		t.Fatal("bad fetched list:", fetched)
+	}
+	content, _ := ioutil.ReadFile(path.Join(local.RootDir, "ns", "dump.sql"))
+	if string(content) != "hello" {
+		t.Fatal("bad file content:", string(content))
+	}
+	content, _ = ioutil.ReadFile(path.Join(local.RootDir, "other", "data.bin"))
+	if !bytes.Equal(content, data) {
+		t.Fatal("bad dedup file content")
+	}
+	metadata, err := LoadJobMetadata(path.Join(local.MetadataDir, "dedup"))
+	if err != nil || metadata.Files[0].Chunks != nil {
+		t.Fatal("bad metadata:", metadata, err)
+	}
+
+	fetched, err = local.SyncFrom(&SyncClient{URL: server.URL, Key: "secret"})
+	if err != nil || len(fetched) != 0 {
+		t.Fatal("existing tasks fetched again:", fetched, err)
+	}
+}
+
+func TestSyncFrom_BadKey(t *testing.T) {
+	remote, remoteCleanup := replicationStorage(t)
+	defer remoteCleanup()
+	server := syncTestServer(t, remote)
+	defer server.Close()
+
+	local, localCleanup := replicationStorage(t)
+	defer localCleanup()
+	_, err := local.SyncFrom(&SyncClient{URL: server.URL, Key: "wrong"})
+	if err == nil || err.Error() != "cannot list metadata: 403 Forbidden: bad sync key" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestSyncFrom_SizeMismatch(t *testing.T) {
+	remote, remoteCleanup := replicationStorage(t)
+	defer remoteCleanup()
+	metadata := saveReplicaTestTask(t, remote, "hello")
+	metadata.Files[0].Size = 10
+	metadata.Save(path.Join(remote.MetadataDir, string(metadata.TaskId)))
+	server := syncTestServer(t, remote)
+	defer server.Close()
+
+	local, localCleanup := replicationStorage(t)
+	defer localCleanup()
+	_, err := local.SyncFrom(&SyncClient{URL: server.URL, Key: "secret"})
+	if err == nil || err.Error() != "1 of 1 missing tasks failed to sync" {
+		t.Fatal("bad error:", err)
+	}
+	if _, err := os.Stat(path.Join(local.MetadataDir, string(metadata.TaskId))); err == nil {
+		t.Fatal("metadata of failed task saved")
+	}
+}
+
+func TestSyncClient_ChecksumMismatch(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", SYNC_CHECKSUM_HEADER)
+		w.Header().Set(SYNC_SIZE_HEADER, "5")
+		w.Write([]byte("hello"))
+		w.Header().Set(SYNC_CHECKSUM_HEADER, "0000")
+	}))
+	defer server.Close()
+	client := &SyncClient{URL: server.URL}
+	_, err := client.FetchFile("task", "file", ioutil.Discard)
+	if err == nil || err.Error() != "checksum mismatch" {
+		t.Fatal("bad error:", err)
+	}
+}
+
+func TestSyncHandler_BadTaskId(t *testing.T) {
+	storage, cleanup := replicationStorage(t)
+	defer cleanup()
+	server := syncTestServer(t, storage)
+	defer server.Close()
+	client := &SyncClient{URL: server.URL, Key: "secret"}
+	_, err := client.FetchFile("../etc", "passwd", ioutil.Discard)
+	if err == nil || !strings.HasPrefix(err.Error(), "400 Bad Request") {
+		t.Fatal("bad error:", err)
+	}
+	_, err = client.FetchMetadata("../metadata")
+	if err == nil || !strings.HasPrefix(err.Error(), "400 Bad Request") {
+		t.Fatal("bad error for task:", err)
+	}
+}
+
+func TestSyncFrom_Artifacts(t *testing.T) {
+	remote, remoteCleanup := replicationStorage(t)
+	defer remoteCleanup()
+	metadata := saveReplicaTestTask(t, remote, "hello")
+	metadata.Output = []byte("dumped")
+	remote.SaveMetadata(metadata)
+	server := syncTestServer(t, remote)
+	defer server.Close()
+
+	local, localCleanup := replicationStorage(t)
+	defer localCleanup()
+	if _, err := local.SyncFrom(&SyncClient{URL: server.URL, Key: "secret"}); err != nil {
+		t.Fatal("error:", err)
+	}
+	synced, err := local.Metadata.Get(metadata.TaskId)
+	if err != nil || len(synced.Artifacts) != 1 {
+		t.Fatal("bad synced metadata:", synced, err)
+	}
+	local.Artifacts.Inline(synced)
+	if string(synced.Output) != "dumped" {
+		t.Fatal("bad synced output:", string(synced.Output))
+	}
+}
+
+func TestSyncFrom_LocalRetention(t *testing.T) {
+	remote, remoteCleanup := replicationStorage(t)
+	defer remoteCleanup()
+	removed := saveReplicaTestTask(t, remote, "hello")
+	removed.StartTime = time.Now().Add(-2 * time.Hour)
+	removed.ExpireTime = time.Time{}
+	removed.Save(path.Join(remote.MetadataDir, string(removed.TaskId)))
+	server := syncTestServer(t, remote)
+	defer server.Close()
+
+	local, localCleanup := replicationStorage(t)
+	defer localCleanup()
+	kept := &JobMetadata{
+		TaskId:    "kept",
+		JobName:   "job",
+		Namespace: "ns",
+		Success:   true,
+		StartTime: time.Now().Add(-time.Hour),
+		Config:    JobConfig{Retention: RetentionConfig{KeepLast: 1}},
+	}
+	local.SaveMetadata(kept)
+	fetched, err := local.SyncFrom(&SyncClient{URL: server.URL, Key: "secret"})
+	if err != nil || len(fetched) != 0 {
+		t.Fatal("run removed by local retention fetched:", fetched, err)
+	}
+
+	// runs kept by policy are fetched
+	kept.Config.Retention.KeepLast = 2
+	local.SaveMetadata(kept)
+	fetched, err = local.SyncFrom(&SyncClient{URL: server.URL, Key: "secret"})
+	if err != nil || len(fetched) != 1 || fetched[0] != removed.TaskId {
+		t.Fatal("bad fetched list:", fetched, err)
+	}
+}
@@ -1,48 +1,45 @@
 package bakapy
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/op/go-logging"
-	"log/syslog"
 	"net/smtp"
-	"os"
 	"os/user"
-	"path"
 	"strings"
+	"sync"
+	"text/template"
 )
 
-func SetupLogging(logLevel string) error {
-	format := "%{level:.8s} %{module} %{message}"
-	stderrBackend := logging.NewLogBackend(os.Stderr, "", 0)
-	syslogBackend, err := logging.NewSyslogBackendPriority("", syslog.LOG_CRIT|syslog.LOG_DAEMON)
-	if err != nil {
-		return err
-	}
-
-	logging.SetBackend(stderrBackend, syslogBackend)
-	logging.SetFormatter(logging.MustStringFormatter(format))
-	level, err := logging.LogLevel(strings.ToUpper(logLevel))
-	if err != nil {
-		return err
-	}
-	logging.SetLevel(level, "")
-	return nil
-}
-
 type NotificationTemplateContext struct {
-	From    string
-	To      string
-	Subject string
-	JobName string
-	Message string
-	Output  string
-	Errput  string
+	From        string
+	To          string
+	Subject     string
+	ContentType string
+	JobName     string
+	Host        string
+	Event       string
+	Message     string
+	Output      string
+	Errput      string
 }
 
-func SendFailedJobNotification(cfg SMTPConfig, meta *JobMetadata) error {
-	curUser, err := user.Current()
-	if err != nil {
-		return err
+// Mail recipients, From and To default to current user name.
+// Password reference is resolved on each mail.
+func sendNotification(cfg SMTPConfig, secretsDir string, to []string, tmpl *template.Template, ctx NotificationTemplateContext) error {
+	from := cfg.From
+	if from == "" || len(to) == 0 {
+		curUser, err := user.Current()
+		if err != nil {
+			return err
+		}
+		if from == "" {
+			from = curUser.Name
+		}
+		if len(to) == 0 {
+			to = []string{curUser.Name}
+		}
 	}
 
 	if cfg.Host == "" {
@@ -58,30 +55,49 @@ func SendFailedJobNotification(cfg SMTPConfig, meta *JobMetadata) error {
 	if err != nil {
 		return err
 	}
+	defer conn.Close()
 
-	err = conn.Mail(curUser.Name)
-	if err != nil {
-		return err
+	if cfg.StartTLS {
+		if ok, _ := conn.Extension("STARTTLS"); !ok {
+			return errors.New("smtp server " + addr + " does not support STARTTLS")
+		}
+		err = conn.StartTLS(&tls.Config{ServerName: cfg.Host})
+		if err != nil {
+			return err
+		}
 	}
 
-	err = conn.Rcpt(curUser.Name)
+	if cfg.Username != "" {
+		password, err := cfg.Password.Resolve(secretsDir)
+		if err != nil {
+			return errors.New("smtp: " + err.Error())
+		}
+		err = conn.Auth(smtp.PlainAuth("", cfg.Username, password, cfg.Host))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = conn.Mail(from)
 	if err != nil {
 		return err
 	}
 
+	for _, rcpt := range to {
+		err = conn.Rcpt(rcpt)
+		if err != nil {
+			return err
+		}
+	}
+
 	ds, err := conn.Data()
 	if err != nil {
 		return err
 	}
 
-	err = MAIL_TEMPLATE_JOB_FAILED.Execute(ds, NotificationTemplateContext{
-		From:    curUser.Name,
-		To:      curUser.Name,
-		Subject: fmt.Sprintf("[bakapy] job %s failed", meta.JobName),
-		Message: meta.Message,
-		Output:  string(meta.Output),
-		Errput:  string(meta.Errput),
-	})
+	ctx.From = from
+	ctx.To = strings.Join(to, ", ")
+	err = tmpl.Execute(ds, ctx)
 	if err != nil {
 		return err
 	}
@@ -98,32 +114,140 @@ func SendFailedJobNotification(cfg SMTPConfig, meta *JobMetadata) error {
 	return nil
 }
 
-func RunJob(jobName string, jConfig *JobConfig, gConfig *Config, storage *Storage) string {
+// Create executor configured by job config
+func NewExecutor(args map[string]string, secrets []string, jConfig *JobConfig) Executer {
+	if jConfig.Driver != "" {
+		return NewDriverExecutor(jConfig.Driver, args)
+	}
+	switch jConfig.Executor {
+	case "ssh":
+		sshExecutor := NewSSHExecutor(args, jConfig.Host, jConfig.Port, jConfig.Sudo, jConfig.SSH)
+		sshExecutor.Secrets = secrets
+		sshExecutor.Transport = jConfig.Transport
+		return sshExecutor
+	case "docker":
+		dockerExecutor := NewDockerExecutor(args, jConfig.Host, jConfig.Port, jConfig.Sudo, jConfig.Container)
+		dockerExecutor.Secrets = secrets
+		dockerExecutor.Transport = jConfig.Transport
+		return dockerExecutor
+	default:
+		bashExecutor := NewBashExecutor(args, jConfig.Host, jConfig.Port, jConfig.Sudo)
+		bashExecutor.Secrets = secrets
+		bashExecutor.Transport = jConfig.Transport
+		return bashExecutor
+	}
+}
+
+func RunJob(jobName string, jConfig *JobConfig, gConfig *Config, storage *Storage) TaskId {
 	logger := logging.MustGetLogger("bakapy.job")
+	args, secrets, argsErr := ResolveArgs(jConfig.Args, gConfig.SecretsDir)
 	executor := jConfig.executor
 	if executor == nil {
-		executor = NewBashExecutor(jConfig.Args, jConfig.Host, jConfig.Port, jConfig.Sudo)
+		executor = NewExecutor(args, secrets, jConfig)
 	}
 	job := NewJob(
 		jobName, jConfig, gConfig.Listen,
 		gConfig.CommandDir, storage, executor,
 	)
-	metadata := job.Run()
-	saveTo := path.Join(gConfig.MetadataDir, string(metadata.TaskId))
-	err := metadata.Save(saveTo)
+	job.secrets = secrets
+	job.backupType = BackupTypeFromArgs(jConfig.Args)
+	logger = logging.MustGetLogger(LoggerName("bakapy.job", LogFields{Job: jobName, TaskId: job.TaskId}))
+	StartRunLog(job.TaskId)
+	if job.backupType == BACKUP_TYPE_DIFF || job.backupType == BACKUP_TYPE_INC {
+		metadatas, err := storage.Metadata.List(MetadataQuery{Namespace: jConfig.Namespace})
+		if err != nil {
+			logger.Warning("cannot load metadata to find backup chain parent: %s", err)
+		}
+		chainKey := BackupChainKey(jobName, jConfig.Namespace, jConfig.Host, jConfig.Args)
+		job.parentTaskId = FindChainParent(metadatas, chainKey, job.backupType)
+		if job.parentTaskId == "" {
+			logger.Warning("no parent backup found for %s backup of job %s", job.backupType, jobName)
+		}
+	}
+	if streamer, ok := executor.(StreamExecuter); ok {
+		streamer.SetStream(job.TaskId, storage)
+	}
+
+	storage.Metrics.JobStarted(jobName)
+	var metadata *JobMetadata
+	if argsErr != nil {
+		logger.Warning("cannot resolve job args: %s", argsErr)
+		metadata = job.newMetadata()
+		metadata.Message = argsErr.Error()
+		metadata.EndTime = metadata.StartTime
+	} else {
+		metadata = job.Run()
+	}
+	storage.Metrics.JobFinished(metadata)
+	metadata.Log = StopRunLog(job.TaskId)
+	stateKey := NotifyStateKey(jobName, jConfig.Host)
+	var events []string
+	failures := 0
+	err := storage.NotifyState.Update(stateKey, func(state *NotifyState) {
+		events = state.RunFinished(metadata, jConfig)
+		failures = state.Failures
+	})
+	if err != nil {
+		logger.Warning("cannot update notification state of job %s: %s", jobName, err)
+		events = []string{EVENT_FAILURE}
+		if metadata.Success {
+			events = []string{EVENT_SUCCESS}
+		}
+	}
+	err = storage.SaveMetadata(metadata)
 	if err != nil {
 		logger.Critical("cannot save metadata: %s", err)
+	} else {
+		logger.Info("metadata for job %s successfully saved", metadata.TaskId)
 	}
-	logger.Info("metadata for job %s successfully saved to %s", metadata.TaskId, saveTo)
-	if !metadata.Success {
-		logger.Debug("sending failed job notification to current user")
-		if err := SendFailedJobNotification(gConfig.SMTP, metadata); err != nil {
-			logger.Critical("cannot send failed job notification: %s", err.Error())
+	if err == nil && metadata.Success && storage.Replication != nil {
+		if err := storage.Replication.Enqueue(metadata.TaskId); err != nil {
+			logger.Critical("cannot queue replication of task %s: %s", metadata.TaskId, err)
 		}
-
+	}
+	router := NewNotificationRouter(gConfig)
+	for _, event := range events {
+		n := NewJobNotification(event, metadata)
+		n.Failures = failures
+		err := router.Send(jConfig, n)
+		if event == EVENT_FAILURE && err == nil {
+			err = storage.NotifyState.Update(stateKey, func(state *NotifyState) {
+				state.Alerted(metadata.EndTime)
+			})
+			if err != nil {
+				logger.Warning("cannot update notification state of job %s: %s", jobName, err)
+			}
+		}
+	}
+	if !metadata.Success {
 		logger.Critical("job '%s' failed", job.Name)
 	} else {
 		logger.Info("job '%s' finished", job.Name)
 	}
-	return saveTo
+	return metadata.TaskId
+}
+
+// Run job on every host from its hosts list, at most jConfig.Parallel
+// at the same time. Returns task ids in hosts order.
+func RunJobHosts(jobName string, jConfig *JobConfig, gConfig *Config, storage *Storage) []TaskId {
+	hostConfigs := jConfig.ExpandHosts()
+	parallel := int(jConfig.Parallel)
+	if parallel <= 0 {
+		parallel = 1
+	}
+
+	results := make([]TaskId, len(hostConfigs))
+	semaphore := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+	for idx, hostConfig := range hostConfigs {
+		wg.Add(1)
+		semaphore <- struct{}{}
+		go func(idx int, hostConfig *JobConfig) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+			results[idx] = RunJob(jobName, hostConfig, gConfig, storage)
+		}(idx, hostConfig)
+	}
+	wg.Wait()
+	return results
 }
@@ -1,17 +1,44 @@
 package bakapy
 
 import (
+	"io"
 	"io/ioutil"
 	"os"
+	"sync"
 	"testing"
+	"time"
 )
 
+type TestConcurrencyExecutor struct {
+	mu      sync.Mutex
+	current int
+	max     int
+	calls   int
+}
+
+func (e *TestConcurrencyExecutor) Execute(script []byte, output io.Writer, errput io.Writer) error {
+	e.mu.Lock()
+	e.calls++
+	e.current++
+	if e.current > e.max {
+		e.max = e.current
+	}
+	e.mu.Unlock()
+	time.Sleep(time.Millisecond * 50)
+	e.mu.Lock()
+	e.current--
+	e.mu.Unlock()
+	return nil
+}
+
 func TestRunJob_MetadataCreated(t *testing.T) {
 	gConfig := NewConfig()
 	gConfig.Listen = "1.1.1.1:1234"
 
 	gConfig.MetadataDir, _ = ioutil.TempDir("", "")
 	defer os.RemoveAll(gConfig.MetadataDir)
+	defer os.RemoveAll(gConfig.MetadataDir + "_artifacts")
+	defer os.RemoveAll(gConfig.MetadataDir + "_notify")
 
 	gConfig.CommandDir, _ = ioutil.TempDir("", "")
 	defer os.RemoveAll(gConfig.CommandDir)
@@ -22,8 +49,8 @@ func TestRunJob_MetadataCreated(t *testing.T) {
 		executor: &TestOkExecutor{},
 	}
 	os.Create(gConfig.CommandDir + "/" + "wow.cmd")
-	metadataPath := RunJob("testjob", jConfig, gConfig, storage)
-	meta, err := LoadJobMetadata(metadataPath)
+	taskId := RunJob("testjob", jConfig, gConfig, storage)
+	meta, err := storage.Metadata.Get(taskId)
 	if err != nil {
 		t.Fatal("cannot load metadata:", err)
 	}
@@ -45,9 +72,62 @@ func TestRunJob_MetadataDirDoesNotExist(t *testing.T) {
 		executor: &TestOkExecutor{},
 	}
 	os.Create(gConfig.CommandDir + "/" + "wow.cmd")
-	metadataPath := RunJob("testjob", jConfig, gConfig, storage)
-	_, err := LoadJobMetadata(metadataPath)
+	taskId := RunJob("testjob", jConfig, gConfig, storage)
+	_, err := storage.Metadata.Get(taskId)
 	if err == nil {
 		t.Fatal("metadata loaded but not expected")
 	}
 }
+
+func TestRunJobHosts_MetadataPerHost(t *testing.T) {
+	gConfig := NewConfig()
+	gConfig.Listen = "1.1.1.1:1234"
+
+	gConfig.MetadataDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(gConfig.MetadataDir)
+	defer os.RemoveAll(gConfig.MetadataDir + "_artifacts")
+	defer os.RemoveAll(gConfig.MetadataDir + "_notify")
+
+	gConfig.CommandDir, _ = ioutil.TempDir("", "")
+	defer os.RemoveAll(gConfig.CommandDir)
+
+	executor := &TestConcurrencyExecutor{}
+	storage := NewStorage(gConfig)
+	jConfig := &JobConfig{
+		Command:   "wow.cmd",
+		Namespace: "www",
+		Hosts:     []string{"web1", "web2", "web3", "web4", "web5"},
+		Parallel:  2,
+		executor:  executor,
+	}
+	os.Create(gConfig.CommandDir + "/" + "wow.cmd")
+	runTaskIds := RunJobHosts("testjob", jConfig, gConfig, storage)
+	if len(runTaskIds) != 5 {
+		t.Fatal("task ids length must be 5, not", len(runTaskIds))
+	}
+
+	taskIds := map[TaskId]bool{}
+	for idx, taskId := range runTaskIds {
+		meta, err := storage.Metadata.Get(taskId)
+		if err != nil {
+			t.Fatal("cannot load metadata:", err)
+		}
+		if meta.Host != jConfig.Hosts[idx] {
+			t.Fatal("bad metadata host:", meta.Host, "expected", jConfig.Hosts[idx])
+		}
+		if meta.Namespace != "www/"+jConfig.Hosts[idx] {
+			t.Fatal("bad metadata namespace:", meta.Namespace)
+		}
+		taskIds[meta.TaskId] = true
+	}
+	if len(taskIds) != 5 {
+		t.Fatal("each host must have own task id")
+	}
+
+	if executor.calls != 5 {
+		t.Fatal("executor must be called 5 times, not", executor.calls)
+	}
+	if executor.max > 2 {
+		t.Fatal("parallel limit exceeded:", executor.max)
+	}
+}